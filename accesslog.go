@@ -0,0 +1,170 @@
+package web
+
+import (
+    "bytes"
+    "io"
+    "json"
+    "os"
+    "sync"
+    "template"
+    "time"
+)
+
+//Access log formats for SetAccessLogFormat. The fields available to a template
+//are the ones of AccessLogEntry
+const (
+    CommonLogFormat   = `{RemoteHost} - - [{Time}] "{Method} {URI} {Proto}" ` + logStatus + ` {Bytes}` + "\n"
+    CombinedLogFormat = `{RemoteHost} - - [{Time}] "{Method} {URI} {Proto}" ` + logStatus + ` {Bytes} "{Referer}" "{UserAgent}"` + "\n"
+    JSONLogFormat     = "json" //one JSON object per line
+)
+
+//the status, or "hijacked" when the handler took over the connection
+const logStatus = `{.section Hijacked}hijacked{.or}{Status}{.end}`
+
+//AccessLogEntry describes a request once it has been served
+type AccessLogEntry struct {
+    RemoteHost string //the client address, see Context.ClientIP
+    Time       string //when the request started, like 10/Oct/2010:13:55:36 -0700
+    Method     string
+    URI        string //the path and query
+    Path       string
+    Query      string
+    Proto      string
+    Status     int   //0 for a hijacked connection
+    Hijacked   bool  //set when the handler took over the connection, see Context.Hijack
+    Bytes      int64 //the size of the response body
+    Duration   int64 //the time taken to serve the request, in microseconds
+    Referer    string
+    UserAgent  string
+}
+
+var accessLog io.Writer = os.Stdout
+var accessLogFile *logFile //set when logging to a file by name
+var accessLogTemplate = template.MustParse(CommonLogFormat, nil)
+var accessLogJSON bool
+var accessLogLock sync.Mutex
+
+//Sets where the access log is written. Nil disables it, which saves a little work
+//on each request for high-throughput deployments. It's written to stdout by default
+func SetAccessLog(w io.Writer) {
+    accessLogLock.Lock()
+    defer accessLogLock.Unlock()
+    closeAccessLogFile()
+    accessLog = w
+}
+
+//Appends the access log to the named file, creating it if needed. See ReopenLogs
+//for rotating it
+func SetAccessLogFile(name string) os.Error {
+    f, err := openLogFile(name)
+    if err != nil {
+        return err
+    }
+    accessLogLock.Lock()
+    defer accessLogLock.Unlock()
+    closeAccessLogFile()
+    accessLog = f
+    accessLogFile = f
+    return nil
+}
+
+func closeAccessLogFile() {
+    if accessLogFile != nil {
+        accessLogFile.Close()
+        accessLogFile = nil
+    }
+}
+
+//Sets the format of the access log: CommonLogFormat (the default),
+//CombinedLogFormat, JSONLogFormat, or a template using the fields of AccessLogEntry
+func SetAccessLogFormat(format string) os.Error {
+    accessLogLock.Lock()
+    defer accessLogLock.Unlock()
+    if format == JSONLogFormat {
+        accessLogJSON = true
+        return nil
+    }
+    t, err := template.Parse(format, nil)
+    if err != nil {
+        return err
+    }
+    accessLogTemplate = t
+    accessLogJSON = false
+    return nil
+}
+
+//loggedConn records the status and size of a response for the access log and
+//the stats
+type loggedConn struct {
+    conn
+    status   int
+    bytes    int64
+    hijacked bool
+}
+
+func (c *loggedConn) StartResponse(status int) {
+    c.status = status
+    c.conn.StartResponse(status)
+}
+
+func (c *loggedConn) Write(data []byte) (n int, err os.Error) {
+    n, err = c.conn.Write(data)
+    c.bytes += int64(n)
+    return
+}
+
+func (c *loggedConn) sentStatus() int {
+    if c.hijacked {
+        return 0
+    }
+    if c.status == 0 {
+        //nothing was written, which the server sends as an empty 200
+        return 200
+    }
+    return c.status
+}
+
+//writes the access log line for a request that started at start (in nanoseconds)
+func logAccess(ctx *Context, c *loggedConn, start int64) {
+    accessLogLock.Lock()
+    defer accessLogLock.Unlock()
+    if accessLog == nil {
+        return
+    }
+
+    req := ctx.Request
+    uri := req.URL.Path
+    if len(req.URL.RawQuery) > 0 {
+        uri += "?" + req.URL.RawQuery
+    }
+    entry := AccessLogEntry{
+        RemoteHost: ctx.ClientIP(),
+        Time:       time.SecondsToLocalTime(start / 1e9).Format("02/Jan/2006:15:04:05 -0700"),
+        Method:     req.Method,
+        URI:        uri,
+        Path:       req.URL.Path,
+        Query:      req.URL.RawQuery,
+        Proto:      req.Proto,
+        Status:     c.sentStatus(),
+        Hijacked:   c.hijacked,
+        Bytes:      c.bytes,
+        Duration:   (time.Nanoseconds() - start) / 1e3,
+        Referer:    req.Referer,
+        UserAgent:  req.UserAgent,
+    }
+
+    var buf bytes.Buffer
+    if accessLogJSON {
+        data, err := json.Marshal(entry)
+        if err != nil {
+            logErrorf("Failed to format the access log: %s", err)
+            return
+        }
+        buf.Write(data)
+        buf.WriteString("\n")
+    } else if err := accessLogTemplate.Execute(entry, &buf); err != nil {
+        logErrorf("Failed to format the access log: %s", err)
+        return
+    }
+    accessLog.Write(buf.Bytes())
+}
@@ -0,0 +1,50 @@
+package web
+
+import (
+    "encoding/base64"
+    "fmt"
+    "strings"
+)
+
+//Returns the credentials sent with HTTP Basic authentication
+func (r *Request) BasicAuth() (user string, pass string, ok bool) {
+    header, has := r.Headers["Authorization"]
+    if !has || len(header) < 6 || strings.ToLower(header[0:6]) != "basic " {
+        return
+    }
+    encoded := []byte(strings.TrimSpace(header[6:]))
+    decoded := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+    n, err := base64.StdEncoding.Decode(decoded, encoded)
+    if err != nil {
+        return
+    }
+    creds := strings.Split(string(decoded[0:n]), ":", 2)
+    if len(creds) != 2 {
+        return
+    }
+    return creds[0], creds[1], true
+}
+
+//Sends a 401 asking the client for HTTP Basic credentials for realm
+func (ctx *Context) RequireBasicAuth(realm string) {
+    ctx.SetHeader("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm), true)
+    ctx.Unauthorized("Unauthorized")
+}
+
+//Returns a function that checks the Basic credentials of a request, asking for
+//them if they're missing or rejected by check. It returns false if the request
+//was rejected, so handlers can start with:
+//
+//  if !auth(ctx) {
+//      return
+//  }
+func BasicAuthFilter(realm string, check func(user, pass string) bool) func(ctx *Context) bool {
+    return func(ctx *Context) bool {
+        user, pass, ok := ctx.BasicAuth()
+        if !ok || !check(user, pass) {
+            ctx.RequireBasicAuth(realm)
+            return false
+        }
+        return true
+    }
+}
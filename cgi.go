@@ -0,0 +1,116 @@
+package web
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+)
+
+//cgiConn writes a CGI response, which starts with a Status header instead of
+//a status line
+type cgiConn struct {
+    out          *bufio.Writer
+    headers      map[string][]string
+    wroteHeaders bool
+}
+
+func (conn *cgiConn) StartResponse(status int) {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "Status: %d %s\r\n", status, statusText[status])
+
+    conn.wroteHeaders = true
+    writeHeaders(&buf, conn.headers)
+    buf.WriteString("\r\n")
+    conn.out.Write(buf.Bytes())
+}
+
+func (conn *cgiConn) SetHeader(hdr string, val string, unique bool) {
+    if conn.wroteHeaders {
+        logErrorf("Header %s set after the response was started", hdr)
+        return
+    }
+    setHeader(conn.headers, hdr, val, unique)
+}
+
+func (conn *cgiConn) DelHeader(hdr string) {
+    if conn.wroteHeaders {
+        logErrorf("Header %s removed after the response was started", hdr)
+        return
+    }
+    conn.headers[hdr] = nil, false
+}
+
+func (conn *cgiConn) Write(data []byte) (n int, err os.Error) {
+    return conn.out.Write(data)
+}
+
+func (conn *cgiConn) Flush() { conn.out.Flush() }
+
+func (conn *cgiConn) Close() { conn.out.Flush() }
+
+//escapes a decoded path, so characters like % ? and # stay part of it
+func escapePath(path string) string {
+    const hex = "0123456789ABCDEF"
+    var buf bytes.Buffer
+    for i := 0; i < len(path); i++ {
+        c := path[i]
+        if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexRune("-._~/!$&'()*,;=:@", int(c)) != -1 {
+            buf.WriteByte(c)
+        } else {
+            buf.WriteByte('%')
+            buf.WriteByte(hex[c>>4])
+            buf.WriteByte(hex[c&15])
+        }
+    }
+    return buf.String()
+}
+
+//handles the request described by the CGI environment env, reading its body
+//from stdin and writing the response to stdout
+func serveCgi(env map[string]string, stdin io.Reader, stdout io.Writer) {
+    //routes match the path below the script, wherever it's mounted. PATH_INFO
+    //was decoded by the web server, so it's escaped again for the URL
+    uri := escapePath(env["PATH_INFO"])
+    if len(uri) == 0 {
+        uri = "/"
+    }
+    if query, _ := env["QUERY_STRING"]; len(query) > 0 {
+        uri += "?" + query
+    }
+    env["REQUEST_URI"] = uri
+    if _, ok := env["HTTP_HOST"]; !ok {
+        env["HTTP_HOST"], _ = env["SERVER_NAME"]
+    }
+
+    clen, _ := strconv.Atoi64(env["CONTENT_LENGTH"])
+    req := newRequestCgi(env, &scgiBody{stdin, clen})
+
+    conn := cgiConn{out: bufio.NewWriter(stdout), headers: make(map[string][]string)}
+    routeHandler(req, &conn)
+    conn.Flush()
+}
+
+//runs the web application as a CGI script: the request is read from the
+//environment and stdin, and the process exits once the response is written
+func RunCgi() {
+    env := make(map[string]string)
+    for _, kv := range os.Environ() {
+        if i := strings.Index(kv, "="); i > 0 {
+            env[kv[0:i]] = kv[i+1:]
+        }
+    }
+    //stdout carries the response, so the logs go to stderr
+    if accessLog == os.Stdout {
+        SetAccessLog(os.Stderr)
+    }
+    if _, ok := logger.(stdLogger); ok {
+        SetLogger(stderrLogger{})
+    }
+
+    serveCgi(env, os.Stdin, os.Stdout)
+    os.Exit(0)
+}
@@ -0,0 +1,462 @@
+package web
+
+import (
+    "container/vector"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+//settings set with SetConfig, by section and then key, both in lower case
+var configValues = make(map[string]map[string]string)
+var configLock sync.RWMutex
+
+//Sets a configuration value. It takes precedence over the environment, the config
+//file and the defaults. Sections and keys are case-insensitive
+func SetConfig(section string, key string, value string) {
+    section, key = strings.ToLower(section), strings.ToLower(key)
+    configLock.Lock()
+    defer configLock.Unlock()
+    if _, ok := configValues[section]; !ok {
+        configValues[section] = make(map[string]string)
+    }
+    configValues[section][key] = value
+}
+
+//ConfigFile holds the settings of an INI style file: sections in brackets, lines
+//like key = value, and comments starting with # or ;. Keys before the first
+//section are in the "default" section
+type ConfigFile struct {
+    sections map[string]map[string]string //by lower case section and key
+}
+
+//The config file loaded with LoadConfigFile. It's empty until one is loaded
+var Config = &ConfigFile{make(map[string]map[string]string)}
+
+//Parses a config file. The last of duplicate keys wins, and a line that's neither
+//a section, a setting nor a comment is an error
+func ParseConfig(r io.Reader) (*ConfigFile, os.Error) {
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    text := string(data)
+    if strings.HasPrefix(text, "\xef\xbb\xbf") {
+        text = text[3:]
+    }
+
+    c := &ConfigFile{make(map[string]map[string]string)}
+    section := "default"
+    for i, line := range strings.Split(text, "\n", -1) {
+        line = strings.TrimSpace(line)
+        if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+            continue
+        }
+        if line[0] == '[' {
+            if line[len(line)-1] != ']' || len(strings.TrimSpace(line[1:len(line)-1])) == 0 {
+                return nil, os.NewError(fmt.Sprintf("line %d: invalid section %q", i+1, line))
+            }
+            section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+            continue
+        }
+        eq := strings.Index(line, "=")
+        if eq == -1 || len(strings.TrimSpace(line[0:eq])) == 0 {
+            return nil, os.NewError(fmt.Sprintf("line %d: expected key = value, got %q", i+1, line))
+        }
+        key := strings.ToLower(strings.TrimSpace(line[0:eq]))
+        if _, ok := c.sections[section]; !ok {
+            c.sections[section] = make(map[string]string)
+        }
+        c.sections[section][key] = strings.TrimSpace(line[eq+1:])
+    }
+    return c, nil
+}
+
+//Reads and parses the named config file
+func ReadConfigFile(name string) (*ConfigFile, os.Error) {
+    f, err := os.Open(name, os.O_RDONLY, 0)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    c, err := ParseConfig(f)
+    if err != nil {
+        return nil, os.NewError(name + ": " + err.String())
+    }
+    return c, nil
+}
+
+//Loads the named config file into Config, where ConfigString and the other
+//getters find the settings that aren't set with SetConfig or in the environment.
+//Config is left alone if the file can't be read
+func LoadConfigFile(name string) os.Error {
+    c, err := ReadConfigFile(name)
+    if err != nil {
+        return err
+    }
+    configLock.Lock()
+    Config = c
+    configLoaded = true
+    configLock.Unlock()
+    checkEnvironment(c, Environment())
+    return nil
+}
+
+//the name of the config file loaded by default, next to the executable
+const defaultConfigFile = "webgo.config"
+
+//whether a config file was loaded, by LoadConfig, LoadConfigFile or Init
+var configLoaded bool
+
+//(Re)loads the config file and applies the settings derived from it, like the
+//cookie secret and the static directory, so main can call it before Run. The
+//file is name if it's not empty, else the one named by the WEBGO_CONFIG
+//environment variable, else webgo.config in the directory of the executable,
+//which may be missing. Settings set with SetConfig and WEBGO_SECTION_KEY
+//environment variables still take precedence over the file. An error is returned
+//if the file can't be read or is invalid, or if its settings can't be applied
+func LoadConfig(name string) os.Error {
+    optional := false
+    if len(name) == 0 {
+        name = os.Getenv("WEBGO_CONFIG")
+    }
+    if len(name) == 0 {
+        name = exeRelative(defaultConfigFile)
+        optional = true
+    }
+    if optional && !fileExists(name) {
+        return nil
+    }
+    if err := LoadConfigFile(name); err != nil {
+        return err
+    }
+    forgetSecretFiles()
+    if err := checkConfig(); err != nil {
+        return err
+    }
+    return checkCookieSecret()
+}
+
+//loads the config with LoadConfig when a server starts, unless one was loaded
+func loadDefaultConfig() os.Error {
+    configLock.RLock()
+    loaded := configLoaded
+    configLock.RUnlock()
+    if loaded {
+        return nil
+    }
+    return LoadConfig("")
+}
+
+//Returns the value of key in section, or an error if it isn't set
+func (c *ConfigFile) GetString(section string, key string) (string, os.Error) {
+    value, ok := c.sections[strings.ToLower(section)][strings.ToLower(key)]
+    if !ok {
+        return "", os.NewError(fmt.Sprintf("%s.%s is not set", section, key))
+    }
+    return value, nil
+}
+
+//Returns the value of key in section as an int
+func (c *ConfigFile) GetInt(section string, key string) (int, os.Error) {
+    value, err := c.GetString(section, key)
+    if err != nil {
+        return 0, err
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        return 0, os.NewError(fmt.Sprintf("%s.%s is not a number: %q", section, key, value))
+    }
+    return n, nil
+}
+
+//Returns the sections of the file
+func (c *ConfigFile) Sections() []string {
+    names := make([]string, 0, len(c.sections))
+    for name := range c.sections {
+        names = names[0 : len(names)+1]
+        names[len(names)-1] = name
+    }
+    return names
+}
+
+//Returns the keys set in section
+func (c *ConfigFile) Keys(section string) []string {
+    keys := c.sections[strings.ToLower(section)]
+    names := make([]string, 0, len(keys))
+    for name := range keys {
+        names = names[0 : len(names)+1]
+        names[len(names)-1] = name
+    }
+    return names
+}
+
+//the environment variable that overrides a setting, like WEBGO_WEBSERVER_STATICDIR
+func configEnvName(section string, key string) string {
+    b := []byte(strings.ToUpper("webgo_" + section + "_" + key))
+    for i, c := range b {
+        if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+            b[i] = '_'
+        }
+    }
+    return string(b)
+}
+
+//the environment set with SetEnvironment, if it was called
+var environment string
+var environmentSet bool
+
+//Selects the environment the application runs in, like "production". Settings in
+//sections like [webserver:production] then override the ones in [webserver]. It
+//defaults to the WEBGO_ENV environment variable
+func SetEnvironment(name string) {
+    configLock.Lock()
+    environment = name
+    environmentSet = true
+    file := Config
+    configLock.Unlock()
+    checkEnvironment(file, name)
+}
+
+//Returns the environment selected with SetEnvironment or WEBGO_ENV, or "" if
+//there's none
+func Environment() string {
+    configLock.RLock()
+    defer configLock.RUnlock()
+    if environmentSet {
+        return environment
+    }
+    return os.Getenv("WEBGO_ENV")
+}
+
+//notes when the config file has no sections for the environment
+func checkEnvironment(c *ConfigFile, name string) {
+    if len(name) == 0 || len(c.sections) == 0 {
+        return
+    }
+    suffix := ":" + strings.ToLower(name)
+    for section := range c.sections {
+        if strings.HasSuffix(section, suffix) {
+            return
+        }
+    }
+    logInfof("The config has no sections for the %q environment, the base sections are used", name)
+}
+
+//looks a setting up, first in the values set with SetConfig, then in the
+//environment and then in the config file. In the values set with SetConfig and
+//the file, the section of the current environment comes before the base section
+func lookupConfig(section string, key string) (string, bool) {
+    sections := []string{strings.ToLower(section)}
+    if env := Environment(); len(env) > 0 {
+        sections = []string{sections[0] + ":" + strings.ToLower(env), sections[0]}
+    }
+    key = strings.ToLower(key)
+
+    configLock.RLock()
+    file := Config
+    for _, s := range sections {
+        if value, ok := configValues[s][key]; ok {
+            configLock.RUnlock()
+            return value, true
+        }
+    }
+    configLock.RUnlock()
+
+    if value := os.Getenv(configEnvName(section, key)); len(value) > 0 {
+        return value, true
+    }
+    for _, s := range sections {
+        if value, err := file.GetString(s, key); err == nil {
+            return value, true
+        }
+    }
+    return "", false
+}
+
+//Returns a configuration value, or def if it isn't set. Values set with SetConfig
+//come first, then environment variables named like WEBGO_SECTION_KEY, and then
+//the file loaded with LoadConfigFile
+func ConfigString(section string, key string, def string) string {
+    if value, ok := lookupConfig(section, key); ok {
+        return value
+    }
+    return def
+}
+
+//Returns a configuration value as an int, or def if it isn't set or isn't a number
+func ConfigInt(section string, key string, def int) int {
+    value, ok := lookupConfig(section, key)
+    if !ok {
+        return def
+    }
+    n, err := strconv.Atoi(strings.TrimSpace(value))
+    if err != nil {
+        logErrorf("Invalid number %q for %s.%s", value, section, key)
+        return def
+    }
+    return n
+}
+
+//Returns a configuration value as a bool, or def if it isn't set. true, yes, on
+//and 1 are true, and false, no, off and 0 are false
+func ConfigBool(section string, key string, def bool) bool {
+    value, ok := lookupConfig(section, key)
+    if !ok {
+        return def
+    }
+    switch strings.ToLower(strings.TrimSpace(value)) {
+    case "true", "yes", "on", "1":
+        return true
+    case "false", "no", "off", "0":
+        return false
+    }
+    logErrorf("Invalid boolean %q for %s.%s", value, section, key)
+    return def
+}
+
+//the directory static files are served from, webserver.staticDir if it's set,
+//which is relative to the directory of the executable
+func staticDirectory() string {
+    dir := staticDir
+    if len(dir) == 0 {
+        dir = path.Join(ExeDir(), "static")
+    }
+    return exeRelative(ConfigString("webserver", "staticDir", dir))
+}
+
+//the directory templates are loaded from, webserver.templateDir if it's set
+func templateDirectory() string {
+    dir := templateDir
+    if len(dir) == 0 {
+        dir = path.Join(ExeDir(), "templates")
+    }
+    return ConfigString("webserver", "templateDir", dir)
+}
+
+//a check of the value of a setting, returning what's wrong with it
+type configCheck func(value string) os.Error
+
+//the settings web.go reads, by section and lower case key, with a check of their
+//values or nil. RegisterConfigSection adds the application's
+var configKeys = map[string]map[string]configCheck{
+    "webserver": map[string]configCheck{
+        "staticdir":   nil,
+        "templatedir": nil,
+        "protocol":    checkConfigProtocol,
+        "host":        nil,
+        "port":        checkConfigPorts,
+        "certfile":    nil,
+        "keyfile":     nil,
+    },
+    "security": map[string]configCheck{
+        "cookiesecret":     nil,
+        "cookiesecretfile": nil,
+    },
+    "log": map[string]configCheck{
+        "access": nil,
+        "error":  nil,
+    },
+}
+
+var strictConfig bool
+var configWarnings sync.Once
+
+func checkConfigProtocol(value string) os.Error {
+    switch strings.ToLower(strings.TrimSpace(value)) {
+    case "http", "https", "scgi", "fcgi":
+        return nil
+    }
+    return os.NewError("webserver.protocol must be http, https, scgi or fcgi, not " + strconv.Quote(value))
+}
+
+func checkConfigPorts(value string) os.Error {
+    _, err := parseConfigPorts(value)
+    return err
+}
+
+//Makes the problems found by ValidateConfig stop the server from starting,
+//instead of being logged
+func StrictConfig(strict bool) { strictConfig = strict }
+
+//Registers a section of the application's settings and its keys, so
+//ValidateConfig reports the other keys in it. Sections that aren't registered
+//aren't checked
+func RegisterConfigSection(section string, keys ...string) {
+    configLock.Lock()
+    defer configLock.Unlock()
+    section = strings.ToLower(section)
+    if _, ok := configKeys[section]; !ok {
+        configKeys[section] = make(map[string]configCheck)
+    }
+    for _, key := range keys {
+        configKeys[section][strings.ToLower(key)] = nil
+    }
+}
+
+//Checks the settings in the config file and the ones set with SetConfig, in
+//the sections web.go reads and the ones registered with RegisterConfigSection.
+//It returns the unknown keys, which are likely typos, and the invalid values
+func ValidateConfig() []os.Error {
+    configLock.RLock()
+    defer configLock.RUnlock()
+    var problems vector.Vector
+    check := func(sections map[string]map[string]string) {
+        for section, values := range sections {
+            base := section
+            if i := strings.Index(section, ":"); i != -1 {
+                base = section[0:i]
+            }
+            known, ok := configKeys[base]
+            if !ok {
+                continue
+            }
+            for key, value := range values {
+                valid, ok := known[key]
+                switch {
+                case !ok:
+                    problems.Push(os.NewError(fmt.Sprintf("unknown setting %s.%s", section, key)))
+                case valid != nil:
+                    if err := valid(value); err != nil {
+                        problems.Push(err)
+                    }
+                }
+            }
+        }
+    }
+    check(Config.sections)
+    check(configValues)
+
+    errors := make([]os.Error, problems.Len())
+    for i, p := range problems {
+        errors[i] = p.(os.Error)
+    }
+    return errors
+}
+
+//validates the config when a server starts. The problems are logged once, or
+//returned in strict mode
+func checkConfig() os.Error {
+    problems := ValidateConfig()
+    if len(problems) == 0 {
+        return nil
+    }
+    if strictConfig {
+        msgs := make([]string, len(problems))
+        for i, p := range problems {
+            msgs[i] = p.String()
+        }
+        return os.NewError("invalid config: " + strings.Join(msgs, "; "))
+    }
+    configWarnings.Do(func() {
+        for _, p := range problems {
+            logErrorf("Config: %s", p)
+        }
+    })
+    return nil
+}
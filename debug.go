@@ -0,0 +1,112 @@
+package web
+
+import (
+    "bytes"
+    "expvar"
+    "fmt"
+    "json"
+    "net"
+    "runtime"
+    "runtime/pprof"
+    "strings"
+)
+
+//Adds routes under prefix, like "/debug/", for diagnosing a running application:
+//heap is the heap profile for pprof, vars the expvar variables and the stats as
+//JSON, and memstats the runtime's memory statistics. Only the addresses in
+//allowFrom can use them, or the local host if it's empty; others get a 403. With
+//the local host default, requests forwarded by a proxy that isn't trusted are
+//refused too, since a proxy on the same host would otherwise let anyone in
+func EnableDebugEndpoints(prefix string, allowFrom []string) {
+    if !strings.HasSuffix(prefix, "/") {
+        prefix += "/"
+    }
+    localOnly := len(allowFrom) == 0
+    if localOnly {
+        allowFrom = []string{"127.0.0.1", "::1"}
+    }
+    allowed := make([]net.IP, 0, len(allowFrom))
+    for _, addr := range allowFrom {
+        ip := net.ParseIP(addr)
+        if ip == nil {
+            logErrorf("Invalid debug endpoint address %q", addr)
+            continue
+        }
+        allowed = allowed[0 : len(allowed)+1]
+        allowed[len(allowed)-1] = ip
+    }
+
+    Get(quoteRoute(prefix)+"heap", func(ctx *Context) {
+        if debugAllowed(ctx, allowed, localOnly) {
+            ctx.SetHeader("Content-Type", "application/octet-stream", true)
+            pprof.WriteHeapProfile(ctx)
+        }
+    })
+    Get(quoteRoute(prefix)+"vars", func(ctx *Context) {
+        if debugAllowed(ctx, allowed, localOnly) {
+            ctx.SetHeader("Content-Type", "application/json; charset=utf-8", true)
+            ctx.Write(debugVars())
+        }
+    })
+    Get(quoteRoute(prefix)+"memstats", func(ctx *Context) {
+        if debugAllowed(ctx, allowed, localOnly) {
+            ctx.WriteJSON(runtime.MemStats)
+        }
+    })
+}
+
+//sends a 403 unless the client is one of the allowed addresses. When localOnly,
+//forwarded requests only count if they come from a trusted proxy
+func debugAllowed(ctx *Context, allowed []net.IP, localOnly bool) bool {
+    ip := net.ParseIP(ctx.ClientIP())
+    if localOnly && !ctx.Request.fromTrustedProxy() {
+        _, xff := ctx.Request.Headers["X-Forwarded-For"]
+        _, realIP := ctx.Request.Headers["X-Real-Ip"]
+        if xff || realIP {
+            ip = nil
+        }
+    }
+    if ip != nil {
+        for _, a := range allowed {
+            if bytes.Equal(ip.To16(), a.To16()) {
+                return true
+            }
+        }
+    }
+    ctx.Forbidden("Forbidden")
+    return false
+}
+
+//the expvar variables as a JSON object, along with the stats
+func debugVars() []byte {
+    var buf bytes.Buffer
+    buf.WriteString("{")
+    first := true
+    for kv := range expvar.Iter() {
+        if !first {
+            buf.WriteString(",")
+        }
+        first = false
+        fmt.Fprintf(&buf, "\n%q: %s", kv.Key, kv.Value.String())
+    }
+    if s, err := json.Marshal(Stats()); err == nil {
+        if !first {
+            buf.WriteString(",")
+        }
+        fmt.Fprintf(&buf, "\n%q: %s", "webgo", s)
+    }
+    buf.WriteString("\n}\n")
+    return buf.Bytes()
+}
+
+//escapes the regular expression characters in a literal path
+func quoteRoute(path string) string {
+    var buf bytes.Buffer
+    for _, c := range path {
+        if strings.IndexRune(`\.+*?()|[]{}^$`, c) != -1 {
+            buf.WriteByte('\\')
+        }
+        buf.WriteString(string(c))
+    }
+    return buf.String()
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+    "bytes"
+    "os"
+    "strings"
+)
+
+//EventStream sends server-sent events to an EventSource in the browser
+type EventStream struct {
+    ctx    *Context
+    closed bool
+}
+
+//Starts a text/event-stream response. Events are sent to the client as long as
+//the handler doesn't return, so it has to block while sending them:
+//
+//  es := ctx.EventStream()
+//  for msg := range messages {
+//      if es.Send("message", msg) != nil {
+//          break
+//      }
+//  }
+func (ctx *Context) EventStream() *EventStream {
+    ctx.SetHeader("Content-Type", "text/event-stream", true)
+    ctx.SetHeader("Cache-Control", "no-cache", true)
+    if ctx.buffer != nil {
+        ctx.FlushBuffer()
+    } else if !ctx.responseStarted {
+        ctx.StartResponse(200)
+    }
+    ctx.Flush()
+    return &EventStream{ctx: ctx}
+}
+
+//Sends an event to the client. The event name can be empty, and multi-line data
+//is sent as several data fields. An error means the client went away
+func (es *EventStream) Send(event string, data string) os.Error {
+    var buf bytes.Buffer
+    if len(event) > 0 {
+        buf.WriteString("event: " + event + "\n")
+    }
+    for _, line := range strings.Split(data, "\n", -1) {
+        buf.WriteString("data: " + line + "\n")
+    }
+    buf.WriteString("\n")
+
+    if _, err := es.ctx.Write(buf.Bytes()); err != nil {
+        es.closed = true
+        return err
+    }
+    es.ctx.Flush()
+    return nil
+}
+
+//Returns true once sending an event failed because the client disconnected
+func (es *EventStream) Closed() bool { return es.closed }
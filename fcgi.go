@@ -4,11 +4,10 @@ import (
     "bytes"
     "bufio"
     "encoding/binary"
-    "fmt"
     "io"
-    "log"
     "net"
     "os"
+    "sync"
 )
 
 const (
@@ -88,108 +87,178 @@ func (er fcgiEndReq) bytes() []byte {
     return buf
 }
 
-type fcgiConn struct {
-    requestId    uint16
-    fd           io.ReadWriteCloser
-    headers      map[string][]string
-    wroteHeaders bool
+//the role of a web.go application, from FCGI_BEGIN_REQUEST
+const fcgiResponder = 1
+
+//the FCGI_BEGIN_REQUEST flag asking to keep the connection open after the request
+const fcgiKeepConn = 1
+
+//the values sent in answer to FCGI_GET_VALUES. Requests are handled concurrently,
+//so they can be multiplexed on a connection
+var fcgiValues = map[string]string{
+    "FCGI_MAX_CONNS":  "1000",
+    "FCGI_MAX_REQS":   "1000",
+    "FCGI_MPXS_CONNS": "1",
 }
 
-func (conn *fcgiConn) fcgiWrite(data []byte) (err os.Error) {
-    l := len(data)
-    // round to the nearest 8
-    padding := make([]byte, uint8(-l&7))
-    hdr := fcgiHeader{
-        Version:       1,
-        Type:          fcgiStdout,
-        RequestId:     conn.requestId,
-        ContentLength: uint16(l),
-        PaddingLength: uint8(len(padding)),
+//fcgiServerConn is a connection from the web server, carrying one or more
+//requests. They are handled in their own goroutines, so records written to the
+//connection have to be serialized
+type fcgiServerConn struct {
+    fd      io.ReadWriteCloser
+    lock    sync.Mutex
+    active  int       //the requests being handled
+    reading bool      //cleared once no more requests can arrive
+    closed  bool
+    idle    chan bool //signaled when the last request is done after reading stopped
+}
+
+//a request whose params and stdin are still being read
+type fcgiRequest struct {
+    id       uint16
+    keepConn bool
+    params   map[string]string
+    body     bytes.Buffer
+}
+
+func (sc *fcgiServerConn) writeRecord(typ int, requestId uint16, data []byte) os.Error {
+    sc.lock.Lock()
+    defer sc.lock.Unlock()
+    if sc.closed {
+        return os.EPIPE
     }
+    _, err := sc.fd.Write(newFcgiRecord(typ, int(requestId), data))
+    return err
+}
 
-    //write the header
-    hdrBytes := hdr.bytes()
-    _, err = conn.fd.Write(hdrBytes)
+//sends FCGI_END_REQUEST for a request
+func (sc *fcgiServerConn) endRequest(requestId uint16, protocolStatus uint8) {
+    content := fcgiEndReq{appStatus: 0, protocolStatus: protocolStatus}.bytes()
+    sc.writeRecord(fcgiEndRequest, requestId, content)
+}
 
-    if err != nil {
-        return err
+func (sc *fcgiServerConn) close() {
+    sc.lock.Lock()
+    defer sc.lock.Unlock()
+    if !sc.closed {
+        sc.closed = true
+        sc.fd.Close()
     }
+}
 
-    _, err = conn.fd.Write(data)
-    if err != nil {
-        return err
+//handles a request once its stdin has been read
+func (sc *fcgiServerConn) serveRequest(r *fcgiRequest) {
+    req := newRequestCgi(r.params, &r.body)
+    fc := &fcgiConn{requestId: r.id, sc: sc, headers: make(map[string][]string), req: req}
+    routeHandler(req, fc)
+    //the end of the request ends the response, so it's sent right after the body
+    sc.endRequest(r.id, fcgiRequestComplete)
+    if !r.keepConn {
+        sc.close()
     }
 
-    _, err = conn.fd.Write(padding)
-    if err != nil {
-        return err
+    sc.lock.Lock()
+    defer sc.lock.Unlock()
+    sc.active--
+    if sc.active == 0 && !sc.reading {
+        sc.idle <- true
     }
+}
 
-    return err
+//answers FCGI_GET_VALUES with the values that were asked for
+func (sc *fcgiServerConn) getValues(content []byte) {
+    names := map[string]string{}
+    readFcgiParams(content, names)
+    var buf bytes.Buffer
+    for name, _ := range names {
+        if val, ok := fcgiValues[name]; ok {
+            buf.Write(fcgiParam(name, val))
+        }
+    }
+    sc.writeRecord(fcgiGetValuesResult, 0, buf.Bytes())
 }
 
-func (conn *fcgiConn) Write(data []byte) (n int, err os.Error) {
+//encodes a name-value pair
+func fcgiParam(key string, val string) []byte {
     var buf bytes.Buffer
-    if !conn.wroteHeaders {
-        conn.wroteHeaders = true
-        for k, v := range conn.headers {
-            for _, i := range v {
-                buf.WriteString(k + ": " + i + "\r\n")
-            }
+    for _, s := range []string{key, val} {
+        if len(s) < 128 {
+            buf.WriteByte(byte(len(s)))
+        } else {
+            size := make([]byte, 4)
+            binary.BigEndian.PutUint32(size, uint32(len(s))|1<<31)
+            buf.Write(size)
         }
-        buf.WriteString("\r\n")
-        conn.fcgiWrite(buf.Bytes())
     }
+    buf.WriteString(key)
+    buf.WriteString(val)
+    return buf.Bytes()
+}
+
+type fcgiConn struct {
+    requestId    uint16
+    sc           *fcgiServerConn
+    headers      map[string][]string
+    wroteHeaders bool
+    req          *Request //the request being answered
+}
 
-    err = conn.fcgiWrite(data)
+func (conn *fcgiConn) fcgiWrite(data []byte) os.Error {
+    return conn.sc.writeRecord(fcgiStdout, conn.requestId, data)
+}
 
-    if err != nil {
-        return 0, err
+//the content of a record is limited by its 16-bit length
+const fcgiMaxWrite = 65535
+
+func (conn *fcgiConn) Write(data []byte) (n int, err os.Error) {
+    for len(data) > 0 {
+        chunk := data
+        if len(chunk) > fcgiMaxWrite {
+            chunk = chunk[0:fcgiMaxWrite]
+        }
+        err = conn.fcgiWrite(chunk)
+        if err != nil {
+            return n, err
+        }
+        n += len(chunk)
+        data = data[len(chunk):]
     }
 
-    return len(data), nil
+    return n, nil
 }
 
 func (conn *fcgiConn) StartResponse(status int) {
     var buf bytes.Buffer
-    text := statusText[status]
-    fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, text)
+    buf.WriteString(statusLine(conn.req, status))
+
+    //the headers are written along with the status, so that
+    //responses without a body (like a 304) are complete
+    conn.wroteHeaders = true
+    closeUnframed(conn.headers, status, conn.req)
+    writeHeaders(&buf, conn.headers)
+    buf.WriteString("\r\n")
     conn.fcgiWrite(buf.Bytes())
 }
 
 func (conn *fcgiConn) SetHeader(hdr string, val string, unique bool) {
-    if _, contains := conn.headers[hdr]; !contains {
-        conn.headers[hdr] = []string{val}
+    if conn.wroteHeaders {
+        logErrorf("Header %s set after the response was started", hdr)
         return
     }
-
-    if unique {
-        //just overwrite the first value
-        conn.headers[hdr][0] = val
-    } else {
-        newHeaders := make([]string, len(conn.headers)+1)
-        copy(newHeaders, conn.headers[hdr])
-        newHeaders[len(newHeaders)-1] = val
-        conn.headers[hdr] = newHeaders
-    }
+    setHeader(conn.headers, hdr, val, unique)
 }
 
-func (conn *fcgiConn) complete() {
-    content := fcgiEndReq{appStatus: 200, protocolStatus: fcgiRequestComplete}.bytes()
-    l := len(content)
-
-    hdr := fcgiHeader{
-        Version:       1,
-        Type:          fcgiEndRequest,
-        RequestId:     uint16(conn.requestId),
-        ContentLength: uint16(l),
-        PaddingLength: 0,
+func (conn *fcgiConn) DelHeader(hdr string) {
+    if conn.wroteHeaders {
+        logErrorf("Header %s removed after the response was started", hdr)
+        return
     }
-
-    conn.fd.Write(hdr.bytes())
-    conn.fd.Write(content)
+    conn.headers[hdr] = nil, false
 }
 
+//records are written straight to the socket, so there's nothing to flush
+func (conn *fcgiConn) Flush() {}
+
 func (conn *fcgiConn) Close() {}
 
 func readFcgiParamSize(data []byte, index int) (int, int) {
@@ -226,12 +295,12 @@ func readFcgiParams(data []byte, storage map[string]string) {
     }
 }
 
+//reads the records of a connection, until the web server closes it or a request
+//without FCGI_KEEP_CONN is done. It returns once all its requests have been handled
 func handleFcgiConnection(fd io.ReadWriteCloser) {
     br := bufio.NewReader(fd)
-    var req *Request
-    var fc *fcgiConn
-    var body bytes.Buffer
-    headers := map[string]string{}
+    sc := &fcgiServerConn{fd: fd, reading: true, idle: make(chan bool, 1)}
+    requests := map[uint16]*fcgiRequest{}
 
     for {
         var h fcgiHeader
@@ -239,57 +308,110 @@ func handleFcgiConnection(fd io.ReadWriteCloser) {
         if err == os.EOF {
             break
         }
-        if err != nil {
-            log.Stderrf("FCGI Error", err.String())
-            break
+        if err == nil {
+            content := make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+            _, err = io.ReadFull(br, content)
+            content = content[0:h.ContentLength]
+            if err == nil {
+                handleFcgiRecord(sc, requests, &h, content)
+                continue
+            }
         }
-        content := make([]byte, h.ContentLength)
-        br.Read(content)
 
-        //read padding
-        if h.PaddingLength > 0 {
-            padding := make([]byte, h.PaddingLength)
-            br.Read(padding)
+        sc.lock.Lock()
+        closed := sc.closed
+        sc.lock.Unlock()
+        if !closed && err != io.ErrUnexpectedEOF {
+            logErrorf("FCGI read error: %s", err)
         }
+        break
+    }
 
-        switch h.Type {
-        case fcgiBeginRequest:
-            fc = &fcgiConn{h.RequestId, fd, make(map[string][]string), false}
+    sc.lock.Lock()
+    sc.reading = false
+    active := sc.active
+    sc.lock.Unlock()
+    if active > 0 {
+        <-sc.idle
+    }
+    sc.close()
+}
 
-        case fcgiParams:
-            if h.ContentLength > 0 {
-                readFcgiParams(content, headers)
-            }
-        case fcgiStdin:
-            if h.ContentLength > 0 {
-                body.Write(content)
-            } else if h.ContentLength == 0 {
-                req = newRequestCgi(headers, &body)
-                routeHandler(req, fc)
-                fc.complete()
-            }
-        case fcgiData:
-            if h.ContentLength > 0 {
-                body.Write(content)
+func handleFcgiRecord(sc *fcgiServerConn, requests map[uint16]*fcgiRequest, h *fcgiHeader, content []byte) {
+    r, ok := requests[h.RequestId]
+
+    switch h.Type {
+    case fcgiBeginRequest:
+        if len(content) < 3 {
+            return
+        }
+        role := binary.BigEndian.Uint16(content[0:2])
+        if role != fcgiResponder {
+            sc.endRequest(h.RequestId, fcgiUnknownRole)
+            return
+        }
+        requests[h.RequestId] = &fcgiRequest{
+            id:       h.RequestId,
+            keepConn: content[2]&fcgiKeepConn != 0,
+            params:   map[string]string{},
+        }
+
+    case fcgiParams:
+        if ok && h.ContentLength > 0 {
+            readFcgiParams(content, r.params)
+        }
+
+    case fcgiStdin:
+        if !ok {
+            return
+        }
+        if h.ContentLength > 0 {
+            r.body.Write(content)
+            return
+        }
+        //the empty record ends stdin, so the request is complete
+        requests[h.RequestId] = nil, false
+        sc.lock.Lock()
+        sc.active++
+        sc.lock.Unlock()
+        go sc.serveRequest(r)
+
+    case fcgiData:
+        if ok && h.ContentLength > 0 {
+            r.body.Write(content)
+        }
+
+    case fcgiAbortRequest:
+        //requests that are already being handled run to completion
+        if ok {
+            requests[h.RequestId] = nil, false
+            sc.endRequest(h.RequestId, fcgiRequestComplete)
+            if !r.keepConn {
+                sc.close()
             }
-        case fcgiAbortRequest:
         }
+
+    case fcgiGetValues:
+        sc.getValues(content)
+
+    default:
+        body := make([]byte, 8)
+        body[0] = h.Type
+        sc.writeRecord(fcgiUnknownType, 0, body)
     }
 }
 
 func listenAndServeFcgi(addr string) {
-    l, err := net.Listen("tcp", addr)
+    l, err := listen(addr)
     if err != nil {
-        log.Stderrf("FCGI listen error", err.String())
+        logErrorf("FCGI listen error: %s", err)
         return
     }
+    serveFcgi(l)
+}
 
-    for {
-        fd, err := l.Accept()
-        if err != nil {
-            log.Stderrf("FCGI accept error", err.String())
-            break
-        }
-        go handleFcgiConnection(fd)
+func serveFcgi(l net.Listener) {
+    if err := serve("fcgi", l); err != nil {
+        logErrorf("FCGI accept error: %s", err)
     }
 }
@@ -0,0 +1,116 @@
+package web
+
+import (
+    "container/list"
+    "io/ioutil"
+    "os"
+    "sync"
+)
+
+//a static file held in memory
+type cachedFile struct {
+    name  string
+    data  []byte
+    mtime int64
+    etag  string
+}
+
+func (cf *cachedFile) ReadAt(b []byte, off int64) (n int, err os.Error) {
+    if off >= int64(len(cf.data)) {
+        return 0, os.EOF
+    }
+    n = copy(b, cf.data[off:])
+    if n < len(b) {
+        err = os.EOF
+    }
+    return n, err
+}
+
+//keeps the contents of small static files in memory, evicting the least
+//recently used ones when the total size goes over the limit
+type staticCache struct {
+    lock        sync.Mutex
+    maxFileSize int64
+    maxSize     int64
+    size        int64
+    files       map[string]*list.Element
+    lru         *list.List //the most recently used file is at the front
+}
+
+//the cache of static files, nil when it's disabled
+var fileCache *staticCache
+
+//Keeps static files of up to maxBytesPerFile in memory, using at most
+//maxTotalBytes in total. A cached file is reloaded when its modification time
+//changes. The cache is disabled by default, and a maxTotalBytes of 0 disables it
+func EnableStaticCache(maxBytesPerFile int, maxTotalBytes int) {
+    if maxBytesPerFile <= 0 || maxTotalBytes <= 0 {
+        fileCache = nil
+        return
+    }
+    fileCache = &staticCache{
+        maxFileSize: int64(maxBytesPerFile),
+        maxSize:     int64(maxTotalBytes),
+        files:       make(map[string]*list.Element),
+        lru:         list.New(),
+    }
+}
+
+//returns the cached copy of a file, reading it into the cache if needed. nil is
+//returned for files that can't be cached, which should be served from disk
+func (c *staticCache) load(name string) *cachedFile {
+    info, err := os.Stat(name)
+    if err != nil || !info.IsRegular() || info.Size > c.maxFileSize || info.Size > c.maxSize {
+        return nil
+    }
+    if cf := c.get(name, info.Mtime_ns, info.Size); cf != nil {
+        return cf
+    }
+
+    data, err := ioutil.ReadFile(name)
+    if err != nil || int64(len(data)) != info.Size {
+        //the file changed while it was read
+        return nil
+    }
+    cf := &cachedFile{name, data, info.Mtime_ns, fileETag(name, info.Size, info.Mtime_ns)}
+    c.add(cf)
+    return cf
+}
+
+func (c *staticCache) get(name string, mtime int64, size int64) *cachedFile {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    e, ok := c.files[name]
+    if !ok {
+        return nil
+    }
+    cf := e.Value.(*cachedFile)
+    if cf.mtime != mtime || int64(len(cf.data)) != size {
+        c.remove(e)
+        return nil
+    }
+    c.lru.MoveToFront(e)
+    return cf
+}
+
+func (c *staticCache) add(cf *cachedFile) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if e, ok := c.files[cf.name]; ok {
+        c.remove(e)
+    }
+    c.files[cf.name] = c.lru.PushFront(cf)
+    c.size += int64(len(cf.data))
+    for c.size > c.maxSize {
+        c.remove(c.lru.Back())
+    }
+}
+
+func (c *staticCache) remove(e *list.Element) {
+    cf := e.Value.(*cachedFile)
+    c.lru.Remove(e)
+    c.files[cf.name] = nil, false
+    c.size -= int64(len(cf.data))
+}
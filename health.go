@@ -0,0 +1,94 @@
+package web
+
+import (
+    "container/vector"
+    "fmt"
+    "json"
+    "os"
+    "strconv"
+    "sync"
+)
+
+//the paths of the health and readiness endpoints, empty when they're disabled
+var healthPath string
+var readinessPath string
+
+type healthCheck struct {
+    name  string
+    check func() os.Error
+}
+
+//runs the check, turning a panic into a failure
+func (hc *healthCheck) run() (err os.Error) {
+    defer func() {
+        if e := recover(); e != nil {
+            logErrorf("Health check %s panicked: %v", hc.name, e)
+            err = os.NewError(fmt.Sprintf("panic: %v", e))
+        }
+    }()
+    return hc.check()
+}
+
+var healthChecks vector.Vector
+var healthLock sync.Mutex
+
+//Answers liveness probes at path, like "/health", with a 200 "ok" as long as the
+//process serves requests. The checks added with AddHealthCheck aren't run, so an
+//outage of a dependency doesn't get the process restarted. Probes aren't logged
+//or counted in the stats, and they're answered even when
+//SetMaxConcurrentRequests makes other requests wait
+func EnableHealthEndpoint(path string) { healthPath = path }
+
+//Answers readiness probes at path, like "/ready", with a 200 "ok", or with a 503
+//and a JSON object listing the checks added with AddHealthCheck that failed. Like
+//the health probes, they skip the logs, the stats and the request limit
+func EnableReadinessEndpoint(path string) { readinessPath = path }
+
+//Adds a check that's run on every readiness probe, like pinging the database.
+//The probe gets a 503 when it returns an error
+func AddHealthCheck(name string, check func() os.Error) {
+    healthLock.Lock()
+    healthChecks.Push(&healthCheck{name, check})
+    healthLock.Unlock()
+}
+
+//returns true for the probes of the health and readiness endpoints
+func isHealthProbe(req *Request) bool {
+    if req.Method != "GET" && req.Method != "HEAD" {
+        return false
+    }
+    path := req.URL.Path
+    return len(healthPath) > 0 && path == healthPath || len(readinessPath) > 0 && path == readinessPath
+}
+
+//sends "ok" to a health probe. A readiness probe runs the checks first, and
+//gets the failures if there are any
+func serveHealth(ctx *Context) {
+    failing := make(map[string]string)
+    if len(readinessPath) > 0 && ctx.Request.URL.Path == readinessPath {
+        healthLock.Lock()
+        checks := healthChecks.Copy()
+        healthLock.Unlock()
+
+        for _, c := range checks {
+            hc := c.(*healthCheck)
+            if err := hc.run(); err != nil {
+                failing[hc.name] = err.String()
+            }
+        }
+    }
+
+    ctx.SetHeader("Cache-Control", "no-cache", true)
+    if len(failing) == 0 {
+        ctx.SetHeader("Content-Type", "text/plain; charset=utf-8", true)
+        ctx.SetHeader("Content-Length", "2", true)
+        ctx.StartResponse(200)
+        ctx.WriteString("ok")
+        return
+    }
+    data, _ := json.Marshal(map[string]map[string]string{"failing": failing})
+    ctx.SetHeader("Content-Type", "application/json; charset=utf-8", true)
+    ctx.SetHeader("Content-Length", strconv.Itoa(len(data)), true)
+    ctx.StartResponse(503)
+    ctx.Write(data)
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+    "http"
+    "os"
+    "strconv"
+    "strings"
+)
+
+//the Strict-Transport-Security header sent over https, if it's enabled
+var hstsHeader string
+
+//Adds a Strict-Transport-Security header to the responses sent over https,
+//telling browsers to use https for maxAge seconds. Requests are considered
+//secure when the connection uses TLS, when the scgi or fastcgi front end sets
+//HTTPS, or when a trusted proxy sends X-Forwarded-Proto: https. maxAge 0
+//disables the header
+func EnableHSTS(maxAge int64, includeSubdomains bool) {
+    if maxAge <= 0 {
+        hstsHeader = ""
+        return
+    }
+    hstsHeader = "max-age=" + strconv.Itoa64(maxAge)
+    if includeSubdomains {
+        hstsHeader += "; includeSubDomains"
+    }
+}
+
+//returns true if the request reached the front end over https
+func (r *Request) isHTTPS() bool {
+    if r.tls {
+        return true
+    }
+    if proto, ok := r.forwardedHeader("X-Forwarded-Proto"); ok {
+        return strings.ToLower(proto) == "https"
+    }
+    return false
+}
+
+//Returns true if the client reached the application over https, directly or
+//through a trusted proxy
+func (ctx *Context) IsSecure() bool { return ctx.Request.isHTTPS() }
+
+//Listens for http requests on httpAddr in the background, and redirects them all
+//to the same path on https. httpsHost is the host, and the port if it isn't 443,
+//of the https server; if it's empty, the Host of the request is used. Routes and
+//static files aren't consulted, and neither the config checks nor the OnStart
+//hooks are run for it. Close stops it along with the other listeners
+func RedirectToHTTPS(httpAddr string, httpsHost string) os.Error {
+    l, err := listen(httpAddr)
+    if err != nil {
+        return err
+    }
+    tl := &trackingListener{l}
+    serverLock.Lock()
+    listeners[tl] = true
+    serverLock.Unlock()
+
+    handler := http.HandlerFunc(func(c *http.Conn, req *http.Request) { redirectToHTTPS(c, req, httpsHost) })
+    logInfof("web.go redirecting %s to https", httpAddr)
+    go func() {
+        err := http.Serve(tl, handler)
+        serverLock.Lock()
+        defer serverLock.Unlock()
+        if !listeners[tl] {
+            //closed by Close
+            return
+        }
+        listeners[tl] = false, false
+        closeListener(l)
+        logErrorf("Redirect listener error: %s", err)
+    }()
+    return nil
+}
+
+func redirectToHTTPS(c *http.Conn, req *http.Request, httpsHost string) {
+    host := httpsHost
+    if len(host) == 0 {
+        host = hostOnly(req.Host)
+    }
+    uri := req.RawURL
+    if !strings.HasPrefix(uri, "/") {
+        uri = req.URL.Path
+        if len(req.URL.RawQuery) > 0 {
+            uri += "?" + req.URL.RawQuery
+        }
+    }
+    if len(host) == 0 {
+        c.WriteHeader(400)
+        return
+    }
+
+    body := "Redirecting to https"
+    c.SetHeader("Location", "https://"+host+uri)
+    c.SetHeader("Content-Type", "text/plain; charset=utf-8")
+    c.SetHeader("Content-Length", strconv.Itoa(len(body)))
+    c.WriteHeader(301)
+    c.Write([]byte(body))
+}
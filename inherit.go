@@ -0,0 +1,245 @@
+package web
+
+import (
+    "container/vector"
+    "exec"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+)
+
+//the listening socket passed by systemd, and by Relaunch to the new process
+const inheritedFd = 3
+
+//fdAddr is the address of a socket that was inherited, or accepted from one
+type fdAddr struct {
+    network string
+    addr    string
+}
+
+func (a fdAddr) Network() string { return a.network }
+
+func (a fdAddr) String() string { return a.addr }
+
+func sockaddrString(sa syscall.Sockaddr) string {
+    switch a := sa.(type) {
+    case *syscall.SockaddrInet4:
+        return net.IP(a.Addr[0:]).String() + ":" + strconv.Itoa(a.Port)
+    case *syscall.SockaddrInet6:
+        return "[" + net.IP(a.Addr[0:]).String() + "]:" + strconv.Itoa(a.Port)
+    case *syscall.SockaddrUnix:
+        return a.Name
+    }
+    return ""
+}
+
+//fdListener accepts connections on a listening socket the process inherited. The
+//socket is blocking, and Close shuts it down to wake the Accept calls, which
+//close it once they've all returned
+type fdListener struct {
+    file      *os.File
+    addr      fdAddr
+    lock      sync.Mutex
+    closed    bool
+    accepting int
+}
+
+func newFdListener(fd int) (*fdListener, os.Error) {
+    sa, errno := syscall.Getsockname(fd)
+    if errno != 0 {
+        return nil, os.NewSyscallError("getsockname", errno)
+    }
+    if errno = syscall.SetNonblock(fd, false); errno != 0 {
+        return nil, os.NewSyscallError("setnonblock", errno)
+    }
+    syscall.CloseOnExec(fd)
+    network := "tcp"
+    if _, ok := sa.(*syscall.SockaddrUnix); ok {
+        network = "unix"
+    }
+    addr := fdAddr{network, sockaddrString(sa)}
+    return &fdListener{file: os.NewFile(fd, addr.addr), addr: addr}, nil
+}
+
+func (l *fdListener) Accept() (net.Conn, os.Error) {
+    l.lock.Lock()
+    if l.closed {
+        l.lock.Unlock()
+        return nil, os.EINVAL
+    }
+    l.accepting++
+    l.lock.Unlock()
+    defer l.doneAccepting()
+
+    for {
+        nfd, sa, errno := syscall.Accept(l.file.Fd())
+        switch errno {
+        case 0:
+            syscall.CloseOnExec(nfd)
+            remote := fdAddr{l.addr.network, sockaddrString(sa)}
+            return &fdConn{os.NewFile(nfd, remote.addr), l.addr, remote}, nil
+        case syscall.EINTR, syscall.ECONNABORTED:
+            continue
+        }
+        l.lock.Lock()
+        closed := l.closed
+        l.lock.Unlock()
+        if closed {
+            return nil, os.EINVAL
+        }
+        return nil, os.NewSyscallError("accept", errno)
+    }
+    return nil, os.EINVAL
+}
+
+//closes the socket after a Close, once the last Accept has returned
+func (l *fdListener) doneAccepting() {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    l.accepting--
+    if l.closed && l.accepting == 0 {
+        l.file.Close()
+    }
+}
+
+func (l *fdListener) Close() os.Error {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    if l.closed {
+        return os.EINVAL
+    }
+    l.closed = true
+    if l.accepting > 0 {
+        //wakes the blocked Accept calls, the last of which closes the socket
+        if errno := syscall.Shutdown(l.file.Fd(), syscall.SHUT_RD); errno != 0 {
+            return os.NewSyscallError("shutdown", errno)
+        }
+        return nil
+    }
+    return l.file.Close()
+}
+
+func (l *fdListener) Addr() net.Addr { return l.addr }
+
+//fdConn is a connection accepted by an fdListener
+type fdConn struct {
+    *os.File
+    local  net.Addr
+    remote net.Addr
+}
+
+func (c *fdConn) LocalAddr() net.Addr { return c.local }
+
+func (c *fdConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *fdConn) SetTimeout(nsec int64) os.Error { return nil }
+
+func (c *fdConn) SetReadTimeout(nsec int64) os.Error { return nil }
+
+func (c *fdConn) SetWriteTimeout(nsec int64) os.Error { return nil }
+
+//the listener served by RunInherited, and the variable it came from
+var inherited *fdListener
+var inheritedEnvVar string
+
+//returns the descriptor named by the environment variable fdEnvVar. For systemd's
+//LISTEN_FDS, it's the first socket passed to the process
+func inheritedFdFromEnv(fdEnvVar string) (int, os.Error) {
+    value := os.Getenv(fdEnvVar)
+    if len(value) == 0 {
+        return -1, os.NewError(fdEnvVar + " is not set")
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+        return -1, os.NewError("Invalid " + fdEnvVar + " " + strconv.Quote(value))
+    }
+    if fdEnvVar != "LISTEN_FDS" {
+        return n, nil
+    }
+    if pid := os.Getenv("LISTEN_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+        return -1, os.NewError("LISTEN_FDS was meant for process " + pid)
+    }
+    if n < 1 {
+        return -1, os.NewError("no sockets were passed in LISTEN_FDS")
+    }
+    return inheritedFd, nil
+}
+
+//runs the web application and serves http requests on a listening socket the
+//process inherited. fdEnvVar is the environment variable holding its descriptor
+//number, or LISTEN_FDS for socket activation by systemd. See Relaunch
+func RunInherited(fdEnvVar string) {
+    fd, err := inheritedFdFromEnv(fdEnvVar)
+    if err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
+    l, err := newFdListener(fd)
+    if err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
+    inherited = l
+    inheritedEnvVar = fdEnvVar
+
+    logInfof("web.go serving inherited %s", l.Addr())
+    if err = serve("http", l); err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
+}
+
+//Starts a new copy of the program, handing it the socket served by RunInherited,
+//for restarting without refusing connections. Once it's started, this process
+//shuts down with Close, letting the requests being handled finish, and exits
+func Relaunch() os.Error {
+    l := inherited
+    if l == nil {
+        return os.NewError("Relaunch needs a server started with RunInherited")
+    }
+
+    argv0 := os.Args[0]
+    if strings.Index(argv0, "/") == -1 {
+        path, err := exec.LookPath(argv0)
+        if err != nil {
+            return err
+        }
+        argv0 = path
+    }
+    dir, err := os.Getwd()
+    if err != nil {
+        return err
+    }
+
+    //the socket becomes descriptor 3 of the new process
+    value := strconv.Itoa(inheritedFd)
+    if inheritedEnvVar == "LISTEN_FDS" {
+        value = "1"
+    }
+    var env vector.StringVector
+    env.Push(inheritedEnvVar + "=" + value)
+    for _, kv := range os.Environ() {
+        if !strings.HasPrefix(kv, inheritedEnvVar+"=") && !strings.HasPrefix(kv, "LISTEN_PID=") {
+            env.Push(kv)
+        }
+    }
+
+    l.lock.Lock()
+    if l.closed {
+        l.lock.Unlock()
+        return os.NewError("the inherited socket was closed")
+    }
+    files := []*os.File{os.Stdin, os.Stdout, os.Stderr, l.file}
+    pid, err := os.ForkExec(argv0, os.Args, env.Copy(), dir, files)
+    l.lock.Unlock()
+    if err != nil {
+        return err
+    }
+
+    logInfof("web.go relaunched as process %d", pid)
+    go func() {
+        Close()
+        os.Exit(0)
+    }()
+    return nil
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+    "os"
+    "path"
+    "strings"
+    "sync"
+)
+
+//InitOptions are the settings of Init. The zero value of a field keeps the default
+type InitOptions struct {
+    ExeDir       string //the directory relative paths are resolved in, instead of the executable's
+    ConfigFile   string //a config file to load, see LoadConfigFile
+    Environment  string //see SetEnvironment
+    StaticDir    string //see SetStaticDir
+    TemplateDir  string //see SetTemplateDir
+    CookieSecret string //see SetCookieSecret
+}
+
+//runs the default setup the first time the package needs it, unless Init ran
+var initOnce sync.Once
+
+func lazyInit() { initOnce.Do(defaultInit) }
+
+//finds the directory of the executable, which the static and template
+//directories are in by default
+func defaultInit() {
+    wd, _ := os.Getwd()
+    exeDir = findExeDir(os.Args[0], wd, os.Getenv("PATH"))
+}
+
+//Sets the package up explicitly, instead of with the defaults guessed from the
+//location of the executable the first time they're needed. It returns an error
+//if the config file can't be loaded or a directory doesn't exist
+func Init(opts InitOptions) os.Error {
+    initOnce.Do(func() {})
+
+    if len(opts.ExeDir) > 0 {
+        dir := opts.ExeDir
+        if !strings.HasPrefix(dir, "/") {
+            wd, err := os.Getwd()
+            if err != nil {
+                return err
+            }
+            dir = path.Join(wd, dir)
+        }
+        if !dirExists(dir) {
+            return os.NewError("web.Init: the directory " + dir + " does not exist")
+        }
+        exeDir = path.Clean(dir)
+    } else if len(exeDir) == 0 {
+        defaultInit()
+    }
+
+    if len(opts.Environment) > 0 {
+        SetEnvironment(opts.Environment)
+    }
+    if len(opts.ConfigFile) > 0 {
+        if err := LoadConfigFile(opts.ConfigFile); err != nil {
+            return err
+        }
+    }
+    if len(opts.StaticDir) > 0 {
+        if err := SetStaticDir(opts.StaticDir); err != nil {
+            return err
+        }
+    }
+    if len(opts.TemplateDir) > 0 {
+        dir := opts.TemplateDir
+        if !strings.HasPrefix(dir, "/") {
+            dir = path.Join(exeDir, dir)
+        }
+        if err := SetTemplateDir(dir); err != nil {
+            return err
+        }
+    }
+    if len(opts.CookieSecret) > 0 {
+        SetCookieSecret(opts.CookieSecret)
+    }
+    return nil
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+    "bytes"
+    "json"
+    "os"
+    "regexp"
+    "strconv"
+)
+
+var jsonpEnabled = true
+
+var jsonpParam = "callback"
+
+//callback names are restricted to dotted javascript identifiers, so they can't
+//be used to inject script into the response
+var jsonpCallback = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+
+const maxJSONPCallback = 128
+
+//Enables or disables JSONP responses from WriteJSON. It's enabled by default
+func SetJSONP(enabled bool) { jsonpEnabled = enabled }
+
+//Sets the query parameter holding the JSONP callback name, "callback" by default
+func SetJSONPParam(name string) { jsonpParam = name }
+
+//Writes v encoded as JSON. If JSONP is enabled and the request has a callback
+//parameter, the output is wrapped in a call to it instead. An invalid callback
+//name is answered with a 400
+func (ctx *Context) WriteJSON(v interface{}) os.Error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+
+    contentType := "application/json; charset=utf-8"
+    if callback, ok := ctx.jsonpCallback(); ok {
+        if len(callback) > maxJSONPCallback || !jsonpCallback.MatchString(callback) {
+            ctx.BadRequest("Invalid JSONP callback")
+            return nil
+        }
+        var buf bytes.Buffer
+        buf.WriteString(callback + "(")
+        buf.Write(data)
+        buf.WriteString(");")
+        data = buf.Bytes()
+        contentType = "application/javascript; charset=utf-8"
+    }
+
+    ctx.SetHeader("Content-Type", contentType, true)
+    ctx.SetHeader("Content-Length", strconv.Itoa(len(data)), true)
+    _, err = ctx.Write(data)
+    return err
+}
+
+func (ctx *Context) jsonpCallback() (string, bool) {
+    if !jsonpEnabled || ctx.Request.Params == nil {
+        return "", false
+    }
+    values, ok := ctx.Request.Params[jsonpParam]
+    if !ok || len(values) == 0 {
+        return "", false
+    }
+    return values[0], true
+}
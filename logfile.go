@@ -0,0 +1,150 @@
+package web
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+//logFile is a log opened by name, which can be reopened after it's rotated. If
+//writing to it fails, the output goes to stderr until it's reopened
+type logFile struct {
+    name   string
+    lock   sync.Mutex
+    file   *os.File
+    failed bool
+}
+
+func openLogFile(name string) (*logFile, os.Error) {
+    file, err := os.Open(name, os.O_WRONLY|os.O_APPEND|os.O_CREAT, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &logFile{name: name, file: file}, nil
+}
+
+func (f *logFile) Write(data []byte) (n int, err os.Error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    if !f.failed {
+        if n, err = f.file.Write(data); err == nil {
+            return
+        }
+        f.failed = true
+        fmt.Fprintf(os.Stderr, "web.go: writing to %s failed, logging to stderr until it's reopened: %s\n", f.name, err)
+    }
+    return os.Stderr.Write(data)
+}
+
+//opens the file again, so a rotated log is written to a new file. The old file is
+//kept if it can't be opened
+func (f *logFile) reopen() os.Error {
+    file, err := os.Open(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREAT, 0644)
+    if err != nil {
+        return err
+    }
+    f.lock.Lock()
+    old := f.file
+    f.file = file
+    f.failed = false
+    f.lock.Unlock()
+    old.Close()
+    return nil
+}
+
+func (f *logFile) Close() os.Error {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.file.Close()
+}
+
+//fileLogger writes web.go's messages to a file set with SetErrorLogFile
+type fileLogger struct {
+    f *logFile
+}
+
+func (l fileLogger) write(format string, v []interface{}) {
+    now := time.LocalTime().Format("2006/01/02 15:04:05 ")
+    l.f.Write([]byte(now + fmt.Sprintf(format, v) + "\n"))
+}
+
+func (l fileLogger) Debugf(format string, v ...interface{}) { l.write(format, v) }
+
+func (l fileLogger) Infof(format string, v ...interface{}) { l.write(format, v) }
+
+func (l fileLogger) Errorf(format string, v ...interface{}) { l.write(format, v) }
+
+var errorLogFile *logFile
+
+//Appends web.go's messages, of every level, to the named file instead of stdout
+//and stderr. SetLogger replaces it
+func SetErrorLogFile(name string) os.Error {
+    f, err := openLogFile(name)
+    if err != nil {
+        return err
+    }
+    closeErrorLogFile()
+    errorLogFile = f
+    logger = fileLogger{f}
+    return nil
+}
+
+func closeErrorLogFile() {
+    if errorLogFile != nil {
+        errorLogFile.Close()
+        errorLogFile = nil
+    }
+}
+
+//Reopens the access log and the error log when they're written to files by
+//name. After moving the files away, log rotation tools can call it by sending the
+//process SIGUSR1, once ReopenLogsOnSignal is enabled
+func ReopenLogs() os.Error {
+    var err os.Error
+    accessLogLock.Lock()
+    if accessLogFile != nil {
+        err = accessLogFile.reopen()
+    }
+    accessLogLock.Unlock()
+    if errorLogFile != nil {
+        if e := errorLogFile.reopen(); e != nil && err == nil {
+            err = e
+        }
+    }
+    return err
+}
+
+var reopenOnSignal = false
+
+//Sets whether SIGUSR1 reopens the log files with ReopenLogs. Until it's enabled,
+//web.go leaves the signal to the application
+func ReopenLogsOnSignal(enabled bool) {
+    reopenOnSignal = enabled
+    if enabled {
+        startSignalWatcher()
+    }
+}
+
+//opens the files named by log.access and log.error in the config when a server
+//starts, unless they're already the ones written to
+func applyLogConfig() os.Error {
+    if name := ConfigString("log", "access", ""); len(name) > 0 {
+        accessLogLock.Lock()
+        open := accessLogFile != nil && accessLogFile.name == name
+        accessLogLock.Unlock()
+        if !open {
+            if err := SetAccessLogFile(name); err != nil {
+                return err
+            }
+        }
+    }
+    if name := ConfigString("log", "error", ""); len(name) > 0 {
+        if errorLogFile == nil || errorLogFile.name != name {
+            if err := SetErrorLogFile(name); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+    "fmt"
+    "log"
+    "os"
+)
+
+//Logger receives the messages logged by web.go, so they can go wherever the
+//application's own logs go
+type Logger interface {
+    Debugf(format string, v ...interface{})
+    Infof(format string, v ...interface{})
+    Errorf(format string, v ...interface{})
+}
+
+//Log levels for SetLogLevel
+const (
+    LogDebug = iota
+    LogInfo
+    LogError
+    LogNone
+)
+
+//stdLogger writes errors to stderr and everything else to stdout
+type stdLogger struct{}
+
+func (l stdLogger) Debugf(format string, v ...interface{}) { log.Stdout(fmt.Sprintf(format, v)) }
+
+func (l stdLogger) Infof(format string, v ...interface{}) { log.Stdout(fmt.Sprintf(format, v)) }
+
+func (l stdLogger) Errorf(format string, v ...interface{}) { log.Stderr(fmt.Sprintf(format, v)) }
+
+//stderrLogger writes everything to stderr, for when stdout carries the response
+type stderrLogger struct{}
+
+func (l stderrLogger) Debugf(format string, v ...interface{}) { log.Stderr(fmt.Sprintf(format, v)) }
+
+func (l stderrLogger) Infof(format string, v ...interface{}) { log.Stderr(fmt.Sprintf(format, v)) }
+
+func (l stderrLogger) Errorf(format string, v ...interface{}) { log.Stderr(fmt.Sprintf(format, v)) }
+
+var logger Logger = stdLogger{}
+var logLevel = LogInfo
+
+//Sets the logger used for web.go's messages. Nil restores the default, which
+//writes errors to stderr and the rest to stdout
+func SetLogger(l Logger) {
+    closeErrorLogFile()
+    if l == nil {
+        l = stdLogger{}
+    }
+    logger = l
+}
+
+//Sets the least important level that's logged. It's LogInfo by default; LogError
+//keeps the errors but silences messages like startup lines and malformed requests
+func SetLogLevel(level int) { logLevel = level }
+
+func logDebugf(format string, v ...interface{}) {
+    if logLevel <= LogDebug {
+        logger.Debugf(format, v)
+    }
+}
+
+func logInfof(format string, v ...interface{}) {
+    if logLevel <= LogInfo {
+        logger.Infof(format, v)
+    }
+}
+
+func logErrorf(format string, v ...interface{}) {
+    if logLevel <= LogError {
+        logger.Errorf(format, v)
+    }
+}
+
+//logs an error the application can't recover from, and exits
+func logFatalf(format string, v ...interface{}) {
+    logger.Errorf(format, v)
+    os.Exit(1)
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "reflect"
+    "runtime"
+    "sort"
+    "strconv"
+    "template"
+)
+
+//Modes for SetMode
+const (
+    DevMode  = "dev"
+    ProdMode = "prod"
+)
+
+var mode = ProdMode
+
+//Sets the mode the application runs in. In DevMode, panics and errors returned
+//by handlers are shown in the browser with the stack and the request, templates
+//and static files are read from disk every time, and every response has
+//Cache-Control: no-store. ProdMode, the default, sends a plain 500 for them and
+//uses the caches
+func SetMode(m string) os.Error {
+    if m != DevMode && m != ProdMode {
+        return os.NewError(fmt.Sprintf("Unknown mode %q", m))
+    }
+    mode = m
+    return nil
+}
+
+//Returns the mode set with SetMode
+func Mode() string { return mode }
+
+func isDevMode() bool { return mode == DevMode }
+
+//calls the handler of a route, turning a panic into an error page
+func callHandler(ctx *Context, route *Route, args []reflect.Value) (ret []reflect.Value) {
+    defer func() {
+        if e := recover(); e != nil {
+            handlerFailed(ctx, route.method+" "+route.r, fmt.Sprintf("panic: %v", e), callerStack(2))
+            ret = nil
+        }
+    }()
+    return route.handler.Call(args)
+}
+
+//calls the static fallback, turning a panic into an error page. It reports
+//whether the request was answered
+func callStaticFallback(ctx *Context, path string) (served bool) {
+    defer func() {
+        if e := recover(); e != nil {
+            handlerFailed(ctx, "static fallback for "+path, fmt.Sprintf("panic: %v", e), callerStack(2))
+            served = true
+        }
+    }()
+    return staticFallback(ctx, path)
+}
+
+//calls a WebSocket handler, logging a panic instead of letting it end the
+//process. The connection has been upgraded, so there's no error page
+func callWebSocketHandler(ctx *Context, ws *WebSocketConn, handler func(*Context, *WebSocketConn)) {
+    defer func() {
+        if e := recover(); e != nil {
+            handlerFailed(ctx, "WebSocket "+ctx.Request.URL.Path, fmt.Sprintf("panic: %v", e), callerStack(2))
+        }
+    }()
+    handler(ctx, ws)
+}
+
+//returns the error returned by a handler, if its last result is a non-nil os.Error
+func handlerError(ret []reflect.Value) os.Error {
+    if len(ret) == 0 {
+        return nil
+    }
+    err, _ := ret[len(ret)-1].Interface().(os.Error)
+    return err
+}
+
+//logs a handler's failure and sends an error page, if the response hasn't started
+func handlerFailed(ctx *Context, handler string, message string, stack string) {
+    logErrorf("Handler for %s failed: %s\n%s", handler, message, stack)
+    if ctx.buffer != nil {
+        //nothing has been sent yet
+        ctx.buffer = nil
+        ctx.responseStarted = false
+    }
+    if ctx.responseStarted {
+        return
+    }
+    if !isDevMode() {
+        ctx.Abort(500, "Internal Server Error")
+        return
+    }
+
+    var buf bytes.Buffer
+    errorPage.Execute(&errorPageData{message, stack, requestDump(ctx.Request)}, &buf)
+    ctx.SetHeader("Content-Type", "text/html; charset=utf-8", true)
+    ctx.SetHeader("Content-Length", strconv.Itoa(buf.Len()), true)
+    ctx.StartResponse(500)
+    ctx.Write(buf.Bytes())
+}
+
+//returns the stack of the calling goroutine, skipping skip frames
+func callerStack(skip int) string {
+    var buf bytes.Buffer
+    for i := skip + 1; ; i++ {
+        pc, file, line, ok := runtime.Caller(i)
+        if !ok {
+            break
+        }
+        name := "?"
+        if f := runtime.FuncForPC(pc); f != nil {
+            name = f.Name()
+        }
+        fmt.Fprintf(&buf, "%s:%d %s\n", file, line, name)
+    }
+    return buf.String()
+}
+
+//describes a request for the error page, with its headers and parameters sorted
+func requestDump(req *Request) string {
+    var buf bytes.Buffer
+    uri := req.URL.Path
+    if len(req.URL.RawQuery) > 0 {
+        uri += "?" + req.URL.RawQuery
+    }
+    fmt.Fprintf(&buf, "%s %s %s\n", req.Method, uri, req.Proto)
+    names := make([]string, 0, len(req.Headers))
+    for name := range req.Headers {
+        names = names[0 : len(names)+1]
+        names[len(names)-1] = name
+    }
+    sort.SortStrings(names)
+    for _, name := range names {
+        fmt.Fprintf(&buf, "%s: %s\n", name, req.Headers[name])
+    }
+
+    if len(req.Params) > 0 {
+        buf.WriteString("\nParameters:\n")
+        names = make([]string, 0, len(req.Params))
+        for name := range req.Params {
+            names = names[0 : len(names)+1]
+            names[len(names)-1] = name
+        }
+        sort.SortStrings(names)
+        for _, name := range names {
+            fmt.Fprintf(&buf, "%s = %q\n", name, req.Params[name])
+        }
+    }
+    return buf.String()
+}
+
+type errorPageData struct {
+    Message string
+    Stack   string
+    Request string
+}
+
+var errorPage = template.MustParse(`<html>
+<head><title>500 Internal Server Error</title></head>
+<body>
+<h1>{Message|html}</h1>
+<h2>Stack</h2>
+<pre>{Stack|html}</pre>
+<h2>Request</h2>
+<pre>{Request|html}</pre>
+</body>
+</html>
+`, nil)
@@ -0,0 +1,246 @@
+package web
+
+import (
+    "os"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+//the most brackets in a parameter name, and the most parameters, that are
+//turned into NestedParams
+const maxParamDepth = 16
+const maxParamKeys = 1000
+
+//splits a parameter name like user[emails][] into user, emails and "". Names
+//that aren't in the bracket syntax are kept whole
+func splitParamKey(key string) []string {
+    i := strings.Index(key, "[")
+    if i <= 0 {
+        return []string{key}
+    }
+    segs := make([]string, 1, strings.Count(key, "[")+1)
+    segs[0] = key[0:i]
+    for rest := key[i:]; len(rest) > 0; {
+        end := strings.Index(rest, "]")
+        if rest[0] != '[' || end == -1 || len(segs) == cap(segs) {
+            return []string{key}
+        }
+        segs = segs[0 : len(segs)+1]
+        segs[len(segs)-1] = rest[1:end]
+        rest = rest[end+1:]
+    }
+    return segs
+}
+
+//builds NestedParams from the flat parameters. Brackets make nested maps, and a
+//trailing [] keeps all the values in a []string, while the other names keep their
+//first value. A name that clashes with another one, or has [] before its end, is
+//left out
+func nestParams(params map[string][]string) (map[string]interface{}, os.Error) {
+    nested := make(map[string]interface{})
+    if len(params) > maxParamKeys {
+        return nested, os.NewError("too many parameters, the limit is " + strconv.Itoa(maxParamKeys))
+    }
+    keys := make([]string, 0, len(params))
+    for key := range params {
+        keys = keys[0 : len(keys)+1]
+        keys[len(keys)-1] = key
+    }
+    //sorted, so the same one of clashing names is kept every time
+    sort.SortStrings(keys)
+
+    var err os.Error
+    for _, key := range keys {
+        segs := splitParamKey(key)
+        if len(segs) > maxParamDepth+1 {
+            if err == nil {
+                err = os.NewError("parameter " + strconv.Quote(key) + " is nested too deeply")
+            }
+            continue
+        }
+
+        values := params[key]
+        var value interface{}
+        if last := len(segs) - 1; last > 0 && len(segs[last]) == 0 {
+            list := make([]string, len(values))
+            copy(list, values)
+            value = list
+            segs = segs[0:last]
+        } else if len(values) > 0 {
+            value = values[0]
+        } else {
+            value = ""
+        }
+
+        //[] is only supported at the end
+        m := nested
+        for _, seg := range segs {
+            if len(seg) == 0 {
+                m = nil
+            }
+        }
+        for _, seg := range segs[0 : len(segs)-1] {
+            if m == nil {
+                break
+            }
+            if _, ok := m[seg]; !ok {
+                m[seg] = make(map[string]interface{})
+            }
+            next, ok := m[seg].(map[string]interface{})
+            if !ok {
+                m = nil
+                break
+            }
+            m = next
+        }
+        if leaf := segs[len(segs)-1]; m != nil {
+            if _, ok := m[leaf]; !ok {
+                m[leaf] = value
+            }
+        }
+    }
+    return nested, err
+}
+
+//Builds NestedParams from Params, the first time it's called. The error tells why
+//some of the parameters were left out, like when there are too many or they are
+//nested too deeply. It isn't a ParseError, so requests that don't use nested
+//parameters aren't affected
+func (r *Request) ParseNestedParams() (map[string]interface{}, os.Error) {
+    if r.NestedParams == nil {
+        r.NestedParams, r.nestError = nestParams(r.Params)
+    }
+    return r.NestedParams, r.nestError
+}
+
+//Fills the exported fields of the struct v points to from NestedParams, matching
+//the names without regard to case. With a prefix, like "user", the fields come
+//from parameters like user[name]. Nested structs are filled from deeper
+//brackets, and slices from names ending in []. The fields of the parameters
+//that are missing are left alone. The error of ParseNestedParams is returned
+//without filling anything
+func (r *Request) BindParams(prefix string, v interface{}) os.Error {
+    data, err := r.ParseNestedParams()
+    if err != nil {
+        return err
+    }
+    if len(prefix) > 0 {
+        m, ok := data[prefix].(map[string]interface{})
+        if !ok {
+            return os.NewError("no parameters under " + strconv.Quote(prefix))
+        }
+        data = m
+    }
+    pv, ok := reflect.NewValue(v).(*reflect.PtrValue)
+    if !ok {
+        return os.NewError("BindParams needs a pointer to a struct")
+    }
+    sv, ok := pv.Elem().(*reflect.StructValue)
+    if !ok {
+        return os.NewError("BindParams needs a pointer to a struct")
+    }
+    return bindStruct(sv, data, prefix)
+}
+
+func bindStruct(sv *reflect.StructValue, data map[string]interface{}, name string) os.Error {
+    byName := make(map[string]interface{})
+    for key, value := range data {
+        byName[strings.ToLower(key)] = value
+    }
+    st := sv.Type().(*reflect.StructType)
+    var err os.Error
+    for i := 0; i < st.NumField(); i++ {
+        f := st.Field(i)
+        value, ok := byName[strings.ToLower(f.Name)]
+        if !ok || len(f.PkgPath) > 0 {
+            continue
+        }
+        fieldName := f.Name
+        if len(name) > 0 {
+            fieldName = name + "[" + f.Name + "]"
+        }
+        if e := bindValue(sv.Field(i), value, fieldName); e != nil && err == nil {
+            err = e
+        }
+    }
+    return err
+}
+
+func bindValue(fv reflect.Value, value interface{}, name string) os.Error {
+    switch fv := fv.(type) {
+    case *reflect.StructValue:
+        m, ok := value.(map[string]interface{})
+        if !ok {
+            return os.NewError(name + " needs bracketed parameters")
+        }
+        return bindStruct(fv, m, name)
+    case *reflect.SliceValue:
+        values, ok := value.([]string)
+        if !ok {
+            s, ok := value.(string)
+            if !ok {
+                return os.NewError(name + " needs a list of values")
+            }
+            values = []string{s}
+        }
+        slice := reflect.MakeSlice(fv.Type().(*reflect.SliceType), len(values), len(values))
+        for i, s := range values {
+            if err := setParamValue(slice.Elem(i), s, name); err != nil {
+                return err
+            }
+        }
+        fv.SetValue(slice)
+        return nil
+    }
+    switch value := value.(type) {
+    case string:
+        return setParamValue(fv, value, name)
+    case []string:
+        if len(value) > 0 {
+            return setParamValue(fv, value[0], name)
+        }
+        return nil
+    }
+    return os.NewError(name + " needs a single value")
+}
+
+//converts s to the type of fv, like the typed Param methods do
+func setParamValue(fv reflect.Value, s string, name string) os.Error {
+    var err os.Error
+    switch fv := fv.(type) {
+    case *reflect.StringValue:
+        fv.Set(s)
+    case *reflect.IntValue:
+        var n int64
+        if n, err = strconv.Atoi64(s); err == nil {
+            fv.Set(n)
+        }
+    case *reflect.UintValue:
+        var n uint64
+        if n, err = strconv.Atoui64(s); err == nil {
+            fv.Set(n)
+        }
+    case *reflect.FloatValue:
+        var f float64
+        if f, err = strconv.Atof64(s); err == nil {
+            fv.Set(f)
+        }
+    case *reflect.BoolValue:
+        switch strings.ToLower(s) {
+        case "1", "true", "on":
+            fv.Set(true)
+        case "0", "false", "off":
+            fv.Set(false)
+        default:
+            err = os.EINVAL
+        }
+    default:
+        return os.NewError(name + " has the unsupported type " + fv.Type().String())
+    }
+    if err != nil {
+        return os.NewError("invalid value " + strconv.Quote(s) + " for " + name)
+    }
+    return nil
+}
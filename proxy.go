@@ -0,0 +1,280 @@
+package web
+
+import (
+    "net"
+    "strconv"
+    "strings"
+)
+
+//a proxy address, or a network of them
+type trustedNet struct {
+    ip   net.IP //in 16 byte form, masked
+    mask []byte
+}
+
+//the proxies whose forwarding headers are trusted
+var trustedProxies []trustedNet
+
+//Sets the addresses of the proxies in front of the application, either single
+//addresses or networks like "10.0.0.0/8". The X-Forwarded-* and X-Real-IP
+//headers are only honored for requests coming from these addresses
+func SetTrustedProxies(addrs []string) {
+    proxies := make([]trustedNet, 0, len(addrs))
+    for _, addr := range addrs {
+        n, ok := parseTrustedNet(addr)
+        if !ok {
+            logErrorf("Invalid trusted proxy address %q", addr)
+            continue
+        }
+        proxies = proxies[0 : len(proxies)+1]
+        proxies[len(proxies)-1] = n
+    }
+    trustedProxies = proxies
+}
+
+//parses an address, or a network in CIDR notation
+func parseTrustedNet(addr string) (trustedNet, bool) {
+    bits := -1
+    if i := strings.Index(addr, "/"); i != -1 {
+        n, err := strconv.Atoi(addr[i+1:])
+        if err != nil || n < 0 {
+            return trustedNet{}, false
+        }
+        bits = n
+        addr = addr[0:i]
+    }
+    ip := net.ParseIP(strings.TrimSpace(addr))
+    if ip == nil {
+        return trustedNet{}, false
+    }
+    ip = ip.To16()
+    switch {
+    case bits == -1:
+        bits = 128
+    case ip.To4() != nil:
+        if bits > 32 {
+            return trustedNet{}, false
+        }
+        bits += 96
+    case bits > 128:
+        return trustedNet{}, false
+    }
+
+    mask := make([]byte, 16)
+    masked := make(net.IP, 16)
+    for i := range mask {
+        switch {
+        case bits >= 8:
+            mask[i] = 0xff
+            bits -= 8
+        case bits > 0:
+            mask[i] = byte(0xff << uint(8-bits))
+            bits = 0
+        }
+        masked[i] = ip[i] & mask[i]
+    }
+    return trustedNet{masked, mask}, true
+}
+
+func (n trustedNet) contains(ip net.IP) bool {
+    ip = ip.To16()
+    if ip == nil {
+        return false
+    }
+    for i := range n.mask {
+        if ip[i]&n.mask[i] != n.ip[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func isTrustedProxy(ip net.IP) bool {
+    for _, proxy := range trustedProxies {
+        if proxy.contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+//returns true if the request comes straight from a trusted proxy
+func (r *Request) fromTrustedProxy() bool {
+    return isTrustedProxy(net.ParseIP(hostOnly(r.RemoteAddr)))
+}
+
+//returns the first value of a forwarding header, if the request comes from a
+//trusted proxy and the header is set
+func (r *Request) forwardedHeader(name string) (string, bool) {
+    value, ok := r.Headers[name]
+    if !ok || !r.fromTrustedProxy() {
+        return "", false
+    }
+    if i := strings.Index(value, ","); i != -1 {
+        value = value[0:i]
+    }
+    return strings.TrimSpace(value), true
+}
+
+//strips the port from an address like "1.2.3.4:80" or "[::1]:80"
+func hostOnly(addr string) string {
+    if strings.HasPrefix(addr, "[") {
+        if end := strings.Index(addr, "]"); end != -1 {
+            return addr[1:end]
+        }
+        return addr
+    }
+    if strings.Count(addr, ":") == 1 {
+        return addr[0:strings.Index(addr, ":")]
+    }
+    return addr
+}
+
+//Returns the address of the client. When the request comes from a trusted proxy,
+//X-Forwarded-For is walked from right to left past the trusted hops, falling
+//back to X-Real-IP. Malformed headers are ignored
+func (ctx *Context) ClientIP() string {
+    remote := net.ParseIP(hostOnly(ctx.Request.RemoteAddr))
+    if remote == nil {
+        return hostOnly(ctx.Request.RemoteAddr)
+    }
+    if !isTrustedProxy(remote) {
+        return remote.String()
+    }
+
+    if xff, ok := ctx.Request.Headers["X-Forwarded-For"]; ok {
+        hops := strings.Split(xff, ",", -1)
+        client := remote
+        for i := len(hops) - 1; i >= 0; i-- {
+            ip := net.ParseIP(hostOnly(strings.TrimSpace(hops[i])))
+            if ip == nil {
+                return remote.String()
+            }
+            client = ip
+            if !isTrustedProxy(ip) {
+                break
+            }
+        }
+        return client.String()
+    }
+
+    if realIP, ok := ctx.Request.Headers["X-Real-Ip"]; ok {
+        if ip := net.ParseIP(strings.TrimSpace(realIP)); ip != nil {
+            return ip.String()
+        }
+    }
+
+    return remote.String()
+}
+
+//the path the application is mounted at, set with SetURLPrefix
+var urlPrefix string
+
+//Sets the path the application is mounted at behind a proxy, like "/myapp". It's
+//stripped from request paths before they are routed, and added to redirects to
+//absolute paths. Without it, the prefix comes from SCRIPT_NAME with scgi and
+//fastcgi, or from the X-Forwarded-Prefix header of trusted proxies
+func SetURLPrefix(prefix string) { urlPrefix = cleanURLPrefix(prefix) }
+
+//returns prefix with a leading slash and no trailing one, or "" if it's invalid
+func cleanURLPrefix(prefix string) string {
+    prefix = strings.TrimSpace(prefix)
+    for strings.HasSuffix(prefix, "/") {
+        prefix = prefix[0 : len(prefix)-1]
+    }
+    if len(prefix) == 0 {
+        return ""
+    }
+    for _, bad := range []string{"\r", "\n", "\\", "?", "#", "//"} {
+        if strings.Index(prefix, bad) != -1 {
+            return ""
+        }
+    }
+    if !strings.HasPrefix(prefix, "/") {
+        prefix = "/" + prefix
+    }
+    return prefix
+}
+
+//finds the path the application is mounted at for a request
+func requestPrefix(req *Request) string {
+    if len(urlPrefix) > 0 {
+        return urlPrefix
+    }
+    if len(req.scriptName) > 0 {
+        return cleanURLPrefix(req.scriptName)
+    }
+    if prefix, ok := req.forwardedHeader("X-Forwarded-Prefix"); ok {
+        return cleanURLPrefix(prefix)
+    }
+    return ""
+}
+
+//removes prefix from a request path, unless the proxy already did
+func stripURLPrefix(path string, prefix string) string {
+    if len(prefix) == 0 {
+        return path
+    }
+    if path == prefix {
+        return "/"
+    }
+    if strings.HasPrefix(path, prefix+"/") {
+        return path[len(prefix):]
+    }
+    return path
+}
+
+//Returns the path the application is mounted at, like "/myapp", or "" when
+//it's served from the root
+func (ctx *Context) URLPrefix() string { return ctx.prefix }
+
+//returns true if a trusted proxy says how the client reached it
+func (r *Request) hasForwardedOrigin() bool {
+    for _, name := range []string{"X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port"} {
+        if _, ok := r.forwardedHeader(name); ok {
+            return true
+        }
+    }
+    return false
+}
+
+//Returns the scheme, host and port the client used to reach the application,
+//followed by the URL prefix, like "https://example.com/myapp". Behind a trusted
+//proxy, X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port are used
+func (ctx *Context) BaseURL() string {
+    req := ctx.Request
+    scheme := "http"
+    if req.isHTTPS() {
+        scheme = "https"
+    }
+    host := req.Host
+    if fh, ok := req.forwardedHeader("X-Forwarded-Host"); ok && validHost(fh) {
+        host = fh
+    }
+    if port, ok := req.forwardedHeader("X-Forwarded-Port"); ok {
+        if n, err := strconv.Atoi(port); err == nil && n > 0 && n < 65536 {
+            name := hostOnly(host)
+            if strings.Index(name, ":") != -1 {
+                name = "[" + name + "]"
+            }
+            host = name
+            if !(scheme == "http" && n == 80) && !(scheme == "https" && n == 443) {
+                host += ":" + port
+            }
+        }
+    }
+    return scheme + "://" + host + ctx.prefix
+}
+
+//returns false for hosts that could change the meaning of a URL they're put in
+func validHost(host string) bool {
+    if len(host) == 0 {
+        return false
+    }
+    for _, c := range host {
+        if c <= ' ' || strings.IndexRune("/\\?#@", c) != -1 {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+    "container/vector"
+    "fmt"
+    "os"
+)
+
+//RouteRegistrar collects the routes and static mounts of a new route table, see
+//ReplaceRoutes. Its methods work like the package functions of the same names
+type RouteRegistrar struct {
+    routes vector.Vector
+    mounts vector.Vector
+    err    os.Error //the first registration that failed
+}
+
+func (r *RouteRegistrar) add(route string, method string, handler interface{}) *Route {
+    rt, err := newRoute(route, method, handler)
+    if err != nil {
+        r.fail(err)
+        return nil
+    }
+    r.routes.Push(rt)
+    return rt
+}
+
+func (r *RouteRegistrar) fail(err os.Error) {
+    if r.err == nil {
+        r.err = err
+    }
+}
+
+//Adds a handler for the 'GET' http method.
+func (r *RouteRegistrar) Get(route string, handler interface{}) *Route {
+    return r.add(route, "GET", handler)
+}
+
+//Adds a handler for the 'POST' http method.
+func (r *RouteRegistrar) Post(route string, handler interface{}) *Route {
+    return r.add(route, "POST", handler)
+}
+
+//Adds a handler for the 'PUT' http method.
+func (r *RouteRegistrar) Put(route string, handler interface{}) *Route {
+    return r.add(route, "PUT", handler)
+}
+
+//Adds a handler for the 'PATCH' http method.
+func (r *RouteRegistrar) Patch(route string, handler interface{}) *Route {
+    return r.add(route, "PATCH", handler)
+}
+
+//Adds a handler for the 'DELETE' http method.
+func (r *RouteRegistrar) Delete(route string, handler interface{}) *Route {
+    return r.add(route, "DELETE", handler)
+}
+
+//Adds a WebSocket route
+func (r *RouteRegistrar) Websocket(route string, handler func(ctx *Context, ws *WebSocketConn)) *Route {
+    rt := r.add(route, "GET", handler)
+    if rt != nil {
+        rt.websocket = handler
+    }
+    return rt
+}
+
+//Serves the files in dir under urlPrefix. A missing directory makes
+//ReplaceRoutes fail
+func (r *RouteRegistrar) Static(urlPrefix string, dir string) {
+    mount, err := newStaticMount(urlPrefix, dir)
+    if err != nil {
+        r.fail(err)
+        return
+    }
+    r.mounts.Push(mount)
+}
+
+//Serves the files in assets under urlPrefix
+func (r *RouteRegistrar) StaticFromMap(urlPrefix string, assets map[string][]byte) {
+    r.mounts.Push(newAssetMount(urlPrefix, assets))
+}
+
+//Replaces every route and static mount with the ones register adds, which is
+//handy for reloading them during development. The new table is built first and
+//swapped in at once: requests being served finish with the old routes, and the
+//next ones use the new routes. If a registration fails, or register panics, the
+//old table is kept and the error returned. Routes added by functions like
+//EnableStatsEndpoint are dropped too, unless register adds them again
+func ReplaceRoutes(register func(r *RouteRegistrar)) (err os.Error) {
+    r := new(RouteRegistrar)
+    if err = buildRoutes(r, register); err != nil {
+        return err
+    }
+    routesLock.Lock()
+    routes = r.routes
+    staticMounts = r.mounts
+    routesLock.Unlock()
+    return nil
+}
+
+//runs register, turning a panic into an error
+func buildRoutes(r *RouteRegistrar, register func(r *RouteRegistrar)) (err os.Error) {
+    defer func() {
+        if e := recover(); e != nil {
+            err = os.NewError(fmt.Sprintf("Failed to register the routes: %v", e))
+        }
+    }()
+    register(r)
+    return r.err
+}
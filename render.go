@@ -0,0 +1,107 @@
+package web
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "path"
+    "strconv"
+    "sync"
+    "template"
+)
+
+//directory the templates are loaded from, set with SetTemplateDir. "" is the
+//templates directory of ExeDir
+var templateDir string
+
+//when set, templates are read from disk for every request
+var templateDebug bool
+
+var templateCache = make(map[string]*template.Template)
+var templateLock sync.Mutex
+
+//LayoutData is what layout templates are executed with
+type LayoutData struct {
+    Content string      //the rendered inner template
+    Data    interface{} //the data the inner template was executed with
+}
+
+//changes the location of the template directory. by default, it's under the 'templates'
+//folder of the directory containing the web application
+func SetTemplateDir(dir string) os.Error {
+    if !dirExists(dir) {
+        msg := fmt.Sprintf("Failed to set template directory %q - does not exist", dir)
+        return os.NewError(msg)
+    }
+    templateLock.Lock()
+    templateDir = dir
+    templateCache = make(map[string]*template.Template)
+    templateLock.Unlock()
+
+    return nil
+}
+
+//In debug mode templates are read from disk on every request, so changes show
+//up without restarting the application
+func SetTemplateDebug(debug bool) { templateDebug = debug }
+
+//returns the parsed template, from the cache unless debugging or in DevMode
+func loadTemplate(name string) (*template.Template, os.Error) {
+    templateLock.Lock()
+    defer templateLock.Unlock()
+
+    if t, ok := templateCache[name]; ok && !templateDebug && !isDevMode() {
+        return t, nil
+    }
+
+    t, err := template.ParseFile(path.Join(templateDirectory(), name), nil)
+    if err != nil {
+        return nil, err
+    }
+    templateCache[name] = t
+    return t, nil
+}
+
+func executeTemplate(name string, data interface{}) ([]byte, os.Error) {
+    t, err := loadTemplate(name)
+    if err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    if err := t.Execute(data, &buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (ctx *Context) writeHTML(content []byte) {
+    ctx.SetHeader("Content-Type", "text/html; charset=utf-8", true)
+    ctx.SetHeader("Content-Length", strconv.Itoa(len(content)), true)
+    ctx.Write(content)
+}
+
+//Executes the template called name in the template directory with data, and
+//writes the result as html. Nothing is written if the template fails
+func (ctx *Context) Render(name string, data interface{}) os.Error {
+    content, err := executeTemplate(name, data)
+    if err != nil {
+        return err
+    }
+    ctx.writeHTML(content)
+    return nil
+}
+
+//Renders the template called name, and writes it inside the layout template,
+//where it's available as {Content}
+func (ctx *Context) RenderInLayout(layout string, name string, data interface{}) os.Error {
+    content, err := executeTemplate(name, data)
+    if err != nil {
+        return err
+    }
+    page, err := executeTemplate(layout, &LayoutData{string(content), data})
+    if err != nil {
+        return err
+    }
+    ctx.writeHTML(page)
+    return nil
+}
@@ -7,7 +7,9 @@ import (
     "http"
     "io"
     "io/ioutil"
+    "json"
     "os"
+    "strconv"
     "strings"
 )
 
@@ -17,31 +19,35 @@ type filedata struct {
 }
 
 type Request struct {
-    Method     string    // GET, POST, PUT, etc.
-    RawURL     string    // The raw URL given in the request.
-    URL        *http.URL // Parsed URL.
-    Proto      string    // "HTTP/1.0"
-    ProtoMajor int       // 1
-    ProtoMinor int       // 0
-    Headers    map[string]string
-    Body       io.Reader
-    Close      bool
-    Host       string
-    Referer    string
-    UserAgent  string
-    Params     map[string][]string
-    Cookies    map[string]string
-    Files      map[string]filedata
+    Method       string    // GET, POST, PUT, etc.
+    RawURL       string    // The raw URL given in the request.
+    URL          *http.URL // Parsed URL.
+    Proto        string    // "HTTP/1.0"
+    ProtoMajor   int       // 1
+    ProtoMinor   int       // 0
+    Headers      map[string]string
+    Body         io.Reader
+    Close        bool
+    Host         string
+    RemoteAddr   string // The address of the client (or the proxy in front of it)
+    Referer      string
+    UserAgent    string
+    Params       map[string][]string
+    Cookies      map[string]string
+    CookiesAll   map[string][]string //every value of each cookie, for names sent more than once
+    Files        map[string]filedata
+    NestedParams map[string]interface{} //Params with names like user[emails][] nested, once ParseNestedParams or BindParams ran
+    JSON         map[string]interface{} //the decoded body of an application/json request
+    ParseError   os.Error               //set if the query or the body couldn't be parsed
+    rawBody      []byte                 //the body, once it has been read
+    bodyErr      os.Error
+    bodyRead     bool
+    nestError    os.Error //why some Params were left out of NestedParams
+    scriptName   string   //the SCRIPT_NAME of scgi and fastcgi requests
+    tls          bool     //set if the client connected with https
 }
 
 
-type badStringError struct {
-    what string
-    str  string
-}
-
-func (e *badStringError) String() string { return fmt.Sprintf("%s %q", e.what, e.str) }
-
 func newRequest(hr *http.Request) *Request {
     req := Request{
         Method:     hr.Method,
@@ -72,39 +78,210 @@ func newRequestCgi(headers map[string]string, body io.Reader) *Request {
     proto, _ := headers["SERVER_PROTOCOL"]
     rawurl := "http://" + host + ":" + port + path
     url, _ := http.ParseURL(rawurl)
-    useragent, _ := headers["USER_AGENT"]
-
-    if cookie, ok := headers["HTTP_COOKIE"]; ok {
-        httpheader["Cookie"] = cookie
+    useragent, ok := headers["HTTP_USER_AGENT"]
+    if !ok {
+        useragent, _ = headers["USER_AGENT"]
     }
-
-    if method == "POST" {
-        if ctype, ok := headers["CONTENT_TYPE"]; ok {
-            httpheader["Content-Type"] = ctype
+    referer, _ := headers["HTTP_REFERER"]
+    scriptName, _ := headers["SCRIPT_NAME"]
+    if pathInfo, _ := headers["PATH_INFO"]; len(pathInfo) == 0 && !isBelowPath(path, scriptName) {
+        //not the mount point, like the whole path set by nginx's stock fastcgi_params
+        scriptName = ""
+    }
+    remoteAddr, _ := headers["REMOTE_ADDR"]
+    if remotePort, ok := headers["REMOTE_PORT"]; ok && len(remoteAddr) > 0 {
+        if strings.Index(remoteAddr, ":") != -1 {
+            remoteAddr = "[" + remoteAddr + "]"
         }
+        remoteAddr += ":" + remotePort
+    }
 
-        if clength, ok := headers["CONTENT_LENGTH"]; ok {
-            httpheader["Content-Length"] = clength
+    for k, v := range headers {
+        if !strings.HasPrefix(k, "HTTP_") {
+            continue
+        }
+        name := cgiHeaderName(k[5:])
+        switch name {
+        case "Host", "Referer", "User-Agent":
+            //kept in the request fields, like the http package does
+            continue
         }
+        httpheader[name] = v
+    }
+
+    if ctype, ok := headers["CONTENT_TYPE"]; ok {
+        httpheader["Content-Type"] = ctype
+    }
+
+    if clength, ok := headers["CONTENT_LENGTH"]; ok {
+        httpheader["Content-Length"] = clength
+    }
+
+    major, minor, ok := parseHTTPVersion(proto)
+    if !ok {
+        //assume the oldest protocol, which doesn't keep connections open
+        major, minor = 1, 0
     }
 
     req := Request{
-        Method:    method,
-        RawURL:    rawurl,
-        URL:       url,
-        Proto:     proto,
-        Host:      host,
-        UserAgent: useragent,
-        Body:      body,
-        Headers:   httpheader,
+        Method:     method,
+        RawURL:     rawurl,
+        URL:        url,
+        Proto:      proto,
+        ProtoMajor: major,
+        ProtoMinor: minor,
+        Host:       host,
+        RemoteAddr: remoteAddr,
+        Referer:    referer,
+        UserAgent:  useragent,
+        Body:       body,
+        Headers:    httpheader,
+        scriptName: scriptName,
+        tls:        strings.ToLower(headers["HTTPS"]) == "on" || headers["HTTPS"] == "1",
     }
 
     return &req
 }
 
+//parses a protocol version like "HTTP/1.0"
+func parseHTTPVersion(proto string) (major int, minor int, ok bool) {
+    if !strings.HasPrefix(proto, "HTTP/") {
+        return 0, 0, false
+    }
+    dot := strings.Index(proto, ".")
+    if dot == -1 {
+        return 0, 0, false
+    }
+    major, err := strconv.Atoi(proto[5:dot])
+    if err != nil || major < 0 {
+        return 0, 0, false
+    }
+    minor, err = strconv.Atoi(proto[dot+1:])
+    if err != nil || minor < 0 {
+        return 0, 0, false
+    }
+    return major, minor, true
+}
+
+//Returns true if the request's protocol is at least HTTP/major.minor
+func (r *Request) ProtoAtLeast(major int, minor int) bool {
+    return r.ProtoMajor > major || r.ProtoMajor == major && r.ProtoMinor >= minor
+}
+
+//returns the path of the request as it was sent, with its escapes
+func (r *Request) escapedPath() string {
+    raw := r.RawURL
+    if i := strings.Index(raw, "://"); i != -1 {
+        raw = raw[i+3:]
+        if j := strings.Index(raw, "/"); j != -1 {
+            raw = raw[j:]
+        } else {
+            raw = "/"
+        }
+    }
+    if i := strings.Index(raw, "?"); i != -1 {
+        raw = raw[0:i]
+    }
+    if i := strings.Index(raw, "#"); i != -1 {
+        raw = raw[0:i]
+    }
+    if !strings.HasPrefix(raw, "/") {
+        return r.URL.Path
+    }
+    return raw
+}
+
+func unhex(c byte) (byte, bool) {
+    switch {
+    case '0' <= c && c <= '9':
+        return c - '0', true
+    case 'a' <= c && c <= 'f':
+        return c - 'a' + 10, true
+    case 'A' <= c && c <= 'F':
+        return c - 'A' + 10, true
+    }
+    return 0, false
+}
+
+//decodes the %XX escapes of a path. Unlike in a query, a + is a plus
+func unescapePath(s string) (string, os.Error) {
+    if strings.Index(s, "%") == -1 {
+        return s, nil
+    }
+    b := make([]byte, 0, len(s))
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if c == '%' {
+            if i+2 >= len(s) {
+                return "", os.NewError("invalid escape " + strconv.Quote(s[i:]))
+            }
+            hi, ok1 := unhex(s[i+1])
+            lo, ok2 := unhex(s[i+2])
+            if !ok1 || !ok2 {
+                return "", os.NewError("invalid escape " + strconv.Quote(s[i:i+3]))
+            }
+            c = hi<<4 | lo
+            i += 2
+        }
+        b = b[0 : len(b)+1]
+        b[len(b)-1] = c
+    }
+    return string(b), nil
+}
+
+//reports whether the path of uri continues below the path prefix, like
+///app/users below /app
+func isBelowPath(uri string, prefix string) bool {
+    if i := strings.Index(uri, "?"); i != -1 {
+        uri = uri[0:i]
+    }
+    for strings.HasSuffix(prefix, "/") {
+        prefix = prefix[0 : len(prefix)-1]
+    }
+    return len(prefix) > 0 && strings.HasPrefix(uri, prefix+"/")
+}
+
+//converts the name of a CGI variable like X_FORWARDED_FOR to the header name
+//X-Forwarded-For
+func cgiHeaderName(name string) string {
+    b := []byte(name)
+    for i, c := range b {
+        if c == '_' {
+            b[i] = '-'
+        }
+    }
+    return http.CanonicalHeaderKey(string(b))
+}
+
+//Returns the value of the request header name, or "" if it isn't set. The
+//lookup is case-insensitive
+func (r *Request) GetHeader(name string) string {
+    key := http.CanonicalHeaderKey(name)
+    switch key {
+    case "Host":
+        return r.Host
+    case "Referer":
+        return r.Referer
+    case "User-Agent":
+        return r.UserAgent
+    }
+    if v, ok := r.Headers[key]; ok {
+        return v
+    }
+    for k, v := range r.Headers {
+        if strings.ToLower(k) == strings.ToLower(name) {
+            return v
+        }
+    }
+    return ""
+}
+
 func parseForm(m map[string][]string, query string) (err os.Error) {
     data := make(map[string]*vector.StringVector)
     for _, kv := range strings.Split(query, "&", -1) {
+        if len(kv) == 0 {
+            continue
+        }
         kvPair := strings.Split(kv, "=", 2)
 
         var key, value string
@@ -119,7 +296,11 @@ func parseForm(m map[string][]string, query string) (err os.Error) {
 
         vec, ok := data[key]
         if !ok {
+            //keep the values that were already parsed
             vec = new(vector.StringVector)
+            for _, v := range m[key] {
+                vec.Push(v)
+            }
             data[key] = vec
         }
         vec.Push(value)
@@ -132,19 +313,133 @@ func parseForm(m map[string][]string, query string) (err os.Error) {
     return
 }
 
-// ParseForm parses the request body as a form for POST requests, or the raw query for GET requests.
-// It is idempotent.
-func (r *Request) parseParams() (err os.Error) {
+//the largest request body that is buffered in memory. 0 means no limit
+var maxBodySize int64 = 32 << 20
+
+//Sets the largest request body, in bytes, that is read into memory for form
+//parsing and RawBody. 0 removes the limit
+func SetMaxBodySize(size int64) { maxBodySize = size }
+
+//reads the whole body once, so it's still available after the form is parsed
+func (r *Request) readBody() ([]byte, os.Error) {
+    if r.bodyRead {
+        return r.rawBody, r.bodyErr
+    }
+    if r.Body == nil {
+        return nil, os.ErrorString("missing request body")
+    }
+    r.bodyRead = true
+    body := r.Body
+    if maxBodySize > 0 {
+        body = io.LimitReader(r.Body, maxBodySize+1)
+    }
+    b, err := ioutil.ReadAll(body)
+    if err == nil && maxBodySize > 0 && int64(len(b)) > maxBodySize {
+        err = os.ErrorString("request body too large")
+    }
+    if err != nil {
+        r.bodyErr = err
+        return nil, err
+    }
+    r.rawBody = b
+    return b, nil
+}
+
+//Returns the exact bytes of the request body. It's still available after the
+//form data has been parsed, unless the route streams its body
+func (r *Request) RawBody() ([]byte, os.Error) { return r.readBody() }
+
+//Decodes a JSON request body into v
+func (r *Request) ReadJSON(v interface{}) os.Error {
+    b, err := r.readBody()
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(b, v)
+}
+
+//parses the raw query of the request, leaving the body untouched
+func (r *Request) parseQuery() os.Error {
+    if r.Params == nil {
+        r.Params = make(map[string][]string)
+    }
+    if r.URL == nil {
+        return nil
+    }
+    return parseForm(r.Params, r.URL.RawQuery)
+}
+
+// ParseForm parses the raw query of the request, followed by the request body
+// as a form for POST, PUT, PATCH and DELETE requests. Values from the body are appended after the ones
+// from the query. It is idempotent, and the error is kept in ParseError.
+func (r *Request) parseParams() os.Error {
     if r.Params != nil {
-        return
+        return r.ParseError
     }
-    r.Params = make(map[string][]string)
+    r.ParseError = r.parseBody()
+    return r.ParseError
+}
 
-    var query string
+//flattens the top level strings, numbers and booleans of a JSON object into
+//Params, keeping the whole object in JSON
+func (r *Request) parseJSON(b []byte) os.Error {
+    var v interface{}
+    if err := json.Unmarshal(b, &v); err != nil {
+        return err
+    }
+    obj, ok := v.(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    r.JSON = obj
+    for name, value := range obj {
+        var s string
+        switch value := value.(type) {
+        case string:
+            s = value
+        case float64:
+            if value == float64(int64(value)) {
+                s = strconv.Itoa64(int64(value))
+            } else {
+                s = strconv.Ftoa64(value, 'g', -1)
+            }
+        case bool:
+            s = fmt.Sprint(value)
+        default:
+            continue
+        }
+        vals := r.Params[name]
+        newlst := make([]string, len(vals)+1)
+        copy(newlst, vals)
+        newlst[len(vals)] = s
+        r.Params[name] = newlst
+    }
+    return nil
+}
+
+//reports whether a PUT, PATCH or DELETE request has a body to parse, with a
+//Content-Length or a chunked Transfer-Encoding
+func (r *Request) hasBody() bool {
     switch r.Method {
-    case "GET", "HEAD":
-        query = r.URL.RawQuery
-    case "POST":
+    case "PUT", "PATCH", "DELETE":
+    default:
+        return false
+    }
+    if te, ok := r.Headers["Transfer-Encoding"]; ok && strings.ToLower(te) != "identity" {
+        return true
+    }
+    n, err := strconv.Atoi64(strings.TrimSpace(r.Headers["Content-Length"]))
+    return err == nil && n > 0
+}
+
+//parses the query, and the body of POST requests and the PUT, PATCH and DELETE
+//requests that have one, depending on its Content-Type. The bodies of other
+//types are left for RawBody
+func (r *Request) parseBody() (err os.Error) {
+    qerr := r.parseQuery()
+
+    var query string
+    if r.Method == "POST" || r.hasBody() {
         if r.Body == nil {
             return os.ErrorString("missing form body")
         }
@@ -152,15 +447,23 @@ func (r *Request) parseParams() (err os.Error) {
         switch strings.Split(ct, ";", 2)[0] {
         case "text/plain", "application/x-www-form-urlencoded", "":
             var b []byte
-            if b, err = ioutil.ReadAll(r.Body); err != nil {
+            if b, err = r.readBody(); err != nil {
                 return err
             }
             query = string(b)
+        case "application/json":
+            var b []byte
+            if b, err = r.readBody(); err != nil {
+                return err
+            }
+            if err = r.parseJSON(b); err != nil {
+                return err
+            }
         case "multipart/form-data":
             r.Files = make(map[string]filedata)
             boundary := strings.Split(ct, "boundary=", 2)[1]
             var b []byte
-            if b, err = ioutil.ReadAll(r.Body); err != nil {
+            if b, err = r.readBody(); err != nil {
                 return err
             }
             parts := bytes.Split(b, []byte("--"+boundary+"--\r\n"), -1)
@@ -226,35 +529,110 @@ func (r *Request) parseParams() (err os.Error) {
                     r.Params[name] = newlst
                 }
             }
-        default:
-            return &badStringError{"unknown Content-Type", ct}
         }
     }
-    return parseForm(r.Params, query)
+    if err = parseForm(r.Params, query); err != nil {
+        return err
+    }
+    return qerr
 }
 
+//parses the Cookie header into Cookies and CookiesAll. A name sent more than
+//once keeps its first value in Cookies, since browsers send the cookie with the
+//most specific path first
 func (r *Request) parseCookies() (err os.Error) {
     if r.Cookies != nil {
         return
     }
 
     r.Cookies = make(map[string]string)
+    r.CookiesAll = make(map[string][]string)
 
     if v, ok := r.Headers["Cookie"]; ok {
-        cookies := strings.Split(v, ";", -1)
-        for _, cookie := range cookies {
-            cookie = strings.TrimSpace(cookie)
-            parts := strings.Split(cookie, "=", 2)
-            if len(parts) != 2 {
-                continue
+        names, values := parseCookieHeader(v)
+        for i, name := range names {
+            if _, ok := r.Cookies[name]; !ok {
+                r.Cookies[name] = values[i]
             }
-            r.Cookies[parts[0]] = parts[1]
+            all := r.CookiesAll[name]
+            newlst := make([]string, len(all)+1)
+            copy(newlst, all)
+            newlst[len(all)] = values[i]
+            r.CookiesAll[name] = newlst
         }
     }
 
     return nil
 }
 
+func isCookieNameChar(c byte) bool {
+    return c > ' ' && c < 0x7f && strings.Index("()<>@,;:\\\"/[]?={}", string(c)) == -1
+}
+
+//reports whether s starts with the name of another cookie, telling the commas
+//that join several Cookie headers from the ones in values
+func cookieFollows(s string) bool {
+    i := 0
+    for i < len(s) && s[i] == ' ' {
+        i++
+    }
+    start := i
+    for i < len(s) && isCookieNameChar(s[i]) {
+        i++
+    }
+    return i > start && i < len(s) && s[i] == '='
+}
+
+//splits a Cookie header into the names and values of its cookies. Values can be
+//quoted, and contain = and the , of lists. Cookies without an = are skipped
+func parseCookieHeader(header string) ([]string, []string) {
+    var names, values vector.StringVector
+    i, n := 0, len(header)
+    for i < n {
+        for i < n && (header[i] == ' ' || header[i] == '\t' || header[i] == ';' || header[i] == ',') {
+            i++
+        }
+        start := i
+        for i < n && header[i] != '=' && header[i] != ';' {
+            i++
+        }
+        name := strings.TrimSpace(header[start:i])
+        if i == n || header[i] != '=' || len(name) == 0 {
+            //skip the rest of the cookie, which may have an = with no name
+            for i < n && header[i] != ';' {
+                i++
+            }
+            continue
+        }
+
+        i++
+        for i < n && (header[i] == ' ' || header[i] == '\t') {
+            i++
+        }
+        var value string
+        if i < n && header[i] == '"' {
+            end := strings.Index(header[i+1:], "\"")
+            if end == -1 {
+                value, i = header[i+1:], n
+            } else {
+                value, i = header[i+1:i+1+end], i+2+end
+            }
+            for i < n && header[i] != ';' && header[i] != ',' {
+                i++
+            }
+        } else {
+            start = i
+            for i < n && header[i] != ';' && !(header[i] == ',' && cookieFollows(header[i+1:])) {
+                i++
+            }
+            value = strings.TrimSpace(header[start:i])
+        }
+        names.Push(name)
+        values.Push(value)
+    }
+    return names.Copy(), values.Copy()
+}
+
 //Returns the first parameter given a name, or an empty string
 func (r *Request) GetParam(name string) string {
     if r.Params == nil || len(r.Params) == 0 {
@@ -267,6 +645,160 @@ func (r *Request) GetParam(name string) string {
     return params[0]
 }
 
+//Returns the first parameter given a name, or an empty string
+func (r *Request) Param(name string) string { return r.GetParam(name) }
+
+//Returns all the values of a parameter, from the query string followed by the body
+func (r *Request) ParamList(name string) []string { return r.Params[name] }
+
+//Returns the first parameter given a name, or def if it's missing
+func (r *Request) ParamString(name string, def string) string {
+    params, ok := r.Params[name]
+    if !ok || len(params) == 0 {
+        return def
+    }
+    return params[0]
+}
+
+//Returns the first parameter given a name as an int, or def if it's missing or invalid
+func (r *Request) ParamInt(name string, def int) int {
+    n, err := strconv.Atoi(r.ParamString(name, ""))
+    if err != nil {
+        return def
+    }
+    return n
+}
+
+//Returns the first parameter given a name as an int64, or def if it's missing or invalid
+func (r *Request) ParamInt64(name string, def int64) int64 {
+    n, err := strconv.Atoi64(r.ParamString(name, ""))
+    if err != nil {
+        return def
+    }
+    return n
+}
+
+//Returns the first parameter given a name as a float64, or def if it's missing or invalid
+func (r *Request) ParamFloat(name string, def float64) float64 {
+    f, err := strconv.Atof64(r.ParamString(name, ""))
+    if err != nil {
+        return def
+    }
+    return f
+}
+
+//Returns the first parameter given a name as a bool, or def if it's missing or invalid.
+//Accepts 1/0, true/false and on/off, since checkboxes are sent as "on"
+func (r *Request) ParamBool(name string, def bool) bool {
+    switch strings.ToLower(r.ParamString(name, "")) {
+    case "1", "true", "on":
+        return true
+    case "0", "false", "off":
+        return false
+    }
+    return def
+}
+
+//Returns true for requests sent with XMLHttpRequest by the common javascript libraries
+func (r *Request) IsAjax() bool {
+    return r.Headers["X-Requested-With"] == "XMLHttpRequest"
+}
+
+//a media range from an Accept header
+type acceptRange struct {
+    mediaType string //like "text/html", "text/*" or "*/*"
+    q         float64
+}
+
+//parses an Accept header into its media ranges and their qualities
+func parseAccept(header string) []acceptRange {
+    parts := strings.Split(header, ",", -1)
+    ranges := make([]acceptRange, 0, len(parts))
+    for _, part := range parts {
+        params := strings.Split(part, ";", -1)
+        mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+        if len(mediaType) == 0 {
+            continue
+        }
+        var q float64 = 1
+        for _, param := range params[1:] {
+            kv := strings.Split(param, "=", 2)
+            if len(kv) != 2 || strings.TrimSpace(kv[0]) != "q" {
+                continue
+            }
+            if f, err := strconv.Atof64(strings.TrimSpace(kv[1])); err == nil {
+                q = f
+            } else {
+                q = 0
+            }
+        }
+        ranges = ranges[0 : len(ranges)+1]
+        ranges[len(ranges)-1] = acceptRange{mediaType, q}
+    }
+    return ranges
+}
+
+//returns the quality of a media type given by the most specific range matching it
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+    mediaType = strings.ToLower(mediaType)
+    slash := strings.Index(mediaType, "/")
+    if slash == -1 {
+        return 0
+    }
+    var q float64 = 0
+    specificity := -1
+    for _, r := range ranges {
+        var s int
+        switch r.mediaType {
+        case mediaType:
+            s = 2
+        case mediaType[0:slash+1] + "*":
+            s = 1
+        case "*/*":
+            s = 0
+        default:
+            continue
+        }
+        if s > specificity {
+            specificity = s
+            q = r.q
+        }
+    }
+    return q
+}
+
+//Returns true if the Accept header allows the media type. Requests without
+//an Accept header accept anything
+func (r *Request) Accepts(mediaType string) bool {
+    header, ok := r.Headers["Accept"]
+    if !ok {
+        return true
+    }
+    return acceptQuality(parseAccept(header), mediaType) > 0
+}
+
+//Returns the offered media type the client prefers according to its Accept
+//header, or an empty string if none is acceptable (a 406)
+func (r *Request) Negotiate(offers ...string) string {
+    header, ok := r.Headers["Accept"]
+    if !ok {
+        if len(offers) == 0 {
+            return ""
+        }
+        return offers[0]
+    }
+    ranges := parseAccept(header)
+    best := ""
+    var bestq float64 = 0
+    for _, offer := range offers {
+        if q := acceptQuality(ranges, offer); q > bestq {
+            best = offer
+            bestq = q
+        }
+    }
+    return best
+}
+
 func (r *Request) HasFile(name string) bool {
     if r.Files == nil || len(r.Files) == 0 {
         return false
@@ -1,10 +1,9 @@
 package web
 
 import (
+    "bufio"
     "bytes"
-    "fmt"
     "io"
-    "log"
     "net"
     "os"
     "strconv"
@@ -14,142 +13,160 @@ type scgiConn struct {
     fd           io.ReadWriteCloser
     headers      map[string][]string
     wroteHeaders bool
+    req          *Request //the request being answered
 }
 
 func (conn *scgiConn) StartResponse(status int) {
     var buf bytes.Buffer
-    text := statusText[status]
-    fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, text)
+    buf.WriteString(statusLine(conn.req, status))
+
+    //the headers are written along with the status, so that
+    //responses without a body (like a 304) are complete
+    conn.wroteHeaders = true
+    closeUnframed(conn.headers, status, conn.req)
+    writeHeaders(&buf, conn.headers)
+
+    buf.WriteString("\r\n")
     conn.fd.Write(buf.Bytes())
 }
 
 func (conn *scgiConn) SetHeader(hdr string, val string, unique bool) {
-    if _, contains := conn.headers[hdr]; !contains {
-        conn.headers[hdr] = []string{val}
+    if conn.wroteHeaders {
+        logErrorf("Header %s set after the response was started", hdr)
         return
     }
+    setHeader(conn.headers, hdr, val, unique)
+}
 
-    if unique {
-        //just overwrite the first value
-        conn.headers[hdr][0] = val
-    } else {
-        newHeaders := make([]string, len(conn.headers)+1)
-        copy(newHeaders, conn.headers[hdr])
-        newHeaders[len(newHeaders)-1] = val
-        conn.headers[hdr] = newHeaders
+func (conn *scgiConn) DelHeader(hdr string) {
+    if conn.wroteHeaders {
+        logErrorf("Header %s removed after the response was started", hdr)
+        return
     }
+    conn.headers[hdr] = nil, false
 }
 
 func (conn *scgiConn) Write(data []byte) (n int, err os.Error) {
-    var buf bytes.Buffer
-    if !conn.wroteHeaders {
-        conn.wroteHeaders = true
-
-        for k, v := range conn.headers {
-            for _, i := range v {
-                buf.WriteString(k + ": " + i + "\r\n")
-            }
-        }
-
-        buf.WriteString("\r\n")
-        conn.fd.Write(buf.Bytes())
-    }
     return conn.fd.Write(data)
 }
 
-func (conn *scgiConn) Close() { conn.fd.Close() }
+//writes go straight to the socket, so there's nothing to flush
+func (conn *scgiConn) Flush() {}
 
-func readScgiRequest(buf *bytes.Buffer) (*Request, os.Error) {
-    headers := make(map[string]string)
+func (conn *scgiConn) Close() { conn.fd.Close() }
 
-    data := buf.Bytes()
-    var clen int
+//the largest netstring of headers that is accepted
+const maxScgiHeaderSize = 1 << 20
 
-    colon := bytes.IndexByte(data, ':')
-    data = data[colon+1:]
-    var err os.Error
-    //find the CONTENT_LENGTH
+//scgiBody reads exactly the CONTENT_LENGTH bytes of a request body
+type scgiBody struct {
+    r         io.Reader
+    remaining int64
+}
 
-    clfields := bytes.Split(data, []byte{0}, 3)
-    if len(clfields) != 3 {
-        return nil, os.NewError("Invalid SCGI Request -- no fields")
+func (b *scgiBody) Read(p []byte) (n int, err os.Error) {
+    if b.remaining <= 0 {
+        return 0, os.EOF
     }
+    if int64(len(p)) > b.remaining {
+        p = p[0:b.remaining]
+    }
+    n, err = b.r.Read(p)
+    b.remaining -= int64(n)
+    if err == os.EOF && b.remaining > 0 {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
 
-    clfields = clfields[0:2]
-    if string(clfields[0]) != "CONTENT_LENGTH" {
-        return nil, os.NewError("Invalid SCGI Request -- expecing CONTENT_LENGTH")
+//reads the netstring of headers, leaving the body to be read from br. os.EOF is
+//returned if the connection was closed without sending anything
+func readScgiRequest(br *bufio.Reader) (*Request, os.Error) {
+    length := 0
+    for i := 0; ; i++ {
+        c, err := br.ReadByte()
+        if err == os.EOF && i > 0 {
+            return nil, io.ErrUnexpectedEOF
+        }
+        if err != nil {
+            return nil, err
+        }
+        if c == ':' && i > 0 {
+            break
+        }
+        if c < '0' || c > '9' {
+            return nil, os.NewError("Invalid SCGI Request -- bad netstring length")
+        }
+        length = length*10 + int(c-'0')
+        if length > maxScgiHeaderSize {
+            return nil, os.NewError("Invalid SCGI Request -- headers too large")
+        }
     }
 
-    if clen, err = strconv.Atoi(string(clfields[1])); err != nil {
-        return nil, os.NewError("Invalid SCGI Request -- invalid CONTENT_LENGTH field")
+    data := make([]byte, length+1)
+    if _, err := io.ReadFull(br, data); err != nil {
+        return nil, err
+    }
+    if data[length] != ',' {
+        return nil, os.NewError("Invalid SCGI Request -- missing netstring comma")
     }
 
-    content := data[len(data)-clen:]
+    //the headers are NUL terminated name and value pairs
+    fields := bytes.Split(data[0:length], []byte{0}, -1)
+    if len(fields) < 3 || len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+        return nil, os.NewError("Invalid SCGI Request -- malformed headers")
+    }
 
-    fields := bytes.Split(data[0:len(data)-clen], []byte{0}, -1)
+    //CONTENT_LENGTH has to come first
+    if string(fields[0]) != "CONTENT_LENGTH" {
+        return nil, os.NewError("Invalid SCGI Request -- expecting CONTENT_LENGTH")
+    }
+    clen, err := strconv.Atoi64(string(fields[1]))
+    if err != nil || clen < 0 {
+        return nil, os.NewError("Invalid SCGI Request -- invalid CONTENT_LENGTH field")
+    }
 
+    headers := make(map[string]string)
     for i := 0; i < len(fields)-1; i += 2 {
-        key := string(fields[i])
-        value := string(fields[i+1])
-        headers[key] = value
+        headers[string(fields[i])] = string(fields[i+1])
     }
 
-    body := bytes.NewBuffer(content)
-    req := newRequestCgi(headers, body)
-
-    return req, nil
+    return newRequestCgi(headers, &scgiBody{br, clen}), nil
 }
 
 func handleScgiRequest(fd io.ReadWriteCloser) {
-    var buf bytes.Buffer
-    var tmp [1024]byte
-    n, err := fd.Read(&tmp)
-    if err != nil || n == 0 {
-        return
-    }
-
-    colonPos := bytes.IndexByte(tmp[0:], ':')
-
-    read := n
-    length, _ := strconv.Atoi(string(tmp[0:colonPos]))
-    buf.Write(tmp[0:n])
-
-    for read < length {
-        n, err := fd.Read(&tmp)
-        if err != nil || n == 0 {
-            break
-        }
-
-        buf.Write(tmp[0:n])
-        read += n
-    }
-
-    req, err := readScgiRequest(&buf)
-
+    sc := scgiConn{fd: fd, headers: make(map[string][]string)}
+    req, err := readScgiRequest(bufio.NewReader(fd))
     if err != nil {
-        log.Stderrf("SCGI read error", err.String())
+        if err != os.EOF {
+            logInfof("SCGI read error: %s", err)
+            body := "Bad Request"
+            sc.SetHeader("Content-Type", "text/plain; charset=utf-8", true)
+            sc.SetHeader("Content-Length", strconv.Itoa(len(body)), true)
+            sc.StartResponse(400)
+            sc.Write([]byte(body))
+        }
+        fd.Close()
         return
     }
 
-    sc := scgiConn{fd, make(map[string][]string), false}
+    sc.req = req
     routeHandler(req, &sc)
+    //closing the socket ends the response
     fd.Close()
 }
 
 func listenAndServeScgi(addr string) {
-    l, err := net.Listen("tcp", addr)
+    l, err := listen(addr)
     if err != nil {
-        log.Stderrf("SCGI listen error", err.String())
+        logErrorf("SCGI listen error: %s", err)
         return
     }
+    serveScgi(l)
+}
 
-    for {
-        fd, err := l.Accept()
-        if err != nil {
-            log.Stderrf("SCGI accept error", err.String())
-            break
-        }
-        go handleScgiRequest(fd)
-
+func serveScgi(l net.Listener) {
+    if err := serve("scgi", l); err != nil {
+        logErrorf("SCGI accept error: %s", err)
     }
 }
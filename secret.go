@@ -0,0 +1,130 @@
+package web
+
+import (
+    "crypto/rand"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "sync"
+)
+
+//the file a generated cookie secret is kept in, in the directory of the executable
+const generatedSecretFile = ".webgo-cookie-secret"
+
+var secretLock sync.Mutex
+
+//the contents of the cookie secret files read so far, or "" for the ones that
+//couldn't be read, which are only reported once
+var secretFiles = make(map[string]string)
+
+var generatedSecret string
+
+//the keys of secure cookies. The first one signs, and comes from the
+//WEBGO_COOKIE_SECRET environment variable, the file named by
+//security.cookieSecretFile or security.cookieSecret, in that order. The keys set
+//with SetCookieSecret follow. When there are none, one is generated, unless the
+//secret file can't be read
+func cookieSecrets() []string {
+    keys, err := configuredSecrets()
+    if len(keys) == 0 && err == nil {
+        if secret := generateCookieSecret(); len(secret) > 0 {
+            keys = []string{secret}
+        }
+    }
+    return keys
+}
+
+//returns the configured keys, and an error if security.cookieSecretFile is set
+//but can't be read
+func configuredSecrets() ([]string, os.Error) {
+    var err os.Error
+    secret := os.Getenv("WEBGO_COOKIE_SECRET")
+    if len(secret) == 0 {
+        if name := ConfigString("security", "cookieSecretFile", ""); len(name) > 0 {
+            if secret = readSecretFile(name); len(secret) == 0 {
+                err = os.NewError(fmt.Sprintf("the cookie secret file %q can't be used", name))
+            }
+        } else {
+            secret = ConfigString("security", "cookieSecret", "")
+        }
+    }
+    if len(secret) == 0 {
+        return secrets, err
+    }
+    keys := make([]string, len(secrets)+1)
+    keys[0] = secret
+    copy(keys[1:], secrets)
+    return keys, nil
+}
+
+//returns the trimmed contents of a secret file, or "" if it can't be read
+func readSecretFile(name string) string {
+    secretLock.Lock()
+    defer secretLock.Unlock()
+    if secret, ok := secretFiles[name]; ok {
+        return secret
+    }
+    data, err := ioutil.ReadFile(name)
+    secret := strings.TrimSpace(string(data))
+    switch {
+    case err != nil:
+        logErrorf("Failed to read the cookie secret file %q: %s", name, err)
+    case len(secret) == 0:
+        logErrorf("The cookie secret file %q is empty", name)
+    }
+    secretFiles[name] = secret
+    return secret
+}
+
+//forgets the secret files read so far, so they're read again after the config is
+//reloaded
+func forgetSecretFiles() {
+    secretLock.Lock()
+    secretFiles = make(map[string]string)
+    secretLock.Unlock()
+}
+
+//returns the secret kept next to the executable, creating it if needed, so the
+//cookies signed with it stay valid after a restart
+func generateCookieSecret() string {
+    secretLock.Lock()
+    defer secretLock.Unlock()
+    if len(generatedSecret) > 0 {
+        return generatedSecret
+    }
+
+    name := path.Join(ExeDir(), generatedSecretFile)
+    if data, err := ioutil.ReadFile(name); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+        generatedSecret = strings.TrimSpace(string(data))
+        return generatedSecret
+    }
+
+    key := make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, key); err != nil {
+        logErrorf("Failed to generate a cookie secret: %s", err)
+        return ""
+    }
+    generatedSecret = fmt.Sprintf("%x", key)
+
+    f, err := os.Open(name, os.O_WRONLY|os.O_CREAT|os.O_TRUNC, 0600)
+    if err == nil {
+        _, err = f.Write([]byte(generatedSecret + "\n"))
+        f.Close()
+    }
+    if err != nil {
+        logErrorf("No cookie secret was set, and the generated one couldn't be saved to %s, so cookies won't survive a restart: %s", name, err)
+    } else {
+        logInfof("No cookie secret was set, so one was generated and saved to %s", name)
+    }
+    return generatedSecret
+}
+
+//checks the cookie secret file when the server starts, which doesn't start if
+//it's set but can't be read
+func checkCookieSecret() os.Error {
+    _, err := configuredSecrets()
+    return err
+}
@@ -1,9 +1,11 @@
 package web
 
 import (
+    "bytes"
+    "container/vector"
     "crypto/md5"
     "fmt"
-    "io"
+    "http"
     "mime"
     "os"
     "path"
@@ -43,47 +45,556 @@ func getmd5(data string) string {
     return fmt.Sprintf("%x", hash.Sum())
 }
 
-func serveFile(ctx *Context, name string) {
+//content types of common static files, checked before the system's mime.types
+var mimeTypes = map[string]string{
+    ".css":  "text/css",
+    ".gif":  "image/gif",
+    ".htm":  "text/html",
+    ".html": "text/html",
+    ".ico":  "image/x-icon",
+    ".jpeg": "image/jpeg",
+    ".jpg":  "image/jpeg",
+    ".js":   "application/javascript",
+    ".json": "application/json",
+    ".pdf":  "application/pdf",
+    ".png":  "image/png",
+    ".svg":  "image/svg+xml",
+    ".txt":  "text/plain",
+    ".woff": "application/font-woff",
+    ".xml":  "text/xml",
+}
+
+//Sets the content type used for static files with the extension ext, like
+//AddMimeType(".webm", "video/webm")
+func AddMimeType(ext string, ctype string) {
+    if !strings.HasPrefix(ext, ".") {
+        ext = "." + ext
+    }
+    mimeTypes[strings.ToLower(ext)] = ctype
+}
+
+//returns the content type for a file extension, or "" if it's unknown
+func typeByExtension(ext string) string {
+    ctype, ok := mimeTypes[strings.ToLower(ext)]
+    if !ok {
+        ctype = mime.TypeByExtension(ext)
+    }
+    if ctype == "" {
+        return ""
+    }
+    //text is assumed to be utf-8, other types don't take a charset
+    textual := strings.HasPrefix(ctype, "text/") || ctype == "application/javascript"
+    if textual && strings.Index(ctype, "charset=") == -1 {
+        ctype += "; charset=utf-8"
+    }
+    return ctype
+}
+
+//a directory of static files served under a url prefix, or a set of files held
+//in memory if assets is set
+type staticMount struct {
+    prefix string
+    dir    string
+    assets map[string]*cachedFile
+}
+
+//guarded by routesLock, so they can be replaced along with the routes
+var staticMounts vector.Vector
+
+//Serves the files in dir under urlPrefix, so Static("/assets", "public") maps
+///assets/style.css to public/style.css. Mounts are checked in the order they
+//were added, before the static directory. A relative dir is relative to the
+//directory of the executable
+func Static(urlPrefix string, dir string) os.Error {
+    mount, err := newStaticMount(urlPrefix, dir)
+    if err != nil {
+        return err
+    }
+    routesLock.Lock()
+    staticMounts.Push(mount)
+    routesLock.Unlock()
+    return nil
+}
+
+func newStaticMount(urlPrefix string, dir string) (*staticMount, os.Error) {
+    dir = exeRelative(dir)
+    if !dirExists(dir) {
+        return nil, os.NewError(fmt.Sprintf("Failed to mount static directory %q - does not exist", dir))
+    }
+    return &staticMount{prefix: path.Clean("/" + urlPrefix), dir: dir}, nil
+}
+
+//Serves the files in assets under urlPrefix, without touching the filesystem.
+//The keys are paths relative to the prefix, like "css/site.css". It's checked
+//along with the directories added with Static, in the order they were added
+func StaticFromMap(urlPrefix string, assets map[string][]byte) {
+    mount := newAssetMount(urlPrefix, assets)
+    routesLock.Lock()
+    staticMounts.Push(mount)
+    routesLock.Unlock()
+}
+
+func newAssetMount(urlPrefix string, assets map[string][]byte) *staticMount {
+    mtime := time.Seconds() * 1e9
+    files := make(map[string]*cachedFile)
+    for name, data := range assets {
+        name = path.Clean("/" + name)
+        files[name] = &cachedFile{name, data, mtime, fmt.Sprintf(`"%s"`, getmd5(string(data)))}
+    }
+    return &staticMount{prefix: path.Clean("/" + urlPrefix), assets: files}
+}
+
+//looks up the file at rel in the mount. For an in-memory file, asset is set
+func (mount *staticMount) lookup(rel string) (name string, asset *cachedFile, ok bool) {
+    if mount.assets != nil {
+        if asset, ok = mount.assets[path.Clean(rel)]; ok {
+            return asset.name, asset, true
+        }
+        return "", nil, false
+    }
+    if name, ok = staticFilePath(mount.dir, rel); ok && fileExists(name) {
+        return name, nil, true
+    }
+    return "", nil, false
+}
+
+//checks whether rel is a directory in the mount
+func (mount *staticMount) isDir(rel string) bool {
+    if mount.assets != nil {
+        dir := path.Clean(rel)
+        if dir != "/" {
+            dir += "/"
+        }
+        for name, _ := range mount.assets {
+            if strings.HasPrefix(name, dir) {
+                return true
+            }
+        }
+        return false
+    }
+    dir, ok := staticFilePath(mount.dir, rel)
+    return ok && dirExists(dir)
+}
+
+//returns the part of requestPath under prefix. The prefix has to match whole
+//path segments, so "/assetsfoo" isn't under "/assets"
+func mountPath(prefix string, requestPath string) (string, bool) {
+    switch {
+    case prefix == "/":
+        return requestPath, true
+    case requestPath == prefix:
+        return "/", true
+    case strings.HasPrefix(requestPath, prefix+"/"):
+        return requestPath[len(prefix):], true
+    }
+    return "", false
+}
+
+//returns the static mounts in the order they're checked, ending with the
+//static directory
+func allStaticMounts() []*staticMount {
+    routesLock.RLock()
+    defer routesLock.RUnlock()
+    mounts := make([]*staticMount, staticMounts.Len()+1)
+    for i := 0; i < staticMounts.Len(); i++ {
+        mounts[i] = staticMounts.At(i).(*staticMount)
+    }
+    mounts[len(mounts)-1] = &staticMount{prefix: "/", dir: staticDirectory()}
+    return mounts
+}
+
+//looks for the file a request path refers to in the static mounts, and then in
+//the static directory
+func findStaticFile(requestPath string) (name string, asset *cachedFile, ok bool) {
+    for _, mount := range allStaticMounts() {
+        rel, ok := mountPath(mount.prefix, requestPath)
+        if !ok {
+            continue
+        }
+        if name, asset, ok := mount.lookup(rel); ok {
+            return name, asset, true
+        }
+    }
+    return "", nil, false
+}
+
+var indexFiles = []string{"index.html"}
+
+var indexRedirect = true
+
+//Sets the files served for a request to a static directory, in the order they're
+//tried. By default it's just index.html, and an empty list disables index files
+func SetIndexFiles(names []string) { indexFiles = names }
+
+//Sets whether a request for a static directory without a trailing slash, like
+///docs, is redirected to /docs/ before its index file is served, so relative
+//links in the index resolve. It's enabled by default
+func SetIndexRedirect(enabled bool) { indexRedirect = enabled }
+
+//looks for an index file in the static directory a request path refers to
+func findIndexFile(requestPath string) (name string, asset *cachedFile, ok bool) {
+    for _, mount := range allStaticMounts() {
+        rel, ok := mountPath(mount.prefix, requestPath)
+        if !ok || !mount.isDir(rel) {
+            continue
+        }
+        for _, index := range indexFiles {
+            if name, asset, ok := mount.lookup(path.Join(rel, index)); ok {
+                return name, asset, true
+            }
+        }
+    }
+    return "", nil, false
+}
+
+var staticFallback func(ctx *Context, requestedPath string) bool
+
+//Sets a handler called when a request matches no route or static file, before
+//the 404 is sent. It returns true if it handled the request, and must not write
+//anything otherwise. For a single-page app, it could serve index.html for every
+//path that isn't part of the api
+func SetStaticFallback(fallback func(ctx *Context, requestedPath string) bool) {
+    staticFallback = fallback
+}
+
+var staticFollowSymlinks = true
+
+var staticCacheMaxAge = 0
+
+//Sets the max-age of the Cache-Control header sent with static files. By
+//default, or if seconds is 0, no Cache-Control header is sent
+func SetStaticCacheMaxAge(seconds int) { staticCacheMaxAge = seconds }
+
+//Sets whether symlinks in the static directory are followed. When they aren't,
+//files reached through a symlink are treated as missing
+func SetStaticFollowSymlinks(follow bool) { staticFollowSymlinks = follow }
+
+//maps a request path to a file under dir. ok is false if the path would escape
+//dir, or goes through a symlink that shouldn't be followed
+func staticFilePath(dir string, requestPath string) (name string, ok bool) {
+    if !validStaticPath(requestPath) {
+        return "", false
+    }
+    //some frontends pass escapes through, so check the decoded path as well
+    if decoded, err := http.URLUnescape(requestPath); err == nil && !validStaticPath(decoded) {
+        return "", false
+    }
+
+    root := path.Clean(dir)
+    if !strings.HasPrefix(root, "/") {
+        wd, err := os.Getwd()
+        if err != nil {
+            return "", false
+        }
+        root = path.Join(wd, root)
+    }
+    name = path.Join(root, path.Clean("/"+requestPath))
+    if name != root && !strings.HasPrefix(name, root+"/") {
+        return "", false
+    }
+    if !staticFollowSymlinks && hasSymlink(root, name) {
+        return "", false
+    }
+    return name, true
+}
+
+func validStaticPath(p string) bool {
+    if strings.Index(p, "\\") != -1 || strings.Index(p, "\x00") != -1 {
+        return false
+    }
+    for _, part := range strings.Split(p, "/", -1) {
+        if part == ".." {
+            return false
+        }
+    }
+    return true
+}
+
+//checks whether name, or any directory between root and name, is a symlink
+func hasSymlink(root string, name string) bool {
+    for len(name) > len(root) {
+        if info, err := os.Lstat(name); err == nil && info.IsSymlink() {
+            return true
+        }
+        name, _ = path.Split(name)
+        name = path.Clean(name)
+    }
+    return false
+}
+
+func serveFile(ctx *Context, name string) os.Error {
+    return serveFileWith(ctx, name, nil)
+}
+
+//serves the file name like serveFile, calling opened, if it's not nil, once the
+//file is known to be readable and before anything is written
+func serveFileWith(ctx *Context, name string, opened func()) os.Error {
     f, err := os.Open(name, os.O_RDONLY, 0)
 
     if err != nil {
-        ctx.Abort(404, "Invalid file")
-        return
+        return err
     }
 
     defer f.Close()
 
-    info, _ := os.Stat(name)
-    //set content-length
-    ctx.SetHeader("Content-Length", strconv.Itoa64(info.Size), true)
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    if !info.IsRegular() {
+        return &os.PathError{"open", name, os.EISDIR}
+    }
+    if opened != nil {
+        opened()
+    }
+
+    serveContent(ctx, name, info.Size, info.Mtime_ns, fileETag(name, info.Size, info.Mtime_ns), f)
+    return nil
+}
+
+//generates a simple etag with heuristic MD5(filename, size, lastmod)
+func fileETag(name string, size int64, mtime int64) string {
+    etagparts := []string{name, strconv.Itoa64(size), strconv.Itoa64(mtime)}
+    return fmt.Sprintf(`"%s"`, getmd5(strings.Join(etagparts, "|")))
+}
+
+//the contents of a file being served, either the open file or a cached copy
+type fileContent interface {
+    ReadAt(b []byte, off int64) (n int, err os.Error)
+}
+
+//sends the contents of the file name, answering conditional and range requests
+func serveContent(ctx *Context, name string, size int64, mtime int64, etag string, content fileContent) {
+    //set the validators, and stop if the client's copy is fresh. If-None-Match
+    //takes precedence over If-Modified-Since
+    lm := time.SecondsToUTC(mtime / 1e9)
+    if _, ok := ctx.Request.Headers["If-None-Match"]; ok {
+        ctx.SetHeader("Last-Modified", webTime(lm), true)
+        if ctx.CheckETag(etag) {
+            return
+        }
+    } else {
+        ctx.SetETag(etag)
+        if ctx.CheckLastModified(lm) {
+            return
+        }
+    }
 
-    //set the last-modified header
-    lm := time.SecondsToLocalTime(info.Mtime_ns / 1e9)
-    ctx.SetHeader("Last-Modified", webTime(lm), true)
+    //send only part of the file if a single range was requested
+    ctx.SetHeader("Accept-Ranges", "bytes", true)
+    status := 200
+    var offset int64 = 0
+    length := size
+    if header, ok := ctx.Request.Headers["Range"]; ok {
+        r, err := parseRange(header, size)
+        if err != nil {
+            ctx.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", size), true)
+            ctx.Abort(416, "Requested range not satisfiable")
+            return
+        }
+        if r != nil {
+            status = 206
+            offset, length = r.start, r.length
+            ctx.SetHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size), true)
+        }
+    }
 
-    //generate a simple etag with heuristic MD5(filename, size, lastmod)
-    etagparts := []string{name, strconv.Itoa64(info.Size), strconv.Itoa64(info.Mtime_ns)}
-    etag := fmt.Sprintf(`"%s"`, getmd5(strings.Join(etagparts, "|")))
-    ctx.SetHeader("ETag", etag, true)
+    //set content-length
+    ctx.SetHeader("Content-Length", strconv.Itoa64(length), true)
 
-    ext := path.Ext(name)
-    if ctype := mime.TypeByExtension(ext); ctype != "" {
+    if ctype := typeByExtension(path.Ext(name)); ctype != "" {
         ctx.SetHeader("Content-Type", ctype, true)
     } else {
-        // read first chunk to decide between utf-8 text and binary
+        //unknown extensions are sent as binary, unless they look like utf-8 text
         var buf [1024]byte
-        n, _ := io.ReadFull(f, &buf)
-        b := buf[0:n]
-        if isText(b) {
-            ctx.SetHeader("Content-Type", "text-plain; charset=utf-8", true)
+        n, _ := content.ReadAt(buf[0:], 0)
+        if isText(buf[0:n]) {
+            ctx.SetHeader("Content-Type", "text/plain; charset=utf-8", true)
         } else {
             ctx.SetHeader("Content-Type", "application/octet-stream", true) // generic binary
         }
-        if ctx.Request.Method != "HEAD" {
-            ctx.Write(b)
+    }
+
+    ctx.StartResponse(status)
+    if ctx.Request.Method == "HEAD" {
+        return
+    }
+    copyContent(ctx, content, offset, length)
+}
+
+//serves a file from the static directory, or from memory if asset is set
+func serveStaticFile(ctx *Context, name string, asset *cachedFile) os.Error {
+    if staticCacheMaxAge > 0 && !isDevMode() {
+        ctx.SetHeader("Cache-Control", "public, max-age="+strconv.Itoa(staticCacheMaxAge), true)
+    }
+    if asset != nil {
+        serveContent(ctx, name, int64(len(asset.data)), asset.mtime, asset.etag, asset)
+        return nil
+    }
+    if cache := fileCache; cache != nil && !isDevMode() {
+        if cf := cache.load(name); cf != nil {
+            serveContent(ctx, name, int64(len(cf.data)), cf.mtime, cf.etag, cf)
+            return nil
         }
     }
-    if ctx.Request.Method != "HEAD" {
-        io.Copy(ctx, f)
+    err := serveFile(ctx, name)
+    if err != nil && staticCacheMaxAge > 0 && !isDevMode() {
+        ctx.DelHeader("Cache-Control")
+    }
+    return err
+}
+
+//responds to an error opening a static file. false is returned if the file is
+//missing, so the request can be handled like any other
+func handleStaticError(ctx *Context, name string, err os.Error) bool {
+    errno := err
+    if pe, ok := err.(*os.PathError); ok {
+        errno = pe.Error
+    }
+    switch errno {
+    case os.ENOENT:
+        return false
+    case os.EACCES, os.EPERM:
+        ctx.Forbidden("Forbidden")
+    default:
+        logErrorf("Failed to serve %s: %s", name, err)
+        ctx.Abort(500, "Server Error")
+    }
+    return true
+}
+
+const fileChunkSize = 32 * 1024
+
+//copies length bytes of content, starting at offset, to the response. It's sent
+//a chunk at a time so large files aren't held in memory. A failed write usually
+//means the client went away, so copying just stops
+func copyContent(ctx *Context, content fileContent, offset int64, length int64) {
+    var buf [fileChunkSize]byte
+    for length > 0 {
+        chunk := buf[0:]
+        if length < int64(len(chunk)) {
+            chunk = chunk[0:length]
+        }
+        n, err := content.ReadAt(chunk, offset)
+        if n > 0 {
+            if _, werr := ctx.Write(chunk[0:n]); werr != nil {
+                return
+            }
+            offset += int64(n)
+            length -= int64(n)
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+//a byte range of a file, from a Range header
+type byteRange struct {
+    start  int64
+    length int64
+}
+
+var errUnsatisfiableRange = os.NewError("unsatisfiable range")
+
+//parses a Range header for a file of the given size. Only single ranges are
+//supported, so a nil range is returned for anything else, meaning the whole
+//file should be sent
+func parseRange(header string, size int64) (*byteRange, os.Error) {
+    if !strings.HasPrefix(header, "bytes=") {
+        return nil, nil
+    }
+    spec := strings.TrimSpace(header[6:])
+    dash := strings.Index(spec, "-")
+    if dash == -1 || strings.Index(spec, ",") != -1 {
+        return nil, nil
+    }
+    first := strings.TrimSpace(spec[0:dash])
+    last := strings.TrimSpace(spec[dash+1:])
+
+    if first == "" {
+        //a suffix range, with the last n bytes of the file
+        n, err := strconv.Atoi64(last)
+        if err != nil || n < 0 {
+            return nil, nil
+        }
+        if n == 0 || size == 0 {
+            return nil, errUnsatisfiableRange
+        }
+        if n > size {
+            n = size
+        }
+        return &byteRange{size - n, n}, nil
+    }
+
+    start, err := strconv.Atoi64(first)
+    if err != nil || start < 0 {
+        return nil, nil
+    }
+    end := size - 1
+    if last != "" {
+        e, err := strconv.Atoi64(last)
+        if err != nil || e < start {
+            return nil, nil
+        }
+        if e < end {
+            end = e
+        }
+    }
+    if start >= size {
+        return nil, errUnsatisfiableRange
+    }
+    return &byteRange{start, end - start + 1}, nil
+}
+
+//Sends a file as the response, with its Content-Type deduced from the extension.
+//If the file can't be read an error is returned and nothing is written, so the
+//handler can decide how to respond
+func (ctx *Context) ServeFile(path string) os.Error {
+    return serveFile(ctx, path)
+}
+
+//Sends a file as an attachment, which browsers save as downloadName. Like
+//ServeFile, nothing is written if the file can't be read
+func (ctx *Context) ServeFileAs(path string, downloadName string) os.Error {
+    return serveFileWith(ctx, path, func() {
+        ctx.SetHeader("Content-Disposition", attachmentDisposition(downloadName), true)
+    })
+}
+
+//the Content-Disposition of an attachment named name, quoted as in RFC 6266.
+//Names that aren't ASCII also get a filename* parameter in UTF-8, with an ASCII
+//filename for older clients
+func attachmentDisposition(name string) string {
+    var quoted bytes.Buffer
+    ascii := true
+    for _, c := range name {
+        switch {
+        case c >= 0x80:
+            ascii = false
+            quoted.WriteByte('_')
+        case c < 0x20 || c == 0x7f:
+            quoted.WriteByte('_')
+        case c == '"' || c == '\\':
+            quoted.WriteByte('\\')
+            quoted.WriteByte(byte(c))
+        default:
+            quoted.WriteByte(byte(c))
+        }
+    }
+    disposition := `attachment; filename="` + quoted.String() + `"`
+    if ascii {
+        return disposition
+    }
+
+    var encoded bytes.Buffer
+    for i := 0; i < len(name); i++ {
+        c := name[i]
+        if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexRune("!#$&+-.^_`|~", int(c)) != -1 {
+            encoded.WriteByte(c)
+        } else {
+            fmt.Fprintf(&encoded, "%%%02X", c)
+        }
     }
+    return disposition + "; filename*=UTF-8''" + encoded.String()
 }
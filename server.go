@@ -0,0 +1,557 @@
+package web
+
+import (
+    "container/vector"
+    "crypto/rand"
+    "crypto/tls"
+    "http"
+    "io"
+    "net"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+//a listener that keeps track of the connections it accepts, so they can be
+//closed when the server shuts down
+type trackingListener struct {
+    net.Listener
+}
+
+func (l *trackingListener) Accept() (net.Conn, os.Error) {
+    c, err := l.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+    tc := &trackedConn{c}
+    serverLock.Lock()
+    conns[tc] = true
+    serverLock.Unlock()
+    return tc, nil
+}
+
+type trackedConn struct {
+    net.Conn
+}
+
+func (c *trackedConn) Close() os.Error {
+    serverLock.Lock()
+    conns[c] = false, false
+    serverLock.Unlock()
+    return c.Conn.Close()
+}
+
+//protects the listeners, connections and request count
+var serverLock sync.Mutex
+
+var listeners = make(map[*trackingListener]bool)
+
+var conns = make(map[*trackedConn]bool)
+
+//the number of requests being handled
+var inflight int
+
+var shutdownGracePeriod int64 = 10e9
+
+var shutdownHooks vector.Vector
+
+//Sets how long Close waits for the requests being handled to finish, 10
+//seconds by default
+func SetShutdownGracePeriod(seconds int) { shutdownGracePeriod = int64(seconds) * 1e9 }
+
+//Adds a function that's called when the server is shut down with Close, after
+//the connections are closed
+func OnShutdown(hook func()) { shutdownHooks.Push(hook) }
+
+var startHooks vector.Vector
+
+//Adds a function called with the listening address once a server is listening,
+//before it accepts connections. Hooks run in the order they were added, and one
+//that panics doesn't stop the others or the server
+func OnStart(hook func(addr string)) { startHooks.Push(hook) }
+
+func runStartHooks(addr string) {
+    for i := 0; i < startHooks.Len(); i++ {
+        runStartHook(startHooks.At(i).(func(string)), addr)
+    }
+}
+
+func runStartHook(hook func(string), addr string) {
+    defer func() {
+        if err := recover(); err != nil {
+            logErrorf("OnStart hook failed: %v", err)
+        }
+    }()
+    hook(addr)
+}
+
+//Starts serving http requests on addr in the background, for programs with a
+//main loop of their own. stop closes the listener
+func Start(addr string) (stop func(), err os.Error) {
+    l, err := listen(addr)
+    if err != nil {
+        return nil, err
+    }
+    logInfof("web.go serving %s", l.Addr())
+    go func() {
+        if err := serve("http", l); err != nil {
+            logErrorf("Serve error: %s", err)
+        }
+    }()
+    return func() { stopListener(l) }, nil
+}
+
+//listens on addr, which is either a tcp address or the path of a unix socket,
+//like "unix:/var/run/app.sock"
+func listen(addr string) (net.Listener, os.Error) {
+    if strings.HasPrefix(addr, "unix:") {
+        return listenUnix(addr[5:], 0)
+    }
+    return net.Listen("tcp", addr)
+}
+
+//listens on the unix socket socketPath, replacing a stale socket left by a
+//previous run. The socket's permissions are set to mode, unless it's 0
+func listenUnix(socketPath string, mode uint32) (net.Listener, os.Error) {
+    if info, err := os.Lstat(socketPath); err == nil && info.IsSocket() {
+        os.Remove(socketPath)
+    }
+    l, err := net.Listen("unix", socketPath)
+    if err != nil {
+        return nil, err
+    }
+    if mode != 0 {
+        if err = os.Chmod(socketPath, mode); err != nil {
+            closeListener(l)
+            return nil, err
+        }
+    }
+    return l, nil
+}
+
+//closes a listener, removing the file of a unix socket unless it was inherited
+func closeListener(l net.Listener) {
+    addr := l.Addr()
+    l.Close()
+    if _, ok := l.(*fdListener); !ok && addr.Network() == "unix" {
+        os.Remove(addr.String())
+    }
+}
+
+//wraps l so it serves tls connections with the certificate and private key in
+//the PEM files certFile and keyFile. l is closed if they can't be loaded
+func tlsListener(l net.Listener, certFile string, keyFile string) (net.Listener, os.Error) {
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        closeListener(l)
+        return nil, err
+    }
+    config := &tls.Config{
+        Rand:         rand.Reader,
+        Time:         time.Seconds,
+        Certificates: []tls.Certificate{cert},
+    }
+    return tls.NewListener(l, config), nil
+}
+
+//ListenerSpec describes one of the listeners started by RunMany
+type ListenerSpec struct {
+    Protocol string //"http", "scgi" or "fcgi"
+    Addr     string //a tcp address, or a unix socket like "unix:/var/run/app.sock"
+    CertFile string //set along with KeyFile to serve https
+    KeyFile  string
+}
+
+func listenSpec(spec ListenerSpec) (net.Listener, os.Error) {
+    switch spec.Protocol {
+    case "http", "scgi", "fcgi":
+    default:
+        return nil, os.NewError("Unknown protocol " + spec.Protocol)
+    }
+    l, err := listen(spec.Addr)
+    if err != nil {
+        return nil, err
+    }
+    if spec.CertFile != "" || spec.KeyFile != "" {
+        if spec.Protocol != "http" {
+            closeListener(l)
+            return nil, os.NewError("TLS is only supported for http")
+        }
+        return tlsListener(l, spec.CertFile, spec.KeyFile)
+    }
+    return l, nil
+}
+
+//Serves the web application on several listeners at once, like http for local
+//debugging and fastcgi for the web server. All the listeners are started before
+//serving begins. It returns the first error, after stopping the other listeners,
+//or nil once Close is called
+func RunMany(specs ...ListenerSpec) os.Error {
+    ls := make([]net.Listener, len(specs))
+    for i, spec := range specs {
+        l, err := listenSpec(spec)
+        if err != nil {
+            for _, started := range ls[0:i] {
+                closeListener(started)
+            }
+            return err
+        }
+        ls[i] = l
+    }
+
+    errors := make(chan os.Error, len(specs))
+    for i, l := range ls {
+        logInfof("web.go serving %s %s", specs[i].Protocol, specs[i].Addr)
+        go func(protocol string, l net.Listener) { errors <- serve(protocol, l) }(specs[i].Protocol, l)
+    }
+    for i := 0; i < len(ls); i++ {
+        if err := <-errors; err != nil {
+            for _, l := range ls {
+                stopListener(l)
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+//returns the listeners described by the [webserver] section of the config: the
+//protocol, which is http, https, scgi or fcgi, and the host and port, which can be
+//comma separated lists to listen on every host and port. A host can also be a unix
+//socket, like "unix:/var/run/app.sock", which doesn't need a port. https also
+//needs certFile and keyFile
+func configListenerSpecs() ([]ListenerSpec, os.Error) {
+    spec := ListenerSpec{Protocol: strings.ToLower(strings.TrimSpace(ConfigString("webserver", "protocol", "http")))}
+    switch spec.Protocol {
+    case "http", "scgi", "fcgi":
+    case "https":
+        var err os.Error
+        spec.Protocol = "http"
+        if spec.CertFile, err = configTLSFile("certFile"); err != nil {
+            return nil, err
+        }
+        if spec.KeyFile, err = configTLSFile("keyFile"); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, checkConfigProtocol(spec.Protocol)
+    }
+
+    hosts := strings.Split(ConfigString("webserver", "host", ""), ",", -1)
+    ports, err := parseConfigPorts(ConfigString("webserver", "port", ""))
+    if err != nil {
+        return nil, err
+    }
+
+    var specs vector.Vector
+    for _, host := range hosts {
+        host = strings.TrimSpace(host)
+        if strings.HasPrefix(host, "unix:") {
+            if len(host) == 5 {
+                return nil, os.NewError("webserver.host \"unix:\" needs the path of the socket")
+            }
+            s := spec
+            s.Addr = host
+            specs.Push(s)
+            continue
+        }
+        if strings.Index(host, ":") != -1 && !strings.HasPrefix(host, "[") {
+            if net.ParseIP(host) == nil {
+                return nil, os.NewError("webserver.host " + strconv.Quote(host) + " must not include the port, set webserver.port instead")
+            }
+            host = "[" + host + "]"
+        }
+        if len(ports) == 0 {
+            return nil, os.NewError("webserver.port must be set")
+        }
+        for _, port := range ports {
+            s := spec
+            s.Addr = host + ":" + port
+            specs.Push(s)
+        }
+    }
+
+    result := make([]ListenerSpec, specs.Len())
+    for i, s := range specs {
+        result[i] = s.(ListenerSpec)
+    }
+    return result, nil
+}
+
+//splits the comma separated list of webserver.port, checking the ports
+func parseConfigPorts(value string) ([]string, os.Error) {
+    if len(strings.TrimSpace(value)) == 0 {
+        return nil, nil
+    }
+    ports := strings.Split(value, ",", -1)
+    for i, port := range ports {
+        port = strings.TrimSpace(port)
+        n, err := strconv.Atoi(port)
+        if err != nil {
+            return nil, os.NewError("webserver.port " + strconv.Quote(port) + " is not a number")
+        }
+        if n < 1 || n > 65535 {
+            return nil, os.NewError("webserver.port " + port + " is out of range, it must be between 1 and 65535")
+        }
+        ports[i] = port
+    }
+    return ports, nil
+}
+
+//returns the file named by webserver.key, checking it exists
+func configTLSFile(key string) (string, os.Error) {
+    name := strings.TrimSpace(ConfigString("webserver", key, ""))
+    if len(name) == 0 {
+        return "", os.NewError("webserver." + key + " must be set to serve https")
+    }
+    if _, err := os.Stat(name); err != nil {
+        return "", os.NewError("webserver." + key + " " + strconv.Quote(name) + " can't be read: " + err.String())
+    }
+    return name, nil
+}
+
+//Serves the web application as set in the [webserver] section of the config, with
+//the protocol, host, port, certFile and keyFile settings. host and port can be
+//comma separated lists, and then every combination is served, like with RunMany.
+//The settings are checked before anything is started
+func RunFromConfig() os.Error {
+    specs, err := configListenerSpecs()
+    if err != nil {
+        return err
+    }
+    return RunMany(specs...)
+}
+
+//closes l if it's being served, which makes serve return nil
+func stopListener(l net.Listener) {
+    serverLock.Lock()
+    defer serverLock.Unlock()
+    for tl, _ := range listeners {
+        if tl.Listener == l {
+            listeners[tl] = false, false
+            closeListener(l)
+        }
+    }
+}
+
+//runs the accept loop of the "http", "scgi" or "fcgi" protocol on l, until
+//there's an error or Close is called. nil is returned after a Close
+func serve(protocol string, l net.Listener) os.Error {
+    switch protocol {
+    case "scgi":
+        return serveConns(l, nil, handleScgiRequest)
+    case "fcgi":
+        return serveConns(l, nil, handleFcgiConnection)
+    }
+    return serveConns(l, http.HandlerFunc(httpHandler), nil)
+}
+
+//runs the accept loop on l, serving http requests with handler, or handing the
+//connections to handle if it's nil
+func serveConns(l net.Listener, handler http.Handler, handle func(io.ReadWriteCloser)) os.Error {
+    lazyInit()
+    if err := loadDefaultConfig(); err != nil {
+        closeListener(l)
+        return err
+    }
+    if err := checkConfig(); err != nil {
+        closeListener(l)
+        return err
+    }
+    if err := applyLogConfig(); err != nil {
+        closeListener(l)
+        return err
+    }
+    if err := checkCookieSecret(); err != nil {
+        closeListener(l)
+        return err
+    }
+
+    tl := &trackingListener{l}
+    serverLock.Lock()
+    listeners[tl] = true
+    serverLock.Unlock()
+
+    runStartHooks(l.Addr().String())
+
+    var err os.Error
+    if handler != nil {
+        err = http.Serve(tl, handler)
+    } else {
+        for {
+            fd, aerr := tl.Accept()
+            if aerr != nil {
+                err = aerr
+                break
+            }
+            go handle(fd)
+        }
+    }
+
+    serverLock.Lock()
+    defer serverLock.Unlock()
+    if !listeners[tl] {
+        //closed by Close
+        return nil
+    }
+    listeners[tl] = false, false
+    closeListener(l)
+    return err
+}
+
+func requestStarted() {
+    serverLock.Lock()
+    inflight++
+    serverLock.Unlock()
+}
+
+func requestFinished() {
+    serverLock.Lock()
+    inflight--
+    serverLock.Unlock()
+}
+
+func requestsInFlight() int {
+    serverLock.Lock()
+    defer serverLock.Unlock()
+    return inflight
+}
+
+//the request limit set with SetMaxConcurrentRequests. A request takes a place in
+//admitted, then waits for one in running
+type requestLimit struct {
+    running  chan bool
+    admitted chan bool
+}
+
+var limit *requestLimit
+
+//Limits the number of requests handled at once to n. Up to queue more requests
+//wait for their turn, and the ones after that get a 503 with a Retry-After
+//header. Static files aren't limited. n = 0 removes the limit
+func SetMaxConcurrentRequests(n int, queue int) {
+    if n <= 0 {
+        limit = nil
+        return
+    }
+    if queue < 0 {
+        queue = 0
+    }
+    limit = &requestLimit{make(chan bool, n), make(chan bool, n+queue)}
+}
+
+//waits for the request's turn. It returns false if the queue is full, otherwise
+//the returned limit has to be released once the request is done
+func acquireRequestSlot() (*requestLimit, bool) {
+    l := limit
+    if l == nil {
+        return nil, true
+    }
+    select {
+    case l.admitted <- true:
+    default:
+        return nil, false
+    }
+    l.running <- true
+    return l, true
+}
+
+func (l *requestLimit) release() {
+    if l != nil {
+        <-l.running
+        <-l.admitted
+    }
+}
+
+//the number of requests waiting for their turn
+func requestsWaiting() int {
+    l := limit
+    if l == nil {
+        return 0
+    }
+    waiting := len(l.admitted) - len(l.running)
+    if waiting < 0 {
+        return 0
+    }
+    return waiting
+}
+
+//Shuts the server down. New connections are refused, the requests being handled
+//get up to the grace period to finish, and then the remaining connections are
+//closed and the shutdown hooks are called. Run, RunScgi and RunFcgi return
+func Close() {
+    serverLock.Lock()
+    for l, _ := range listeners {
+        closeListener(l.Listener)
+    }
+    listeners = make(map[*trackingListener]bool)
+    serverLock.Unlock()
+
+    deadline := time.Nanoseconds() + shutdownGracePeriod
+    for requestsInFlight() > 0 && time.Nanoseconds() < deadline {
+        time.Sleep(10e6)
+    }
+
+    serverLock.Lock()
+    for c, _ := range conns {
+        c.Conn.Close()
+    }
+    conns = make(map[*trackedConn]bool)
+    serverLock.Unlock()
+
+    for i := 0; i < shutdownHooks.Len(); i++ {
+        shutdownHooks.At(i).(func())()
+    }
+}
+
+var handleSignals = false
+var signalsWatched sync.Once
+
+//Sets whether SIGINT and SIGTERM shut the server down gracefully with Close,
+//instead of killing the process right away. Until it's enabled, web.go leaves
+//the signals to the application
+func HandleSignals(enabled bool) {
+    handleSignals = enabled
+    if enabled {
+        startSignalWatcher()
+    }
+}
+
+//starts reading the signals, the first time it's called
+func startSignalWatcher() {
+    signalsWatched.Do(func() { go watchSignals() })
+}
+
+//once os/signal is imported, the runtime queues signals instead of acting on
+//them, so while they are read here the ones that would have killed the process
+//still have to
+func watchSignals() {
+    for sig := range signal.Incoming {
+        usig, ok := sig.(signal.UnixSignal)
+        if !ok {
+            continue
+        }
+        switch usig {
+        case syscall.SIGINT, syscall.SIGTERM:
+            if handleSignals {
+                logInfof("web.go shutting down on %s", sig)
+                go Close()
+                continue
+            }
+            os.Exit(128 + int(usig))
+        case syscall.SIGHUP:
+            os.Exit(128 + int(usig))
+        case syscall.SIGUSR1:
+            if !reopenOnSignal {
+                continue
+            }
+            if err := ReopenLogs(); err != nil {
+                logErrorf("Failed to reopen the logs: %s", err)
+            }
+        }
+    }
+}
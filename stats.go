@@ -0,0 +1,92 @@
+package web
+
+import (
+    "strconv"
+    "sync"
+    "time"
+)
+
+//ServerStats holds counters about the requests served since the application started
+type ServerStats struct {
+    Requests  int64                 //requests served
+    Responses map[string]int64      //responses by status class, like "2xx", or "hijacked"
+    Bytes     int64                 //response body bytes written
+    InFlight  int                   //requests being handled right now
+    TimedOut  int64                 //requests whose handler timed out
+    Waiting   int                   //requests waiting for their turn, see SetMaxConcurrentRequests
+    Rejected  int64                 //requests refused because too many were waiting
+    Routes    map[string]RouteStats //keyed by the method and pattern, like "GET /user/(.*)"
+}
+
+//RouteStats holds the counters of a single route
+type RouteStats struct {
+    Hits    int64
+    Latency int64 //the total time taken by the route's requests, in microseconds
+}
+
+var stats = ServerStats{Responses: make(map[string]int64), Routes: make(map[string]RouteStats)}
+var statsLock sync.Mutex
+
+//Returns a copy of the request counters
+func Stats() ServerStats {
+    statsLock.Lock()
+    defer statsLock.Unlock()
+    s := stats
+    s.Responses = make(map[string]int64)
+    for class, n := range stats.Responses {
+        s.Responses[class] = n
+    }
+    s.Routes = make(map[string]RouteStats)
+    for key, rs := range stats.Routes {
+        s.Routes[key] = rs
+    }
+    s.InFlight = requestsInFlight()
+    s.Waiting = requestsWaiting()
+    return s
+}
+
+//Serves the request counters as JSON at path, like "/debug/webgo-stats"
+func EnableStatsEndpoint(path string) {
+    Get(path, func(ctx *Context) {
+        ctx.SetHeader("Cache-Control", "no-cache", true)
+        ctx.WriteJSON(Stats())
+    })
+}
+
+//the key of a route in the stats
+func (route *Route) statsKey() string { return route.method + " " + route.r }
+
+//counts a finished request. route is nil if it wasn't handled by a route
+func recordStats(route *Route, c *loggedConn, start int64) {
+    class := strconv.Itoa(c.sentStatus()/100) + "xx"
+    if c.hijacked {
+        class = "hijacked"
+    }
+    elapsed := (time.Nanoseconds() - start) / 1e3
+
+    statsLock.Lock()
+    defer statsLock.Unlock()
+    stats.Requests++
+    stats.Responses[class]++
+    stats.Bytes += c.bytes
+    if route != nil {
+        rs := stats.Routes[route.statsKey()]
+        rs.Hits++
+        rs.Latency += elapsed
+        stats.Routes[route.statsKey()] = rs
+    }
+}
+
+//counts a request whose handler timed out
+func countTimeout() {
+    statsLock.Lock()
+    stats.TimedOut++
+    statsLock.Unlock()
+}
+
+//counts a request refused by the concurrency limit
+func countRejected() {
+    statsLock.Lock()
+    stats.Rejected++
+    statsLock.Unlock()
+}
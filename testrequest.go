@@ -0,0 +1,110 @@
+package web
+
+import (
+    "bytes"
+    "http"
+    "os"
+    "strconv"
+    "strings"
+)
+
+//RecordedResponse is the response to a request made with TestRequest
+type RecordedResponse struct {
+    Status  int
+    Headers map[string][]string
+    Body    []byte
+    Cookies map[string]string //the values of the cookies that were set
+}
+
+//recorderConn keeps the response instead of sending it
+type recorderConn struct {
+    resp         *RecordedResponse
+    body         bytes.Buffer
+    wroteHeaders bool
+}
+
+func (c *recorderConn) StartResponse(status int) {
+    c.wroteHeaders = true
+    c.resp.Status = status
+}
+
+func (c *recorderConn) SetHeader(hdr string, val string, unique bool) {
+    if c.wroteHeaders {
+        logErrorf("Header %s set after the response was started", hdr)
+        return
+    }
+    setHeader(c.resp.Headers, hdr, val, unique)
+}
+
+func (c *recorderConn) DelHeader(hdr string) {
+    if c.wroteHeaders {
+        logErrorf("Header %s removed after the response was started", hdr)
+        return
+    }
+    c.resp.Headers[hdr] = nil, false
+}
+
+func (c *recorderConn) Write(data []byte) (n int, err os.Error) { return c.body.Write(data) }
+
+func (c *recorderConn) Flush() {}
+
+func (c *recorderConn) Close() {}
+
+//Runs a request through the application without a network listener, the same
+//way as one from a client, and returns the response. It's meant for testing
+//handlers:
+//
+//  resp := web.TestRequest("POST", "/login", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, []byte("user=a"))
+//  if resp.Status != 303 {
+//      t.Fatalf("login failed")
+//  }
+func TestRequest(method string, path string, headers map[string]string, body []byte) *RecordedResponse {
+    req := newTestRequest(method, path, headers, body)
+    resp := &RecordedResponse{Status: 200, Headers: make(map[string][]string), Cookies: make(map[string]string)}
+    c := recorderConn{resp: resp}
+    routeHandler(req, &c)
+
+    resp.Body = c.body.Bytes()
+    for _, cookie := range resp.Headers["Set-Cookie"] {
+        if i := strings.Index(cookie, ";"); i != -1 {
+            cookie = cookie[0:i]
+        }
+        if kv := strings.Split(cookie, "=", 2); len(kv) == 2 {
+            resp.Cookies[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+        }
+    }
+    return resp
+}
+
+//builds a request from the local host, like the http server would
+func newTestRequest(method string, path string, headers map[string]string, body []byte) *Request {
+    rawurl := "http://localhost" + path
+    url, _ := http.ParseURL(rawurl)
+    req := Request{
+        Method:     method,
+        RawURL:     rawurl,
+        URL:        url,
+        Proto:      "HTTP/1.1",
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Headers:    make(map[string]string),
+        Body:       bytes.NewBuffer(body),
+        Host:       "localhost",
+        RemoteAddr: "127.0.0.1:1024",
+    }
+    for k, v := range headers {
+        req.Headers[http.CanonicalHeaderKey(k)] = v
+    }
+    if len(body) > 0 {
+        req.Headers["Content-Length"] = strconv.Itoa(len(body))
+    }
+
+    //these are kept in the request fields, like the http package does
+    for name, field := range map[string]*string{"Host": &req.Host, "Referer": &req.Referer, "User-Agent": &req.UserAgent} {
+        if v, ok := req.Headers[name]; ok {
+            *field = v
+            req.Headers[name] = "", false
+        }
+    }
+    return &req
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+    "os"
+    "reflect"
+    "strconv"
+    "sync"
+    "time"
+)
+
+var handlerTimeout int64 //in nanoseconds, 0 disables it
+
+//Sets how long handlers have to finish, in milliseconds. When one takes longer
+//the client gets a 503, if the response hasn't started, and whatever the handler
+//writes afterwards is discarded. 0 disables the timeout, which is the default
+func SetHandlerTimeout(ms int64) { handlerTimeout = ms * 1e6 }
+
+//Sets the handler timeout of this route in milliseconds, overriding the one set
+//with SetHandlerTimeout. 0 disables it for the route
+func (route *Route) Timeout(ms int64) *Route {
+    route.timeout = ms * 1e6
+    return route
+}
+
+func (route *Route) handlerTimeout() int64 {
+    if route.timeout >= 0 {
+        return route.timeout
+    }
+    return handlerTimeout
+}
+
+//calls the handler in its own goroutine. ok is false if it didn't return in
+//timeout nanoseconds, in which case it's left running, and abandoned is called
+//once it returns
+func callWithTimeout(call func() []reflect.Value, timeout int64, abandoned func()) (ret []reflect.Value, ok bool) {
+    done := make(chan []reflect.Value, 1)
+    expired := make(chan bool, 1)
+    var lock sync.Mutex
+    returned, timedOut := false, false
+    go func() {
+        ret := call()
+        lock.Lock()
+        returned = true
+        gaveUp := timedOut
+        lock.Unlock()
+        if gaveUp {
+            abandoned()
+            return
+        }
+        done <- ret
+    }()
+    go func() {
+        time.Sleep(timeout)
+        expired <- true
+    }()
+
+    select {
+    case ret = <-done:
+        return ret, true
+    case <-expired:
+    }
+
+    lock.Lock()
+    defer lock.Unlock()
+    if returned {
+        //it returned just in time
+        return <-done, true
+    }
+    timedOut = true
+    return nil, false
+}
+
+//timeoutConn drops everything a handler sends once it timed out, so it can't
+//interleave with the timeout response
+type timeoutConn struct {
+    conn
+    lock     sync.Mutex
+    started  bool
+    timedOut bool
+}
+
+func (c *timeoutConn) StartResponse(status int) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if !c.timedOut {
+        c.started = true
+        c.conn.StartResponse(status)
+    }
+}
+
+func (c *timeoutConn) SetHeader(hdr string, val string, unique bool) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if !c.timedOut {
+        c.conn.SetHeader(hdr, val, unique)
+    }
+}
+
+func (c *timeoutConn) DelHeader(hdr string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if !c.timedOut {
+        c.conn.DelHeader(hdr)
+    }
+}
+
+func (c *timeoutConn) Write(data []byte) (n int, err os.Error) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if c.timedOut {
+        return 0, os.EPIPE
+    }
+    return c.conn.Write(data)
+}
+
+func (c *timeoutConn) Flush() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if !c.timedOut {
+        c.conn.Flush()
+    }
+}
+
+func (c *timeoutConn) Close() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if !c.timedOut {
+        c.conn.Close()
+    }
+}
+
+//cuts the handler off, and sends a 503 unless it already started the response
+func (c *timeoutConn) timeout() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.timedOut = true
+    if c.started {
+        return
+    }
+    body := []byte("Service Unavailable")
+    c.conn.SetHeader("Content-Type", "text/plain; charset=utf-8", true)
+    c.conn.SetHeader("Content-Length", strconv.Itoa(len(body)), true)
+    c.conn.StartResponse(503)
+    c.conn.Write(body)
+}
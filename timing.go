@@ -0,0 +1,34 @@
+package web
+
+import "fmt"
+
+var timingHeader bool
+var slowRequestThreshold int64 //in nanoseconds, 0 disables the warning
+
+//Adds an X-Response-Time header with the time the handler took, like "12.3ms".
+//It's only added to responses that haven't been sent when the handler returns,
+//like buffered ones and the strings returned by handlers
+func AddTimingHeader(enabled bool) { timingHeader = enabled }
+
+//Logs a warning for requests whose handler takes longer than ms milliseconds.
+//0 disables the warning
+func SetSlowRequestThreshold(ms int64) { slowRequestThreshold = ms * 1e6 }
+
+//formats a duration in nanoseconds as milliseconds
+func formatMillis(ns int64) string { return fmt.Sprintf("%.1fms", float64(ns)/1e6) }
+
+//adds the timing header for a handler that took handlerTime nanoseconds, unless
+//the response was already sent
+func setTimingHeader(ctx *Context, handlerTime int64) {
+    if timingHeader && (ctx.buffer != nil || !ctx.responseStarted) {
+        ctx.SetHeader("X-Response-Time", formatMillis(handlerTime), true)
+    }
+}
+
+//warns about a slow request once it has been sent. The handler time excludes
+//sending a buffered response, the total time doesn't
+func checkSlowRequest(req *Request, handlerTime int64, totalTime int64) {
+    if slowRequestThreshold > 0 && handlerTime > slowRequestThreshold {
+        logErrorf("Slow request: %s %s took %s (%s including the response)", req.Method, req.URL.Path, formatMillis(handlerTime), formatMillis(totalTime))
+    }
+}
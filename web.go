@@ -4,27 +4,43 @@ import (
     "bytes"
     "container/vector"
     "crypto/hmac"
+    "crypto/sha256"
+    "crypto/subtle"
     "encoding/base64"
+    "encoding/hex"
     "fmt"
+    "hash"
     "http"
     "io/ioutil"
-    "log"
     "os"
     "path"
     "reflect"
     "regexp"
     "strconv"
     "strings"
+    "sync"
+    "template"
     "time"
 )
 
-//secret key used to store cookies
-var secret = ""
+//secret keys used to store cookies. the first one signs, all of them verify
+var secrets []string
+
+//secure cookie formats
+const (
+    cookieFormatSHA1   = iota + 1 //val|timestamp|sig
+    cookieFormatSHA256            //2|val|timestamp|sig
+)
+
+//the number of seconds a secure cookie is valid for. 0 disables the check
+var secureCookieMaxAge int64 = 31 * 86400
 
 type conn interface {
     StartResponse(status int)
     SetHeader(hdr string, val string, unique bool)
+    DelHeader(hdr string)
     Write(data []byte) (n int, err os.Error)
+    Flush()
     Close()
 }
 
@@ -32,21 +48,88 @@ type Context struct {
     *Request
     *conn
     responseStarted bool
+    buffer          *bytes.Buffer     //the response body, when buffering
+    status          int               //the status sent when the buffer is flushed
+    flash           map[string]string //flash messages set by the previous request
+    pendingFlash    map[string]string //flash messages for the next request
+    flashRead       bool
+    noBody          bool   //set for responses that can't have a body, like a 304
+    prefix          string //the path the application is mounted at
 }
 
 func (ctx *Context) StartResponse(status int) {
+    if ctx.buffer != nil {
+        //the response is sent when the buffer is flushed
+        ctx.status = status
+        ctx.responseStarted = true
+        return
+    }
+    ctx.saveFlash()
     ctx.conn.StartResponse(status)
     ctx.responseStarted = true
 }
 
+//Buffers the response until the handler returns, so the status and headers can
+//still be changed after writing. The Content-Length is set automatically
+func (ctx *Context) Buffer() {
+    if ctx.buffer != nil {
+        return
+    }
+    if ctx.responseStarted {
+        logErrorf("Buffer called after the response was started")
+        return
+    }
+    ctx.buffer = new(bytes.Buffer)
+    ctx.status = 200
+}
+
+//Sends the status, headers and content buffered so far. Later writes are sent
+//to the client right away
+func (ctx *Context) FlushBuffer() {
+    if ctx.buffer == nil {
+        return
+    }
+    buf := ctx.buffer
+    ctx.buffer = nil
+    ctx.saveFlash()
+    ctx.conn.StartResponse(ctx.status)
+    ctx.responseStarted = true
+    ctx.Write(buf.Bytes())
+}
+
+//Sends the data written so far to the client, including a buffered response
+func (ctx *Context) Flush() {
+    ctx.FlushBuffer()
+    ctx.conn.Flush()
+}
+
+//sends a buffered response once the handler is done, along with its length
+func (ctx *Context) finishBuffer() {
+    if ctx.buffer == nil {
+        return
+    }
+    if ctx.noBody {
+        ctx.FlushBuffer()
+        return
+    }
+    ctx.SetHeader("Content-Length", strconv.Itoa(ctx.buffer.Len()), true)
+    ctx.FlushBuffer()
+}
+
 func (ctx *Context) Write(data []byte) (n int, err os.Error) {
     if !ctx.responseStarted {
         ctx.StartResponse(200)
     }
 
-    //if it's a HEAD request, we just write blank data
-    if ctx.Request.Method == "HEAD" {
-        data = []byte{}
+    if ctx.noBody {
+        if len(data) > 0 {
+            logErrorf("Write to %s discarded, the response can't have a body", ctx.Request.URL.Path)
+        }
+        return len(data), nil
+    }
+
+    if ctx.buffer != nil {
+        return ctx.buffer.Write(data)
     }
 
     return ctx.conn.Write(data)
@@ -56,19 +139,197 @@ func (ctx *Context) WriteString(content string) {
 }
 
 func (ctx *Context) Abort(status int, body string) {
+    //drop any partial output that was buffered
+    if ctx.buffer != nil {
+        ctx.buffer.Reset()
+    }
+    ctx.SetHeader("Content-Length", strconv.Itoa(len(body)), true)
     ctx.StartResponse(status)
     ctx.WriteString(body)
 }
 
 func (ctx *Context) Redirect(status int, url string) {
+    if status < 300 || status > 399 {
+        logErrorf("Redirect to %q called with non-3xx status %d", url, status)
+    }
+    //absolute paths are relative to where the application is mounted, and behind
+    //a proxy that says how the client reached it, they're made into full URLs
+    if strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//") {
+        if ctx.Request.hasForwardedOrigin() {
+            url = ctx.BaseURL() + url
+        } else {
+            url = ctx.prefix + url
+        }
+    }
+    var buf bytes.Buffer
+    template.HTMLEscape(&buf, []byte(url))
+    escaped := buf.String()
+    body := `Redirecting to: <a href="` + escaped + `">` + escaped + "</a>"
+
     ctx.SetHeader("Location", url, true)
+    ctx.SetHeader("Content-Type", "text/html; charset=utf-8", true)
+    ctx.SetHeader("Content-Length", strconv.Itoa(len(body)), true)
+    ctx.StartResponse(status)
+    ctx.WriteString(body)
+}
+
+//Redirects with a 301 Moved Permanently
+func (ctx *Context) RedirectPermanent(url string) { ctx.Redirect(301, url) }
+
+//Redirects with a 302 Found
+func (ctx *Context) RedirectTemporary(url string) { ctx.Redirect(302, url) }
+
+//Redirects with a 303 See Other, typically after a POST
+func (ctx *Context) RedirectSeeOther(url string) { ctx.Redirect(303, url) }
+
+func (ctx *Context) NotFound(message string) { ctx.Abort(404, message) }
+
+//Sends a 400 Bad Request with message as the body
+func (ctx *Context) BadRequest(message string) { ctx.Abort(400, message) }
+
+//Sends a 401 Unauthorized with message as the body
+func (ctx *Context) Unauthorized(message string) { ctx.Abort(401, message) }
+
+//Sends a 403 Forbidden with message as the body
+func (ctx *Context) Forbidden(message string) { ctx.Abort(403, message) }
+
+//Sends a 204 No Content. Anything written afterwards is discarded
+func (ctx *Context) NoContent() { ctx.startBodyless(204) }
+
+//Sends a 304 Not Modified. Anything written afterwards is discarded
+func (ctx *Context) NotModified() {
+    ctx.DelHeader("Content-Type")
+    ctx.startBodyless(304)
+}
+
+//starts a response that must not have a body
+func (ctx *Context) startBodyless(status int) {
+    if ctx.buffer != nil {
+        ctx.buffer.Reset()
+    }
+    ctx.DelHeader("Content-Length")
     ctx.StartResponse(status)
-    ctx.WriteString("Redirecting to: " + url)
+    ctx.noBody = true
+}
+
+//Sets the ETag header, quoting the tag if needed
+func (ctx *Context) SetETag(tag string) {
+    ctx.SetHeader("ETag", quoteETag(tag), true)
+}
+
+//Sets the ETag header and compares it against the If-None-Match header of the
+//request. If they match, a 304 is sent and true is returned, so the handler
+//doesn't need to write the response
+func (ctx *Context) CheckETag(tag string) bool {
+    ctx.SetETag(tag)
+    header, ok := ctx.Request.Headers["If-None-Match"]
+    if !ok || !etagMatch(header, tag) {
+        return false
+    }
+    ctx.NotModified()
+    return true
+}
+
+//Sets the Last-Modified header and compares it against the If-Modified-Since
+//header of the request. If the content hasn't been modified since, a 304 is
+//sent and true is returned
+func (ctx *Context) CheckLastModified(t *time.Time) bool {
+    ctx.SetHeader("Last-Modified", webTime(time.SecondsToUTC(t.Seconds())), true)
+    header, ok := ctx.Request.Headers["If-Modified-Since"]
+    if !ok {
+        return false
+    }
+    since, err := time.Parse(time.RFC1123, header)
+    if err != nil || t.Seconds() > since.Seconds() {
+        return false
+    }
+    ctx.NotModified()
+    return true
+}
+
+func quoteETag(tag string) string {
+    if strings.HasPrefix(tag, `"`) || strings.HasPrefix(tag, `W/"`) {
+        return tag
+    }
+    return `"` + tag + `"`
+}
+
+//parses the entity tags of an If-None-Match header, dropping the weak validator
+//prefixes. returns nil if the header is malformed
+func parseETags(header string) []string {
+    var tags vector.StringVector
+    for i := 0; i < len(header); {
+        switch header[i] {
+        case ' ', '\t', ',':
+            i++
+        case '*':
+            tags.Push("*")
+            i++
+        default:
+            if strings.HasPrefix(header[i:], "W/") {
+                i += 2
+            }
+            if i >= len(header) || header[i] != '"' {
+                return nil
+            }
+            end := strings.Index(header[i+1:], `"`)
+            if end == -1 {
+                return nil
+            }
+            tags.Push(header[i : i+end+2])
+            i += end + 2
+        }
+    }
+    return tags.Copy()
+}
+
+//checks if an If-None-Match header matches the tag using the weak comparison
+func etagMatch(header string, tag string) bool {
+    tag = quoteETag(tag)
+    if strings.HasPrefix(tag, "W/") {
+        tag = tag[2:]
+    }
+    for _, t := range parseETags(header) {
+        if t == "*" || t == tag {
+            return true
+        }
+    }
+    return false
 }
 
-func (ctx *Context) NotFound(message string) {
-    ctx.StartResponse(404)
-    ctx.WriteString(message)
+//Cookie holds a cookie value along with the attributes sent in the Set-Cookie header
+type Cookie struct {
+    Name     string
+    Value    string
+    Age      int64 //the amount of time in seconds. negative values expire the cookie
+    Path     string
+    Domain   string
+    Secure   bool
+    HttpOnly bool
+}
+
+func (cookie *Cookie) String() string {
+    var buf bytes.Buffer
+    if cookie.Age < 0 {
+        fmt.Fprintf(&buf, "%s=%s; expires=%s; Max-Age=0", cookie.Name, cookie.Value, webTime(time.SecondsToUTC(0)))
+    } else {
+        utctime := time.UTC()
+        utc1 := time.SecondsToUTC(utctime.Seconds() + cookie.Age)
+        fmt.Fprintf(&buf, "%s=%s; expires=%s", cookie.Name, cookie.Value, webTime(utc1))
+    }
+    if len(cookie.Path) > 0 {
+        fmt.Fprintf(&buf, "; Path=%s", cookie.Path)
+    }
+    if len(cookie.Domain) > 0 {
+        fmt.Fprintf(&buf, "; Domain=%s", cookie.Domain)
+    }
+    if cookie.Secure {
+        buf.WriteString("; Secure")
+    }
+    if cookie.HttpOnly {
+        buf.WriteString("; HttpOnly")
+    }
+    return buf.String()
 }
 
 //Sets a cookie -- duration is the amount of time in seconds. 0 = forever
@@ -77,44 +338,95 @@ func (ctx *Context) SetCookie(name string, value string, age int64) {
         //do some really long time
     }
 
-    utctime := time.UTC()
-    utc1 := time.SecondsToUTC(utctime.Seconds() + age)
-    cookie := fmt.Sprintf("%s=%s; expires=%s", name, value, webTime(utc1))
-    ctx.SetHeader("Set-Cookie", cookie, false)
+    ctx.SetCookieFull(Cookie{Name: name, Value: value, Age: age})
 }
 
-func SetCookieSecret(key string) { secret = key }
+//Sets a cookie along with its Path, Domain, Secure and HttpOnly attributes
+func (ctx *Context) SetCookieFull(cookie Cookie) {
+    ctx.SetHeader("Set-Cookie", cookie.String(), false)
+}
+
+//Expires a cookie on the client
+func (ctx *Context) DeleteCookie(name string) {
+    ctx.DeleteCookieFull(Cookie{Name: name})
+}
+
+//Expires a cookie on the client. The Path and Domain have to match the ones
+//the cookie was set with, otherwise browsers keep it
+func (ctx *Context) DeleteCookieFull(cookie Cookie) {
+    cookie.Value = ""
+    cookie.Age = -1
+    ctx.SetCookieFull(cookie)
+}
+
+//Sets the keys used to sign secure cookies. The first key is used for signing
+//new cookies, and all of them are tried when verifying, so old keys can be kept
+//around while rotating to a new one
+func SetCookieSecret(keys ...string) { secrets = keys }
+
+//Sets the number of seconds secure cookies are accepted for after being set.
+//The default is 31 days, and 0 disables the expiry check
+func SetSecureCookieMaxAge(seconds int64) { secureCookieMaxAge = seconds }
 
-func getCookieSig(val []byte, timestamp string) string {
-    hm := hmac.NewSHA1([]byte(secret))
+func cookieSig(format int, key string, val []byte, timestamp string) []byte {
+    var hm hash.Hash
+    if format == cookieFormatSHA1 {
+        hm = hmac.NewSHA1([]byte(key))
+    } else {
+        hm = hmac.New(sha256.New, []byte(key))
+    }
 
     hm.Write(val)
     hm.Write([]byte(timestamp))
 
-    hex := fmt.Sprintf("%02x", hm.Sum())
+    return hm.Sum()
+}
+
+func getCookieSig(format int, key string, val []byte, timestamp string) string {
+    hex := fmt.Sprintf("%02x", cookieSig(format, key, val, timestamp))
     return hex
 }
 
+//compares the signature of a cookie in constant time against each secret key
+func checkCookieSig(format int, val []byte, timestamp string, sig string) bool {
+    decoded, err := hex.DecodeString(sig)
+    if err != nil {
+        return false
+    }
+    for _, key := range cookieSecrets() {
+        if subtle.ConstantTimeCompare(decoded, cookieSig(format, key, val, timestamp)) == 1 {
+            return true
+        }
+    }
+    return false
+}
+
 func (ctx *Context) SetSecureCookie(name string, val string, age int64) {
+    ctx.SetSecureCookieFull(Cookie{Name: name, Value: val, Age: age})
+}
+
+//Signs the value of the cookie and sets it along with its attributes
+func (ctx *Context) SetSecureCookieFull(cookie Cookie) {
     //base64 encode the val
-    if len(secret) == 0 {
-        log.Stderrf("Secret Key for secure cookies has not been set. Please call web.SetCookieSecret\n")
+    keys := cookieSecrets()
+    if len(keys) == 0 || len(keys[0]) == 0 {
+        logErrorf("Secret Key for secure cookies has not been set. Please call web.SetCookieSecret")
         return
     }
     var buf bytes.Buffer
     encoder := base64.NewEncoder(base64.StdEncoding, &buf)
-    encoder.Write([]byte(val))
+    encoder.Write([]byte(cookie.Value))
     encoder.Close()
     vs := buf.String()
     vb := buf.Bytes()
 
     timestamp := strconv.Itoa64(time.Seconds())
 
-    sig := getCookieSig(vb, timestamp)
+    sig := getCookieSig(cookieFormatSHA256, keys[0], vb, timestamp)
 
-    cookie := strings.Join([]string{vs, timestamp, sig}, "|")
+    cookie.Value = strings.Join([]string{strconv.Itoa(cookieFormatSHA256), vs, timestamp, sig}, "|")
 
-    ctx.SetCookie(name, cookie, age)
+    ctx.SetCookieFull(cookie)
 }
 
 func (ctx *Context) GetSecureCookie(name string) (string, bool) {
@@ -125,77 +437,322 @@ func (ctx *Context) GetSecureCookie(name string) (string, bool) {
         return "", false
     }
 
-    parts := strings.Split(cookie, "|", 3)
+    parts := strings.Split(cookie, "|", -1)
+
+    //cookies without a version marker were signed with SHA1
+    var format int
+    switch {
+    case len(parts) == 3:
+        format = cookieFormatSHA1
+    case len(parts) == 4 && parts[0] == strconv.Itoa(cookieFormatSHA256):
+        format = cookieFormatSHA256
+        parts = parts[1:]
+    default:
+        return "", false
+    }
 
     val := parts[0]
     timestamp := parts[1]
     sig := parts[2]
 
-    if getCookieSig([]byte(val), timestamp) != sig {
+    if !checkCookieSig(format, []byte(val), timestamp, sig) {
         return "", false
     }
 
-    ts, _ := strconv.Atoi64(timestamp)
+    ts, err := strconv.Atoi64(timestamp)
+    if err != nil {
+        return "", false
+    }
 
-    if time.Seconds()-31*86400 > ts {
+    if secureCookieMaxAge > 0 && time.Seconds()-secureCookieMaxAge > ts {
         return "", false
     }
 
     buf := bytes.NewBufferString(val)
     encoder := base64.NewDecoder(base64.StdEncoding, buf)
 
-    res, _ := ioutil.ReadAll(encoder)
+    res, err := ioutil.ReadAll(encoder)
+    if err != nil {
+        return "", false
+    }
     return string(res), true
 }
 
+//name of the secure cookie holding flash messages between requests
+const flashCookie = "flash"
+
+//Stores a message that is available to the next request, typically after a redirect
+func (ctx *Context) SetFlash(key string, msg string) {
+    if ctx.pendingFlash == nil {
+        ctx.pendingFlash = make(map[string]string)
+    }
+    ctx.pendingFlash[key] = msg
+}
+
+//Returns a flash message stored by the previous request and removes it. Once
+//any flash message has been read, the unread ones are discarded as well
+func (ctx *Context) GetFlash(key string) (string, bool) {
+    if ctx.flash == nil {
+        ctx.flash = make(map[string]string)
+        if val, ok := ctx.GetSecureCookie(flashCookie); ok {
+            params := make(map[string][]string)
+            parseForm(params, val)
+            for k, v := range params {
+                if len(v) > 0 {
+                    ctx.flash[k] = v[0]
+                }
+            }
+        }
+    }
+    ctx.flashRead = true
+    msg, ok := ctx.flash[key]
+    ctx.flash[key] = "", false
+    return msg, ok
+}
+
+//writes the pending flash messages, or expires the ones that were read
+func (ctx *Context) saveFlash() {
+    if len(ctx.pendingFlash) > 0 {
+        var buf bytes.Buffer
+        for k, v := range ctx.pendingFlash {
+            if buf.Len() > 0 {
+                buf.WriteByte('&')
+            }
+            buf.WriteString(http.URLEscape(k))
+            buf.WriteByte('=')
+            buf.WriteString(http.URLEscape(v))
+        }
+        ctx.SetSecureCookieFull(Cookie{Name: flashCookie, Value: buf.String(), Age: 300, Path: "/", HttpOnly: true})
+    } else if ctx.flashRead {
+        ctx.DeleteCookieFull(Cookie{Name: flashCookie, Path: "/"})
+    }
+}
+
 var contextType reflect.Type
+//set with SetStaticDir, "" for the static directory of ExeDir
 var staticDir string
 
+//found by defaultInit, or set with Init
+var exeDir string
+
 func init() {
     contextType = reflect.Typeof(Context{})
-    //find the location of the exe file
-    arg0 := path.Clean(os.Args[0])
-    wd, _ := os.Getwd()
-    var exeFile string
-    if strings.HasPrefix(arg0, "/") {
-        exeFile = arg0
-    } else {
-        //TODO for robustness, search each directory in $PATH
-        exeFile = path.Join(wd, arg0)
+}
+
+//finds the directory of the executable started as arg0. Like the shell, a name
+//without a slash is looked up in the directories of pathList
+func findExeDir(arg0 string, wd string, pathList string) string {
+    exeFile := arg0
+    if strings.Index(arg0, "/") == -1 {
+        for _, dir := range strings.Split(pathList, ":", -1) {
+            if dir == "" {
+                dir = "."
+            }
+            if candidate := path.Join(dir, arg0); fileExists(candidate) {
+                exeFile = candidate
+                break
+            }
+        }
+    }
+    if !strings.HasPrefix(exeFile, "/") {
+        exeFile = path.Join(wd, exeFile)
     }
-    root, _ := path.Split(exeFile)
-    staticDir = path.Join(root, "static")
+    dir, _ := path.Split(path.Clean(exeFile))
+    return path.Clean(dir)
 }
 
-type route struct {
-    r       string
-    cr      *regexp.Regexp
-    method  string
-    handler *reflect.FuncValue
+//Returns the directory containing the executable of the web application
+func ExeDir() string {
+    lazyInit()
+    return exeDir
+}
+
+//makes a relative dir relative to the directory of the executable
+func exeRelative(dir string) string {
+    if strings.HasPrefix(dir, "/") {
+        return dir
+    }
+    return path.Join(ExeDir(), dir)
+}
+
+//Route is a handler registered for a method and a url pattern
+type Route struct {
+    r          string
+    cr         *regexp.Regexp
+    method     string
+    handler    *reflect.FuncValue
+    streamBody bool
+    timeout    int64 //the handler timeout in nanoseconds, or -1 to use the default
+    websocket  func(*Context, *WebSocketConn)
+}
+
+//Leaves the request body unread, so the handler can stream it from ctx.Request.Body.
+//Only the query string is parsed into Params, and RawBody isn't available
+func (route *Route) StreamBody() *Route {
+    route.streamBody = true
+    return route
+}
+
+//the headers sent with every response, unless the handler changes them. The map
+//is replaced instead of changed, so requests can use it without holding the lock
+var defaultHeaders = map[string]string{
+    "Content-Type": "text/html; charset=utf-8",
+    "Server":       "web.go",
+}
+var defaultHeadersLock sync.RWMutex
+
+//Changes the headers sent with every response, before the handler runs. An empty
+//value stops a header from being sent, like SetDefaultHeaders(map[string]string{"Server": ""})
+//to hide the server banner. The Date header is always sent
+func SetDefaultHeaders(headers map[string]string) {
+    defaultHeadersLock.Lock()
+    defer defaultHeadersLock.Unlock()
+    updated := make(map[string]string, len(defaultHeaders))
+    for hdr, val := range defaultHeaders {
+        updated[hdr] = val
+    }
+    for hdr, val := range headers {
+        hdr = http.CanonicalHeaderKey(hdr)
+        if len(val) == 0 {
+            updated[hdr] = "", false
+        } else {
+            updated[hdr] = val
+        }
+    }
+    defaultHeaders = updated
+}
+
+//returns the current default headers, which mustn't be changed
+func defaultHeaderList() map[string]string {
+    defaultHeadersLock.RLock()
+    defer defaultHeadersLock.RUnlock()
+    return defaultHeaders
 }
 
 var routes vector.Vector
 
-func addRoute(r string, method string, handler interface{}) {
+//routes and static mounts can be added while requests are being served
+var routesLock sync.RWMutex
+
+func addRoute(r string, method string, handler interface{}) *Route {
+    route, err := newRoute(r, method, handler)
+    if err != nil {
+        logErrorf("%s", err)
+        return nil
+    }
+    routesLock.Lock()
+    routes.Push(route)
+    routesLock.Unlock()
+    return route
+}
+
+func newRoute(r string, method string, handler interface{}) (*Route, os.Error) {
     cr, err := regexp.Compile(r)
     if err != nil {
-        log.Stderrf("Error in route regex %q\n", r)
-        return
+        return nil, os.NewError(fmt.Sprintf("Error in route regex %q", r))
     }
     fv := reflect.NewValue(handler).(*reflect.FuncValue)
-    routes.Push(route{r, cr, method, fv})
+    return &Route{r: r, cr: cr, method: method, handler: fv, timeout: -1}, nil
+}
+
+//returns a copy of the route table, which can be used without holding the lock
+func routeList() []*Route {
+    routesLock.RLock()
+    defer routesLock.RUnlock()
+    list := make([]*Route, routes.Len())
+    for i := 0; i < routes.Len(); i++ {
+        list[i] = routes.At(i).(*Route)
+    }
+    return list
+}
+
+//headConn discards the body written in response to a HEAD request
+type headConn struct {
+    conn
+}
+
+func (c headConn) Write(data []byte) (n int, err os.Error) { return len(data), nil }
+
+//adds a header value, replacing the existing ones if unique is set
+func setHeader(headers map[string][]string, hdr string, val string, unique bool) {
+    if _, contains := headers[hdr]; !contains || unique {
+        headers[hdr] = []string{val}
+        return
+    }
+
+    newHeaders := make([]string, len(headers[hdr])+1)
+    copy(newHeaders, headers[hdr])
+    newHeaders[len(newHeaders)-1] = val
+    headers[hdr] = newHeaders
+}
+
+//writes the headers, with a line for each value
+func writeHeaders(buf *bytes.Buffer, headers map[string][]string) {
+    for k, v := range headers {
+        for _, i := range v {
+            buf.WriteString(k + ": " + i + "\r\n")
+        }
+    }
+}
+
+//the status line of a response sent through scgi or fastcgi, in the version the
+//client used
+func statusLine(req *Request, status int) string {
+    version := "HTTP/1.1"
+    if req != nil && req.Proto == "HTTP/1.0" {
+        version = req.Proto
+    }
+    return fmt.Sprintf("%s %d %s\r\n", version, status, statusText[status])
+}
+
+//a response the front end can't tell the length of ends when the connection is
+//closed if the client can't take a chunked response, which it's told with
+//Connection: close. That's assumed when the request isn't known
+func closeUnframed(headers map[string][]string, status int, req *Request) {
+    if _, ok := headers["Content-Length"]; ok || !bodyAllowed(status) {
+        return
+    }
+    if req != nil && req.ProtoAtLeast(1, 1) {
+        return
+    }
+    headers["Connection"] = []string{"close"}
+}
+
+//returns false for the statuses that never have a body
+func bodyAllowed(status int) bool {
+    return status >= 200 && status != 204 && status != 304
 }
 
 type httpConn struct {
-    conn *http.Conn
+    conn         *http.Conn
+    headers      map[string][]string
+    wroteHeaders bool
 }
 
-func (c *httpConn) StartResponse(status int) { c.conn.WriteHeader(status) }
+func (c *httpConn) StartResponse(status int) {
+    c.wroteHeaders = true
+    for k, v := range c.headers {
+        //the http package keeps a single value per header (see issue 488),
+        //so repeated headers like Set-Cookie are written as separate lines
+        c.conn.SetHeader(k, strings.Join(v, "\r\n"+k+": "))
+    }
+    c.conn.WriteHeader(status)
+}
 
 func (c *httpConn) SetHeader(hdr string, val string, unique bool) {
-    //right now unique can't be implemented through the http package.
-    //see issue 488
-    c.conn.SetHeader(hdr, val)
+    if c.wroteHeaders {
+        logErrorf("Header %s set after the response was started", hdr)
+        return
+    }
+    setHeader(c.headers, hdr, val, unique)
+}
+
+func (c *httpConn) DelHeader(hdr string) {
+    if c.wroteHeaders {
+        logErrorf("Header %s removed after the response was started", hdr)
+        return
+    }
+    c.headers[hdr] = nil, false
 }
 
 func (c *httpConn) WriteString(content string) {
@@ -207,6 +764,8 @@ func (c *httpConn) Write(content []byte) (n int, err os.Error) {
     return c.conn.Write(content)
 }
 
+func (c *httpConn) Flush() { c.conn.Flush() }
+
 func (c *httpConn) Close() {
     rwc, buf, _ := c.conn.Hijack()
     if buf != nil {
@@ -219,56 +778,111 @@ func (c *httpConn) Close() {
 }
 
 func httpHandler(c *http.Conn, req *http.Request) {
-    conn := httpConn{c}
+    conn := httpConn{conn: c, headers: make(map[string][]string)}
     wreq := newRequest(req)
+    wreq.RemoteAddr = c.RemoteAddr
+    wreq.tls = c.UsingTLS()
     routeHandler(wreq, &conn)
 }
 
 func routeHandler(req *Request, c conn) {
-    requestPath := req.URL.Path
+    //the request counts as in flight, and keeps its slot, until it's done. A
+    //handler that times out keeps them until it returns, a WebSocket gives them
+    //up once upgraded
+    held := true
+    requestStarted()
+    defer func() {
+        if held {
+            requestFinished()
+        }
+    }()
 
-    //log the request
-    if len(req.URL.RawQuery) == 0 {
-        log.Stdout(req.Method + " " + requestPath)
-    } else {
-        log.Stdout(requestPath + "?" + req.URL.RawQuery)
+    start := time.Nanoseconds()
+
+    //the url of an scgi, fastcgi or cgi request couldn't be parsed
+    if req.URL == nil {
+        ctx := Context{Request: req, conn: &c}
+        ctx.Abort(400, "Bad Request")
+        return
     }
 
-    //parse the form data (if it exists)
-    perr := req.parseParams()
-    if perr != nil {
-        log.Stderrf("Failed to parse form data %q", perr.String())
+    //routes and static files are matched below the path the application is mounted at
+    prefix := requestPrefix(req)
+    req.URL.Path = stripURLPrefix(req.URL.Path, prefix)
+    requestPath := req.URL.Path
+    escapedPath := stripURLPrefix(req.escapedPath(), prefix)
+
+    //health probes skip the logs, the stats and the request limit
+    if isHealthProbe(req) {
+        if req.Method == "HEAD" {
+            c = headConn{c}
+        }
+        serveHealth(&Context{Request: req, conn: &c, prefix: prefix})
+        return
     }
 
     //parse the cookies
-    perr = req.parseCookies()
+    perr := req.parseCookies()
     if perr != nil {
-        log.Stderrf("Failed to parse cookies %q", perr.String())
+        logInfof("Failed to parse cookies %q", perr.String())
     }
 
-    ctx := Context{req, &c, false}
+    //record the status and size of the response for the access log and the stats
+    logged := &loggedConn{conn: c}
+    c = logged
 
-    //set some default headers
-    ctx.SetHeader("Content-Type", "text/html; charset=utf-8", true)
-    ctx.SetHeader("Server", "web.go", true)
+    //responses to HEAD requests keep their headers, but the body is discarded
+    if req.Method == "HEAD" {
+        c = headConn{c}
+    }
+
+    ctx := Context{Request: req, conn: &c, prefix: prefix}
+    defer logAccess(&ctx, logged, start)
+
+    //the route handling the request, for the stats
+    var handledBy *Route
+    defer func() { recordStats(handledBy, logged, start) }()
 
-    tm := time.LocalTime()
-    ctx.SetHeader("Date", webTime(tm), true)
+    //set the default headers, which the handlers can override
+    for hdr, val := range defaultHeaderList() {
+        ctx.SetHeader(hdr, val, true)
+    }
+    ctx.SetHeader("Date", webTime(time.UTC()), true)
+    if len(hstsHeader) > 0 && req.isHTTPS() {
+        ctx.SetHeader("Strict-Transport-Security", hstsHeader, true)
+    }
+    if isDevMode() {
+        ctx.SetHeader("Cache-Control", "no-store", true)
+    }
 
     //try to serve a static file
-    staticFile := path.Join(staticDir, requestPath)
-    if fileExists(staticFile) && (req.Method == "GET" || req.Method == "HEAD") {
-        serveFile(&ctx, staticFile)
+    staticFile, asset, ok := findStaticFile(requestPath)
+    if ok && (req.Method == "GET" || req.Method == "HEAD") {
+        err := serveStaticFile(&ctx, staticFile, asset)
+        if err == nil || handleStaticError(&ctx, staticFile, err) {
+            return
+        }
+    }
+
+    //wait for a turn if too many requests are being handled
+    slot, ok := acquireRequestSlot()
+    if !ok {
+        countRejected()
+        ctx.SetHeader("Retry-After", "1", true)
+        ctx.Abort(503, "Service Unavailable")
         return
     }
+    defer func() {
+        if held {
+            slot.release()
+        }
+    }()
 
-    for i := 0; i < routes.Len(); i++ {
-        route := routes.At(i).(route)
+    //the methods of the routes matching the path, for a 405
+    var allowed vector.StringVector
+
+    for _, route := range routeList() {
         cr := route.cr
-        //if the methods don't match, skip this handler (except HEAD can be used in place of GET)
-        if req.Method != route.method && !(req.Method == "HEAD" && route.method == "GET") {
-            continue
-        }
 
         if !cr.MatchString(requestPath) {
             continue
@@ -279,6 +893,34 @@ func routeHandler(req *Request, c conn) {
             continue
         }
 
+        //if the methods don't match, skip this handler (except HEAD can be used in place of GET)
+        if req.Method != route.method && !(req.Method == "HEAD" && route.method == "GET") {
+            allowed.Push(route.method)
+            continue
+        }
+        handledBy = route
+
+        //parse the form data (if it exists)
+        if route.streamBody {
+            perr = req.parseQuery()
+            req.ParseError = perr
+        } else {
+            perr = req.parseParams()
+        }
+        if perr != nil {
+            logInfof("Failed to parse form data %q", perr.String())
+        }
+
+        //websocket handlers take over the connection
+        if route.websocket != nil {
+            serveWebSocket(&ctx, route.websocket, func() {
+                held = false
+                slot.release()
+                requestFinished()
+            })
+            return
+        }
+
         var args vector.Vector
 
         handlerType := route.handler.Type().(*reflect.FuncType)
@@ -293,12 +935,12 @@ func routeHandler(req *Request, c conn) {
             }
         }
 
-        for _, arg := range match[1:] {
+        for _, arg := range pathParams(cr, match, escapedPath) {
             args.Push(reflect.NewValue(arg))
         }
 
         if args.Len() != handlerType.NumIn() {
-            log.Stderrf("Incorrect number of arguments for %s\n", requestPath)
+            logErrorf("Incorrect number of arguments for %s", requestPath)
             ctx.Abort(500, "Server Error")
             return
         }
@@ -308,68 +950,258 @@ func routeHandler(req *Request, c conn) {
             valArgs[i] = args.At(i).(reflect.Value)
         }
 
-        ret := route.handler.Call(valArgs)
-
-        if len(ret) == 0 {
-            return
+        handlerStart := time.Nanoseconds()
+        var ret []reflect.Value
+        if timeout := route.handlerTimeout(); timeout > 0 {
+            //the handler may still be using ctx after it timed out, so the
+            //timeout response bypasses it
+            tc := &timeoutConn{conn: c}
+            c = tc
+            var ok bool
+            call := func() []reflect.Value { return callHandler(&ctx, route, valArgs) }
+            abandoned := func() {
+                slot.release()
+                requestFinished()
+            }
+            if ret, ok = callWithTimeout(call, timeout, abandoned); !ok {
+                held = false
+                tc.timeout()
+                logErrorf("Handler for %s %s timed out after %s", route.method, route.r, formatMillis(time.Nanoseconds()-handlerStart))
+                countTimeout()
+                return
+            }
+        } else {
+            ret = callHandler(&ctx, route, valArgs)
         }
+        handlerTime := time.Nanoseconds() - handlerStart
+        if err := handlerError(ret); err != nil {
+            handlerFailed(&ctx, route.method+" "+route.r, err.String(), "")
+        }
+        setTimingHeader(&ctx, handlerTime)
 
-        sval, ok := ret[0].(*reflect.StringValue)
+        if len(ret) > 0 {
+            sval, ok := ret[0].(*reflect.StringValue)
 
-        if ok && !ctx.responseStarted {
-            content := []byte(sval.Get())
-            ctx.SetHeader("Content-Length", strconv.Itoa(len(content)), true)
-            ctx.StartResponse(200)
-            ctx.Write(content)
+            if ok && !ctx.responseStarted {
+                content := []byte(sval.Get())
+                ctx.SetHeader("Content-Length", strconv.Itoa(len(content)), true)
+                ctx.StartResponse(200)
+                ctx.Write(content)
+            }
         }
 
+        ctx.finishBuffer()
+        checkSlowRequest(req, handlerTime, time.Nanoseconds()-handlerStart)
         return
     }
 
-    //try to serve index.html
-    if indexPath := path.Join(staticDir, "index.html"); requestPath == "/" && fileExists(indexPath) {
-        serveFile(&ctx, indexPath)
+    //static files only answer GET and HEAD. This is checked after the routes,
+    //so a route for another method can still handle a static file's path
+    if _, _, ok := findStaticFile(requestPath); ok {
+        ctx.SetHeader("Allow", "GET, HEAD", true)
+        ctx.Abort(405, "Method Not Allowed")
+        return
+    }
+
+    //try to serve the index file of a static directory
+    if indexPath, asset, ok := findIndexFile(requestPath); ok {
+        if req.Method != "GET" && req.Method != "HEAD" {
+            ctx.SetHeader("Allow", "GET, HEAD", true)
+            ctx.Abort(405, "Method Not Allowed")
+            return
+        }
+        if indexRedirect && !strings.HasSuffix(requestPath, "/") {
+            url := requestPath + "/"
+            if len(req.URL.RawQuery) > 0 {
+                url += "?" + req.URL.RawQuery
+            }
+            ctx.Redirect(301, url)
+            return
+        }
+        err := serveStaticFile(&ctx, indexPath, asset)
+        if err == nil || handleStaticError(&ctx, indexPath, err) {
+            return
+        }
+    }
+
+    //the path matches a route, but not for this method
+    if allowed.Len() > 0 {
+        ctx.SetHeader("Allow", allowHeader(&allowed), true)
+        ctx.Abort(405, "Method Not Allowed")
         return
     }
 
+    if staticFallback != nil {
+        if perr = req.parseParams(); perr != nil {
+            logInfof("Failed to parse form data %q", perr.String())
+        }
+        if callStaticFallback(&ctx, requestPath) {
+            ctx.finishBuffer()
+            return
+        }
+    }
+
     ctx.Abort(404, "Page not found")
 }
 
-//runs the web application and serves http requests
+//lists the methods in an Allow header, adding HEAD where GET is allowed
+func allowHeader(methods *vector.StringVector) string {
+    seen := make(map[string]bool)
+    var list vector.StringVector
+    for i := 0; i < methods.Len(); i++ {
+        method := methods.At(i)
+        if !seen[method] {
+            seen[method] = true
+            list.Push(method)
+        }
+        if method == "GET" && !seen["HEAD"] {
+            seen["HEAD"] = true
+            list.Push("HEAD")
+        }
+    }
+    return strings.Join(list.Copy(), ", ")
+}
+
+//runs the web application and serves http requests, until Close is called. addr
+//can also be a unix socket, like "unix:/var/run/app.sock"
 func Run(addr string) {
-    http.Handle("/", http.HandlerFunc(httpHandler))
+    l, err := listen(addr)
+    if err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
 
-    log.Stdoutf("web.go serving %s", addr)
-    err := http.ListenAndServe(addr, nil)
+    logInfof("web.go serving %s", addr)
+    if err = serve("http", l); err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
+}
+
+//runs the web application and serves http requests on the unix socket
+//socketPath, with its permissions set to mode
+func RunUnix(socketPath string, mode uint32) {
+    l, err := listenUnix(socketPath, mode)
     if err != nil {
-        log.Exit("ListenAndServe:", err)
+        logFatalf("ListenAndServe: %s", err)
+    }
+
+    logInfof("web.go serving unix:%s", socketPath)
+    if err = serve("http", l); err != nil {
+        logFatalf("ListenAndServe: %s", err)
     }
 }
 
-//runs the web application and serves scgi requests
+//runs the web application and serves https requests, with the certificate and
+//private key in the PEM files certFile and keyFile
+func RunTLS(addr string, certFile string, keyFile string) {
+    l, err := listen(addr)
+    if err == nil {
+        l, err = tlsListener(l, certFile, keyFile)
+    }
+    if err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
+
+    logInfof("web.go serving https %s", addr)
+    if err = serve("http", l); err != nil {
+        logFatalf("ListenAndServe: %s", err)
+    }
+}
+
+//runs the web application and serves scgi requests. addr can also be a unix
+//socket, like "unix:/var/run/app.sock"
 func RunScgi(addr string) {
-    log.Stdoutf("web.go serving scgi %s", addr)
+    logInfof("web.go serving scgi %s", addr)
     listenAndServeScgi(addr)
 }
 
-//runs the web application by serving fastcgi requests
+//runs the web application and serves scgi requests on the unix socket socketPath,
+//with its permissions set to mode
+func RunScgiUnix(socketPath string, mode uint32) {
+    logInfof("web.go serving scgi unix:%s", socketPath)
+    l, err := listenUnix(socketPath, mode)
+    if err != nil {
+        logErrorf("SCGI listen error: %s", err)
+        return
+    }
+    serveScgi(l)
+}
+
+//runs the web application by serving fastcgi requests. addr can also be a unix
+//socket, like "unix:/var/run/app.sock"
 func RunFcgi(addr string) {
-    log.Stdoutf("web.go serving fcgi %s", addr)
+    logInfof("web.go serving fcgi %s", addr)
     listenAndServeFcgi(addr)
 }
 
+//runs the web application by serving fastcgi requests on the unix socket
+//socketPath, with its permissions set to mode
+func RunFcgiUnix(socketPath string, mode uint32) {
+    logInfof("web.go serving fcgi unix:%s", socketPath)
+    l, err := listenUnix(socketPath, mode)
+    if err != nil {
+        logErrorf("FCGI listen error: %s", err)
+        return
+    }
+    serveFcgi(l)
+}
+
+//set to pass the groups captured by routes to the handlers without decoding them
+var rawPathParams = false
+
+//Sets whether the groups captured from the path by a route are passed to the
+//handler as they were sent, like "caf%C3%A9", instead of decoded. A + in the
+//path is kept as it is either way. The groups of routes that only match the
+//decoded path are always decoded
+func RawPathParams(raw bool) { rawPathParams = raw }
+
+//returns the groups a route captured from the path. Routes match the decoded
+//path, but the groups are taken from the path as it was sent and decoded once
+//here, so an escaped / or + keeps its meaning. When the route only matches the
+//decoded path, like one with a literal é, its groups are used as they are. A path
+//with an invalid escape like %zz never gets here: its url can't be parsed, so
+//routeHandler answers it with a 400 while req.URL is nil
+func pathParams(cr *regexp.Regexp, match []string, escapedPath string) []string {
+    raw := cr.MatchStrings(escapedPath)
+    if len(raw) != len(match) || len(raw[0]) != len(escapedPath) {
+        return match[1:]
+    }
+    if rawPathParams {
+        return raw[1:]
+    }
+    params := make([]string, len(raw)-1)
+    for i, arg := range raw[1:] {
+        decoded, err := unescapePath(arg)
+        if err != nil {
+            return match[1:]
+        }
+        params[i] = decoded
+    }
+    return params
+}
+
 //Adds a handler for the 'GET' http method.
-func Get(route string, handler interface{}) { addRoute(route, "GET", handler) }
+func Get(route string, handler interface{}) *Route {
+    return addRoute(route, "GET", handler)
+}
 
 //Adds a handler for the 'POST' http method.
-func Post(route string, handler interface{}) { addRoute(route, "POST", handler) }
+func Post(route string, handler interface{}) *Route {
+    return addRoute(route, "POST", handler)
+}
 
 //Adds a handler for the 'PUT' http method.
-func Put(route string, handler interface{}) { addRoute(route, "PUT", handler) }
+func Put(route string, handler interface{}) *Route {
+    return addRoute(route, "PUT", handler)
+}
+
+//Adds a handler for the 'PATCH' http method.
+func Patch(route string, handler interface{}) *Route {
+    return addRoute(route, "PATCH", handler)
+}
 
 //Adds a handler for the 'DELETE' http method.
-func Delete(route string, handler interface{}) {
-    addRoute(route, "DELETE", handler)
+func Delete(route string, handler interface{}) *Route {
+    return addRoute(route, "DELETE", handler)
 }
 
 func webTime(t *time.Time) string {
@@ -404,8 +1236,11 @@ func fileExists(dir string) bool {
 }
 
 //changes the location of the static directory. by default, it's under the 'static' folder
-//of the directory containing the web application
+//of the directory containing the web application. It's served at "/", after the
+//directories added with Static. A relative dir is relative to the directory of the
+//executable. The webserver.staticDir setting overrides it, see ConfigString
 func SetStaticDir(dir string) os.Error {
+    dir = exeRelative(dir)
     if !dirExists(dir) {
         msg := fmt.Sprintf("Failed to set static directory %q - does not exist", dir)
         return os.NewError(msg)
@@ -415,6 +1250,14 @@ func SetStaticDir(dir string) os.Error {
     return nil
 }
 
+//Like SetStaticDir, but creates the directory if it doesn't exist
+func CreateStaticDir(dir string) os.Error {
+    if err := os.MkdirAll(exeRelative(dir), 0755); err != nil {
+        return err
+    }
+    return SetStaticDir(dir)
+}
+
 func Urlencode(data map[string]string) string {
     var buf bytes.Buffer
     for k, v := range data {
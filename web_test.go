@@ -1,14 +1,22 @@
 package web
 
 import (
+    "bufio"
     "bytes"
+    "container/vector"
     "encoding/binary"
     "fmt"
     "http"
+    "io"
+    "io/ioutil"
+    "net"
     "os"
+    "path"
     "strconv"
     "strings"
+    "syscall"
     "testing"
+    "time"
 )
 
 //this implements io.ReadWriteCloser, which means it can be passed around as a tcp connection
@@ -27,6 +35,24 @@ func (buf *tcpBuffer) Read(p []byte) (n int, err os.Error) {
 
 func (buf *tcpBuffer) Close() os.Error { return nil }
 
+//a connection that fails every write after the first few, like a client that went away
+type brokenConn struct {
+    writes    int
+    maxWrites int
+}
+
+func (c *brokenConn) Write(p []byte) (n int, err os.Error) {
+    c.writes++
+    if c.writes > c.maxWrites {
+        return 0, os.EPIPE
+    }
+    return len(p), nil
+}
+
+func (c *brokenConn) Read(p []byte) (n int, err os.Error) { return 0, os.EOF }
+
+func (c *brokenConn) Close() os.Error { return nil }
+
 type testResponse struct {
     statusCode int
     status     string
@@ -81,6 +107,10 @@ func buildTestResponse(buf *bytes.Buffer) *testResponse {
 
 func getTestResponse(method string, path string, body string, headers map[string]string) *testResponse {
     req := buildTestRequest(method, path, body, headers)
+    return getTestResponseFromRequest(req)
+}
+
+func getTestResponseFromRequest(req *Request) *testResponse {
     var buf bytes.Buffer
 
     tcpb := tcpBuffer{nil, &buf}
@@ -137,6 +167,263 @@ func init() {
         return val
     })
     Get("/getparam", func(ctx *Context) string { return ctx.GetParam("a") })
+
+    Get("/cookie/full", func(ctx *Context) string {
+        ctx.SetCookieFull(Cookie{Name: "a", Value: "1", Age: 60, Path: "/admin", Domain: "example.com", Secure: true, HttpOnly: true})
+        return ""
+    })
+
+    Get("/cookie/delete/(.+)", func(ctx *Context, name string) string {
+        ctx.DeleteCookieFull(Cookie{Name: name, Path: "/admin"})
+        return ""
+    })
+
+    Get("/redirect/permanent", func(ctx *Context) { ctx.RedirectPermanent("/echo/a") })
+    Get("/redirect/temporary", func(ctx *Context) { ctx.RedirectTemporary("/echo/a") })
+    Post("/redirect/seeother", func(ctx *Context) { ctx.RedirectSeeOther("/echo/a?b=1&c=2") })
+
+    Get("/clientip", func(ctx *Context) string { return ctx.ClientIP() })
+    Get("/baseurl", func(ctx *Context) string { return ctx.BaseURL() })
+
+    Get("/paramlist/(.+)", func(ctx *Context, name string) string {
+        return strings.Join(ctx.ParamList(name), ",")
+    })
+
+    Post("/paramlist/(.+)", func(ctx *Context, name string) string {
+        return ctx.Param(name) + ":" + strings.Join(ctx.ParamList(name), ",")
+    })
+
+    Post("/json", func(ctx *Context) string {
+        var data struct {
+            Name string
+            Tags []string
+        }
+        if err := ctx.ReadJSON(&data); err != nil {
+            ctx.Abort(400, err.String())
+            return ""
+        }
+        //reading the body twice gives the same result
+        ctx.ReadJSON(&data)
+        return data.Name + ":" + strings.Join(data.Tags, ",")
+    })
+
+    Post("/rawbody", func(ctx *Context) string {
+        body, err := ctx.RawBody()
+        if err != nil {
+            ctx.Abort(413, err.String())
+            return ""
+        }
+        return ctx.Param("a") + ":" + string(body)
+    })
+
+    Post("/streambody", func(ctx *Context) string {
+        body, _ := ioutil.ReadAll(ctx.Request.Body)
+        return ctx.Param("a") + ":" + string(body)
+    }).StreamBody()
+
+    Get("/servefile/(.*)", func(ctx *Context, name string) {
+        if err := ctx.ServeFile(name); err != nil {
+            ctx.NotFound("missing " + name)
+        }
+    })
+
+    Get("/download/(.*)", func(ctx *Context, name string) {
+        if err := ctx.ServeFileAs(name, "download.txt"); err != nil {
+            ctx.NotFound("missing " + name)
+        }
+    })
+
+    Get("/buffer/status", func(ctx *Context) {
+        ctx.Buffer()
+        ctx.WriteString("hello")
+        ctx.SetHeader("X-Buffered", "1", true)
+        ctx.StartResponse(201)
+    })
+
+    Get("/buffer/abort", func(ctx *Context) {
+        ctx.Buffer()
+        ctx.WriteString("partial output")
+        ctx.Abort(500, "error")
+    })
+
+    Get("/buffer/flush", func(ctx *Context) {
+        ctx.Buffer()
+        ctx.WriteString("hello")
+        ctx.FlushBuffer()
+        ctx.WriteString(" world")
+    })
+
+    Get("/negotiate", func(ctx *Context) string {
+        return fmt.Sprintf("%v %v %s", ctx.IsAjax(), ctx.Accepts("application/json"), ctx.Negotiate("text/html", "application/json"))
+    })
+
+    auth := BasicAuthFilter("admin area", func(user, pass string) bool { return user == "admin" && pass == "open:sesame" })
+    Get("/basicauth", func(ctx *Context) string {
+        if !auth(ctx) {
+            return ""
+        }
+        user, _, _ := ctx.BasicAuth()
+        return "hello " + user
+    })
+
+    Get("/setheader", func(ctx *Context) {
+        ctx.SetHeader("X-Unique", "a", true)
+        ctx.SetHeader("X-Unique", "b", true)
+        ctx.SetHeader("X-Multi", "a", false)
+        ctx.SetHeader("X-Multi", "b", false)
+        ctx.SetCookie("a", "1", 60)
+        ctx.SetCookie("b", "2", 60)
+        ctx.SetHeader("Content-Type", "text/plain", true)
+        ctx.StartResponse(200)
+        ctx.SetHeader("X-Late", "a", true)
+        ctx.WriteString("ok")
+    })
+
+    Get("/render/(.*)", func(ctx *Context, name string) {
+        if err := ctx.Render(name, map[string]string{"Name": "world"}); err != nil {
+            ctx.Abort(500, "template error")
+        }
+    })
+
+    Get("/renderlayout/(.*)", func(ctx *Context, name string) {
+        if err := ctx.RenderInLayout("layout.html", name, map[string]string{"Name": "world"}); err != nil {
+            ctx.Abort(500, "template error")
+        }
+    })
+
+    Get("/events", func(ctx *Context) {
+        es := ctx.EventStream()
+        es.Send("greeting", "hello")
+        es.Send("", "multi\nline")
+    })
+
+    Get("/nocontent", func(ctx *Context) string {
+        ctx.NoContent()
+        ctx.WriteString("oops")
+        return "ignored"
+    })
+
+    Get("/notmodified", func(ctx *Context) {
+        ctx.NotModified()
+        ctx.WriteString("oops")
+    })
+
+    Get("/buffer/nocontent", func(ctx *Context) {
+        ctx.Buffer()
+        ctx.WriteString("partial output")
+        ctx.NoContent()
+        ctx.WriteString("oops")
+    })
+
+    Get("/forbidden", func(ctx *Context) { ctx.Forbidden("go away") })
+    Get("/badrequest", func(ctx *Context) { ctx.BadRequest("bad") })
+
+    Get("/json", func(ctx *Context) {
+        ctx.WriteJSON(map[string]string{"a": "b"})
+    })
+
+    Get("/header/(.*)", func(ctx *Context, name string) string { return ctx.GetHeader(name) })
+
+    Get("/large/(.*)", func(size string) string {
+        n, _ := strconv.Atoi(size)
+        return strings.Repeat("a", n)
+    })
+
+    Post("/hello.txt", func() string { return "posted" })
+
+    Get("/slow", func() string {
+        time.Sleep(100e6)
+        return "done"
+    })
+
+    Get("/slow", func() string {
+        time.Sleep(20e6)
+        return "slow"
+    })
+
+    Get("/timeout", func(ctx *Context) {
+        time.Sleep(50e6)
+        ctx.WriteString("too late")
+    }).Timeout(10)
+
+    Websocket("/ws/echo", func(ctx *Context, ws *WebSocketConn) {
+        for {
+            messageType, data, err := ws.ReadMessage()
+            if err != nil {
+                return
+            }
+            ws.WriteMessage(messageType, data)
+        }
+    })
+
+    Get("/hijack", func(ctx *Context) {
+        rwc, err := ctx.Hijack()
+        if err != nil {
+            ctx.WriteString(err.String())
+            return
+        }
+        defer rwc.Close()
+        line, _ := bufio.NewReader(rwc).ReadString('\n')
+        rwc.Write([]byte("hijacked " + line))
+    })
+    Get("/panic", func(ctx *Context) {
+        ctx.Buffer()
+        ctx.WriteString("partial")
+        panic("oops")
+    })
+    Get("/handlererror", func() (string, os.Error) { return "", os.NewError("no such thing") })
+    Get("/unframed", func(ctx *Context) {
+        ctx.WriteString("no length")
+    })
+    Post("/jsonparams", func(ctx *Context) string {
+        if ctx.Request.ParseError != nil {
+            ctx.BadRequest(ctx.Request.ParseError.String())
+            return ""
+        }
+        p := ctx.Request.Params
+        nested, _ := ctx.Request.JSON["nested"].(map[string]interface{})
+        return fmt.Sprintf("%v %v %v %v %v", p["name"], p["count"], p["ratio"], p["ok"], nested["a"])
+    })
+    bodyParams := func(ctx *Context) string { return ctx.Request.Method + " " + ctx.Param("q") + " " + ctx.Param("a") }
+    Put("/bodyparams", bodyParams)
+    Patch("/bodyparams", bodyParams)
+    Delete("/bodyparams", bodyParams)
+    Post("/nestedparams", func(ctx *Context) string {
+        var user testUser
+        if err := ctx.BindParams("user", &user); err != nil {
+            return err.String()
+        }
+        return fmt.Sprintf("%s %v %d %v %s", user.Name, user.Emails, user.Age, user.Admin, user.Address.City)
+    })
+    Get("/café/(.*)", func(s string) string { return "literal " + s })
+    Websocket("/ws/panic", func(ctx *Context, ws *WebSocketConn) { panic("oops") })
+    Get("/typedparams", func(ctx *Context) string {
+        return fmt.Sprintf("%d %d %v %v %s", ctx.ParamInt("i", -1), ctx.ParamInt64("l", -1), ctx.ParamFloat("f", -1), ctx.ParamBool("b", false), ctx.ParamString("s", "def"))
+    })
+
+    Get("/etag", func(ctx *Context) string {
+        if ctx.CheckETag("abc") {
+            return ""
+        }
+        return "body"
+    })
+
+    Get("/lastmodified", func(ctx *Context) string {
+        if ctx.CheckLastModified(time.SecondsToUTC(1e9)) {
+            return ""
+        }
+        return "body"
+    })
+
+    Post("/flash/set/(.+)/(.+)", func(ctx *Context, key string, msg string) {
+        ctx.SetFlash(key, msg)
+        ctx.RedirectSeeOther("/flash/get/" + key)
+    })
+
+    Get("/flash/get/(.+)", func(ctx *Context, key string) string {
+        msg, _ := ctx.GetFlash(key)
+        return msg
+    })
 }
 
 var tests = []Test{
@@ -159,6 +446,26 @@ var tests = []Test{
     Test{"POST", "/posterror/code/410/failedrequest", "", 410, "failedrequest"},
     Test{"GET", "/getparam?a=abcd", "", 200, "abcd"},
     Test{"GET", "/getparam?b=abcd", "", 200, ""},
+    Test{"GET", "/paramlist/tag?tag=go&tag=web&tag=http", "", 200, "go,web,http"},
+    Test{"GET", "/paramlist/tag?tag=go&other=1&tag=web", "", 200, "go,web"},
+    Test{"GET", "/paramlist/tag", "", 200, ""},
+    Test{"POST", "/paramlist/tag", "tag=go&tag=web", 200, "go:go,web"},
+    Test{"POST", "/paramlist/tag?tag=query", "tag=go&tag=web", 200, "query:query,go,web"},
+    Test{"POST", "/rawbody", "a=1&b=2", 200, "1:a=1&b=2"},
+    Test{"POST", "/streambody?a=q", "a=1&b=2", 200, "q:a=1&b=2"},
+    Test{"GET", "/buffer/status", "", 201, "hello"},
+    Test{"GET", "/buffer/abort", "", 500, "error"},
+    Test{"GET", "/buffer/flush", "", 200, "hello world"},
+    Test{"GET", "/nocontent", "", 204, ""},
+    Test{"GET", "/notmodified", "", 304, ""},
+    Test{"GET", "/buffer/nocontent", "", 204, ""},
+    Test{"GET", "/forbidden", "", 403, "go away"},
+    Test{"GET", "/badrequest", "", 400, "bad"},
+    Test{"GET", "/typedparams", "", 200, "-1 -1 -1 false def"},
+    Test{"GET", "/typedparams?i=12&l=12345678901&f=1.5&b=on&s=abc", "", 200, "12 12345678901 1.5 true abc"},
+    Test{"GET", "/typedparams?i=a&l=1.5&f=b&b=maybe&s=", "", 200, "-1 -1 -1 false "},
+    Test{"GET", "/typedparams?b=1", "", 200, "-1 -1 -1 true def"},
+    Test{"GET", "/typedparams?b=TRUE", "", 200, "-1 -1 -1 true def"},
 }
 
 func buildTestRequest(method string, path string, body string, headers map[string]string) *Request {
@@ -180,13 +487,14 @@ func buildTestRequest(method string, path string, body string, headers map[strin
     }
 
     req := Request{Method: method,
-        RawURL:    rawurl,
-        URL:       url,
-        Proto:     proto,
-        Host:      host,
-        UserAgent: useragent,
-        Headers:   headers,
-        Body:      bytes.NewBufferString(body),
+        RawURL:     rawurl,
+        URL:        url,
+        Proto:      proto,
+        Host:       host,
+        RemoteAddr: "127.0.0.1:4000",
+        UserAgent:  useragent,
+        Headers:    headers,
+        Body:       bytes.NewBufferString(body),
     }
 
     return &req
@@ -421,8 +729,8 @@ func buildTestFcgiRequest(method string, path string, bodychunks []string, heade
         fcgiHeaders[k] = v
     }
 
-    // add the begin request
-    req.Write(newFcgiRecord(fcgiBeginRequest, 0, make([]byte, 8)))
+    // add the begin request, for the responder role
+    req.Write(newFcgiRecord(fcgiBeginRequest, 0, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}))
 
     var buf bytes.Buffer
     for k, v := range fcgiHeaders {
@@ -603,3 +911,3108 @@ func TestSecureCookieFcgi(t *testing.T) {
         t.Fatalf("SecureCookie test failed")
     }
 }
+
+func TestCookieAttributes(t *testing.T) {
+    resp := getTestResponse("GET", "/cookie/full", "", nil)
+    if resp.cookies["a"] != "1" {
+        t.Fatalf("expected cookie value %q got %q", "1", resp.cookies["a"])
+    }
+    cookie := resp.headers["Set-Cookie"][0]
+    for _, attr := range []string{"; Path=/admin", "; Domain=example.com", "; Secure", "; HttpOnly"} {
+        if strings.Index(cookie, attr) == -1 {
+            t.Fatalf("cookie %q is missing %q", cookie, attr)
+        }
+    }
+}
+
+func TestDeleteCookie(t *testing.T) {
+    resp := getTestResponse("GET", "/cookie/delete/a", "", nil)
+    if val, ok := resp.cookies["a"]; !ok || val != "" {
+        t.Fatalf("expected an empty cookie value got %q", val)
+    }
+    cookie := resp.headers["Set-Cookie"][0]
+    for _, attr := range []string{"; expires=Thu, 01 Jan 1970 00:00:00 GMT", "; Max-Age=0", "; Path=/admin"} {
+        if strings.Index(cookie, attr) == -1 {
+            t.Fatalf("cookie %q is missing %q", cookie, attr)
+        }
+    }
+}
+
+func TestSecureCookieMalformed(t *testing.T) {
+    SetCookieSecret(testSecret)
+    now := strconv.Itoa64(time.Seconds())
+    values := []string{
+        "",
+        "MQ==",
+        "MQ==|" + now,
+        "MQ==|abc|" + getCookieSig(cookieFormatSHA1, testSecret, []byte("MQ=="), "abc"),
+        "!!!!|" + now + "|" + getCookieSig(cookieFormatSHA1, testSecret, []byte("!!!!"), now),
+        "2|MQ==|abc|" + getCookieSig(cookieFormatSHA256, testSecret, []byte("MQ=="), "abc"),
+        "3|MQ==|" + now + "|" + getCookieSig(cookieFormatSHA256, testSecret, []byte("MQ=="), now),
+    }
+    for _, val := range values {
+        cookie := fmt.Sprintf("a=%s", val)
+        resp := getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": cookie})
+        if resp.statusCode != 200 || resp.body != "" {
+            t.Fatalf("malformed secure cookie %q was accepted", val)
+        }
+    }
+}
+
+const testSecret = "7C19QRmwf3mHZ9CPAaPQ0hsWeufKd"
+
+type cookieTest struct {
+    cookie string
+    body   string
+}
+
+func TestSecureCookieSignature(t *testing.T) {
+    SetCookieSecret(testSecret)
+    resp := getTestResponse("POST", "/securecookie/set/a/1", "", nil)
+    parts := strings.Split(resp.cookies["a"], "|", -1)
+    if len(parts) != 4 {
+        t.Fatalf("unexpected secure cookie format %q", resp.cookies["a"])
+    }
+    val, timestamp, sig := parts[1], parts[2], parts[3]
+    ts, _ := strconv.Atoi64(timestamp)
+    expired := strconv.Itoa64(ts - 32*86400)
+    expiredSig := getCookieSig(cookieFormatSHA256, testSecret, []byte(val), expired)
+
+    tests := []cookieTest{
+        cookieTest{strings.Join([]string{"2", val, timestamp, sig}, "|"), "1"},
+        //tampered value
+        cookieTest{strings.Join([]string{"2", "Mg==", timestamp, sig}, "|"), ""},
+        //tampered timestamp
+        cookieTest{strings.Join([]string{"2", val, strconv.Itoa64(ts + 1), sig}, "|"), ""},
+        //expired, but correctly signed
+        cookieTest{strings.Join([]string{"2", val, expired, expiredSig}, "|"), ""},
+    }
+
+    for _, test := range tests {
+        cookie := fmt.Sprintf("a=%s", test.cookie)
+        resp := getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": cookie})
+        if resp.body != test.body {
+            t.Fatalf("secure cookie %q: expected %q got %q", test.cookie, test.body, resp.body)
+        }
+    }
+
+    //expired cookies are accepted when the expiry check is disabled
+    SetSecureCookieMaxAge(0)
+    defer SetSecureCookieMaxAge(31 * 86400)
+    cookie := fmt.Sprintf("a=%s", strings.Join([]string{"2", val, expired, expiredSig}, "|"))
+    resp = getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": cookie})
+    if resp.body != "1" {
+        t.Fatalf("expected expired cookie to be accepted got %q", resp.body)
+    }
+}
+
+func TestSecureCookieFormats(t *testing.T) {
+    SetCookieSecret(testSecret)
+    defer SetCookieSecret(testSecret)
+    now := strconv.Itoa64(time.Seconds())
+
+    //cookies signed with SHA1 before the format had a version marker
+    sha1Cookie := strings.Join([]string{"MQ==", now, getCookieSig(cookieFormatSHA1, testSecret, []byte("MQ=="), now)}, "|")
+    resp := getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": "a=" + sha1Cookie})
+    if resp.body != "1" {
+        t.Fatalf("SHA1 secure cookie was rejected")
+    }
+
+    //new cookies are signed with SHA256
+    resp = getTestResponse("POST", "/securecookie/set/a/1", "", nil)
+    sha256Cookie := resp.cookies["a"]
+    if !strings.HasPrefix(sha256Cookie, "2|") {
+        t.Fatalf("expected a SHA256 secure cookie got %q", sha256Cookie)
+    }
+    resp = getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": "a=" + sha256Cookie})
+    if resp.body != "1" {
+        t.Fatalf("SHA256 secure cookie was rejected")
+    }
+
+    //both keep verifying after rotating to a new key
+    SetCookieSecret("dkIGkpvoRmbZrkQ54MWHJrw2U", testSecret)
+    for _, cookie := range []string{sha1Cookie, sha256Cookie} {
+        resp = getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": "a=" + cookie})
+        if resp.body != "1" {
+            t.Fatalf("secure cookie %q was rejected after key rotation", cookie)
+        }
+    }
+
+    //and are rejected once the old key is dropped
+    SetCookieSecret("dkIGkpvoRmbZrkQ54MWHJrw2U")
+    for _, cookie := range []string{sha1Cookie, sha256Cookie} {
+        resp = getTestResponse("GET", "/securecookie/get/a", "", map[string]string{"Cookie": "a=" + cookie})
+        if resp.body != "" {
+            t.Fatalf("secure cookie %q was accepted with an unknown key", cookie)
+        }
+    }
+}
+
+func TestRedirect(t *testing.T) {
+    tests := []Test{
+        Test{"GET", "/redirect/permanent", "", 301, `Redirecting to: <a href="/echo/a">/echo/a</a>`},
+        Test{"GET", "/redirect/temporary", "", 302, `Redirecting to: <a href="/echo/a">/echo/a</a>`},
+        Test{"POST", "/redirect/seeother", "", 303, `Redirecting to: <a href="/echo/a?b=1&amp;c=2">/echo/a?b=1&amp;c=2</a>`},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus {
+            t.Fatalf("expected status %d got %d", test.expectedStatus, resp.statusCode)
+        }
+        if resp.body != test.expectedBody {
+            t.Fatalf("expected %q got %q", test.expectedBody, resp.body)
+        }
+        if loc := resp.headers["Location"]; len(loc) != 1 || !strings.HasPrefix(loc[0], "/echo/a") {
+            t.Fatalf("unexpected Location header %v", loc)
+        }
+        if ct := resp.headers["Content-Type"]; len(ct) != 1 || ct[0] != "text/html; charset=utf-8" {
+            t.Fatalf("unexpected Content-Type header %v", ct)
+        }
+    }
+}
+
+func TestFlash(t *testing.T) {
+    SetCookieSecret(testSecret)
+
+    //set, redirect, get
+    resp := getTestResponse("POST", "/flash/set/saved/yes", "", nil)
+    flash, ok := resp.cookies[flashCookie]
+    if !ok || resp.statusCode != 303 {
+        t.Fatalf("flash cookie was not set on the redirect")
+    }
+    cookie := map[string]string{"Cookie": flashCookie + "=" + flash}
+    resp = getTestResponse("GET", "/flash/get/saved", "", cookie)
+    if resp.body != "yes" {
+        t.Fatalf("expected flash %q got %q", "yes", resp.body)
+    }
+    if val, ok := resp.cookies[flashCookie]; !ok || val != "" {
+        t.Fatalf("flash cookie was not expired after being read")
+    }
+
+    //requests that don't read flash messages keep them around
+    resp = getTestResponse("GET", "/echo/a", "", map[string]string{"Cookie": flashCookie + "=" + flash})
+    if _, ok := resp.cookies[flashCookie]; ok {
+        t.Fatalf("flash cookie was changed by a request that didn't read it")
+    }
+
+    //reading any flash message discards the unread ones
+    resp = getTestResponse("GET", "/flash/get/other", "", map[string]string{"Cookie": flashCookie + "=" + flash})
+    if resp.body != "" {
+        t.Fatalf("expected no flash got %q", resp.body)
+    }
+    if val, ok := resp.cookies[flashCookie]; !ok || val != "" {
+        t.Fatalf("unread flash cookie was not expired")
+    }
+}
+
+type conditionalTest struct {
+    path           string
+    header         string
+    value          string
+    expectedStatus int
+    expectedBody   string
+}
+
+var conditionalTests = []conditionalTest{
+    conditionalTest{"/etag", "If-None-Match", `"abc"`, 304, ""},
+    conditionalTest{"/etag", "If-None-Match", `W/"abc"`, 304, ""},
+    conditionalTest{"/etag", "If-None-Match", `"xyz", "abc"`, 304, ""},
+    conditionalTest{"/etag", "If-None-Match", `"a,b",W/"abc"`, 304, ""},
+    conditionalTest{"/etag", "If-None-Match", `*`, 304, ""},
+    conditionalTest{"/etag", "If-None-Match", `"xyz"`, 200, "body"},
+    conditionalTest{"/etag", "If-None-Match", `"abcd", "ab"`, 200, "body"},
+    conditionalTest{"/etag", "If-None-Match", `abc`, 200, "body"},
+    conditionalTest{"/etag", "If-None-Match", `"abc`, 200, "body"},
+    conditionalTest{"/etag", "If-None-Match", ``, 200, "body"},
+    conditionalTest{"/lastmodified", "If-Modified-Since", "Sun, 09 Sep 2001 01:46:40 GMT", 304, ""},
+    conditionalTest{"/lastmodified", "If-Modified-Since", "Sun, 09 Sep 2001 01:46:41 GMT", 304, ""},
+    conditionalTest{"/lastmodified", "If-Modified-Since", "Sun, 09 Sep 2001 01:46:39 GMT", 200, "body"},
+    conditionalTest{"/lastmodified", "If-Modified-Since", "yesterday", 200, "body"},
+}
+
+func TestConditionalGet(t *testing.T) {
+    for _, test := range conditionalTests {
+        resp := getTestResponse("GET", test.path, "", map[string]string{test.header: test.value})
+        if resp.statusCode != test.expectedStatus {
+            t.Fatalf("%s %q: expected status %d got %d", test.header, test.value, test.expectedStatus, resp.statusCode)
+        }
+        if resp.body != test.expectedBody {
+            t.Fatalf("%s %q: expected %q got %q", test.header, test.value, test.expectedBody, resp.body)
+        }
+    }
+
+    resp := getTestResponse("GET", "/etag", "", nil)
+    if etag := resp.headers["ETag"]; len(etag) != 1 || etag[0] != `"abc"` {
+        t.Fatalf("unexpected ETag header %v", etag)
+    }
+    resp = getTestResponse("GET", "/lastmodified", "", nil)
+    if lm := resp.headers["Last-Modified"]; len(lm) != 1 || lm[0] != "Sun, 09 Sep 2001 01:46:40 GMT" {
+        t.Fatalf("unexpected Last-Modified header %v", lm)
+    }
+}
+
+type clientIPTest struct {
+    remoteAddr string
+    header     string
+    value      string
+    expected   string
+}
+
+var clientIPTests = []clientIPTest{
+    clientIPTest{"127.0.0.1:4000", "", "", "127.0.0.1"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "1.2.3.4", "1.2.3.4"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "1.2.3.4, 10.0.0.1", "1.2.3.4"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.1", "1.2.3.4"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "10.0.0.1", "10.0.0.1"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "2001:db8::1", "2001:db8::1"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "<script>", "127.0.0.1"},
+    clientIPTest{"127.0.0.1:4000", "X-Forwarded-For", "1.2.3.4, ", "127.0.0.1"},
+    clientIPTest{"127.0.0.1:4000", "X-Real-Ip", "1.2.3.4", "1.2.3.4"},
+    clientIPTest{"127.0.0.1:4000", "X-Real-Ip", "garbage", "127.0.0.1"},
+    clientIPTest{"[::1]:4000", "X-Forwarded-For", "1.2.3.4", "1.2.3.4"},
+    clientIPTest{"[2001:db8::2]:4000", "X-Forwarded-For", "1.2.3.4", "2001:db8::2"},
+    clientIPTest{"5.6.7.8:4000", "X-Forwarded-For", "1.2.3.4", "5.6.7.8"},
+    clientIPTest{"5.6.7.8:4000", "X-Real-Ip", "1.2.3.4", "5.6.7.8"},
+    clientIPTest{"192.168.7.9:4000", "X-Forwarded-For", "1.2.3.4", "1.2.3.4"},
+    clientIPTest{"192.169.0.1:4000", "X-Forwarded-For", "1.2.3.4", "192.169.0.1"},
+}
+
+func TestClientIP(t *testing.T) {
+    SetTrustedProxies([]string{"127.0.0.1", "10.0.0.1", "::1", "192.168.0.0/16"})
+    defer SetTrustedProxies(nil)
+
+    for _, test := range clientIPTests {
+        headers := map[string]string{}
+        if len(test.header) > 0 {
+            headers[test.header] = test.value
+        }
+        req := buildTestRequest("GET", "/clientip", "", headers)
+        req.RemoteAddr = test.remoteAddr
+        resp := getTestResponseFromRequest(req)
+        if resp.body != test.expected {
+            t.Fatalf("%s with %s %q: expected %q got %q", test.remoteAddr, test.header, test.value, test.expected, resp.body)
+        }
+    }
+}
+
+func TestReadJSON(t *testing.T) {
+    headers := map[string]string{"Content-Type": "application/json"}
+    req := buildTestRequest("POST", "/json", `{"Name": "web.go", "Tags": ["go", "web"]}`, headers)
+    req.Headers["Content-Type"] = "application/json"
+    resp := getTestResponseFromRequest(req)
+    if resp.statusCode != 200 || resp.body != "web.go:go,web" {
+        t.Fatalf("expected %q got %d %q", "web.go:go,web", resp.statusCode, resp.body)
+    }
+
+    req = buildTestRequest("POST", "/json", `{"Name": `, headers)
+    req.Headers["Content-Type"] = "application/json"
+    resp = getTestResponseFromRequest(req)
+    if resp.statusCode != 400 {
+        t.Fatalf("expected status 400 for invalid JSON got %d", resp.statusCode)
+    }
+}
+
+func TestMaxBodySize(t *testing.T) {
+    SetMaxBodySize(4)
+    defer SetMaxBodySize(32 << 20)
+
+    resp := getTestResponse("POST", "/rawbody", "a=12345", nil)
+    if resp.statusCode != 413 {
+        t.Fatalf("expected status 413 got %d", resp.statusCode)
+    }
+
+    resp = getTestResponse("POST", "/rawbody", "a=1", nil)
+    if resp.body != "1:a=1" {
+        t.Fatalf("expected %q got %q", "1:a=1", resp.body)
+    }
+
+    //streamed bodies aren't limited
+    resp = getTestResponse("POST", "/streambody", "a=12345", nil)
+    if resp.body != ":a=12345" {
+        t.Fatalf("expected %q got %q", ":a=12345", resp.body)
+    }
+}
+
+func TestServeFile(t *testing.T) {
+    contents, _ := ioutil.ReadFile("LICENSE")
+    info, _ := os.Stat("LICENSE")
+
+    resp := getTestResponse("GET", "/servefile/LICENSE", "", nil)
+    if resp.statusCode != 200 || resp.body != string(contents) {
+        t.Fatalf("ServeFile failed with status %d", resp.statusCode)
+    }
+    if cl := resp.headers["Content-Length"]; len(cl) != 1 || cl[0] != strconv.Itoa(len(contents)) {
+        t.Fatalf("unexpected Content-Length header %v", cl)
+    }
+    lm := resp.headers["Last-Modified"]
+    if len(lm) != 1 || lm[0] != webTime(time.SecondsToUTC(info.Mtime_ns/1e9)) {
+        t.Fatalf("unexpected Last-Modified header %v", lm)
+    }
+
+    resp = getTestResponse("GET", "/servefile/LICENSE", "", map[string]string{"If-Modified-Since": lm[0]})
+    if resp.statusCode != 304 || resp.body != "" {
+        t.Fatalf("expected status 304 got %d", resp.statusCode)
+    }
+
+    resp = getTestResponse("GET", "/servefile/doesnotexist", "", nil)
+    if resp.statusCode != 404 || resp.body != "missing doesnotexist" {
+        t.Fatalf("expected the handler to handle the missing file got %d %q", resp.statusCode, resp.body)
+    }
+
+    resp = getTestResponse("GET", "/download/LICENSE", "", nil)
+    if cd := resp.headers["Content-Disposition"]; len(cd) != 1 || cd[0] != `attachment; filename="download.txt"` {
+        t.Fatalf("unexpected Content-Disposition header %v", cd)
+    }
+    if resp.body != string(contents) {
+        t.Fatalf("ServeFileAs sent the wrong contents")
+    }
+
+    resp = getTestResponse("GET", "/download/doesnotexist", "", nil)
+    if _, ok := resp.headers["Content-Disposition"]; ok || resp.statusCode != 404 {
+        t.Fatalf("ServeFileAs wrote headers for a missing file")
+    }
+
+    dispositions := map[string]string{
+        `plain.txt`:       `attachment; filename="plain.txt"`,
+        `say "hi"\.txt`:   `attachment; filename="say \"hi\"\\.txt"`,
+        "tab\there.txt":   `attachment; filename="tab_here.txt"`,
+        `résumé 100%.pdf`: `attachment; filename="r_sum_ 100%.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%20100%25.pdf`,
+    }
+    for name, expected := range dispositions {
+        if d := attachmentDisposition(name); d != expected {
+            t.Fatalf("expected %q for %q got %q", expected, name, d)
+        }
+    }
+}
+
+func TestBuffer(t *testing.T) {
+    resp := getTestResponse("GET", "/buffer/status", "", nil)
+    if h := resp.headers["X-Buffered"]; len(h) != 1 || h[0] != "1" {
+        t.Fatalf("header set after writing to the buffer is missing")
+    }
+    if cl := resp.headers["Content-Length"]; len(cl) != 1 || cl[0] != "5" {
+        t.Fatalf("unexpected Content-Length header %v", cl)
+    }
+
+    //explicitly flushed responses are streamed without a length
+    resp = getTestResponse("GET", "/buffer/flush", "", nil)
+    if _, ok := resp.headers["Content-Length"]; ok {
+        t.Fatalf("flushed response has a Content-Length")
+    }
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "."
+    defer func() { staticDir = oldStaticDir }()
+
+    paths := []string{
+        "/echo/hello",
+        "/error/code/500",
+        "/error/notfound/notfound",
+        "/doesnotexist",
+        "/redirect/permanent",
+        "/buffer/status",
+        "/servefile/LICENSE",
+        "/LICENSE",
+    }
+    for _, path := range paths {
+        getresp := getTestResponse("GET", path, "", nil)
+        headresp := getTestResponse("HEAD", path, "", nil)
+
+        if len(headresp.body) != 0 {
+            t.Fatalf("HEAD %s arrived with a body", path)
+        }
+        if cl := getresp.headers["Content-Length"]; len(cl) != 1 || cl[0] != strconv.Itoa(len(getresp.body)) {
+            t.Fatalf("GET %s has Content-Length %v for a body of %d bytes", path, cl, len(getresp.body))
+        }
+        for name, values := range getresp.headers {
+            if name == "Date" {
+                continue
+            }
+            if strings.Join(headresp.headers[name], ",") != strings.Join(values, ",") {
+                t.Fatalf("HEAD %s: expected %s %v got %v", path, name, values, headresp.headers[name])
+            }
+        }
+    }
+}
+
+type negotiateTest struct {
+    headers  map[string]string
+    expected string
+}
+
+var negotiateTests = []negotiateTest{
+    negotiateTest{map[string]string{}, "false true text/html"},
+    negotiateTest{map[string]string{"X-Requested-With": "XMLHttpRequest"}, "true true text/html"},
+    negotiateTest{map[string]string{"Accept": "application/json"}, "false true application/json"},
+    negotiateTest{map[string]string{"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, "false true text/html"},
+    negotiateTest{map[string]string{"Accept": "text/html;q=0.5, application/json"}, "false true application/json"},
+    negotiateTest{map[string]string{"Accept": "text/*;q=0.3, application/*"}, "false true application/json"},
+    negotiateTest{map[string]string{"Accept": "*/*"}, "false true text/html"},
+    negotiateTest{map[string]string{"Accept": "*/*, application/json;q=0"}, "false false text/html"},
+    negotiateTest{map[string]string{"Accept": "image/png"}, "false false "},
+    negotiateTest{map[string]string{"Accept": "TEXT/HTML;level=1;q=0.4, application/json;q=bogus"}, "false false text/html"},
+}
+
+func TestNegotiate(t *testing.T) {
+    for _, test := range negotiateTests {
+        resp := getTestResponse("GET", "/negotiate", "", test.headers)
+        if resp.body != test.expected {
+            t.Fatalf("%v: expected %q got %q", test.headers, test.expected, resp.body)
+        }
+    }
+}
+
+type basicAuthTest struct {
+    authorization  string
+    expectedStatus int
+    expectedBody   string
+}
+
+var basicAuthTests = []basicAuthTest{
+    //admin:open:sesame
+    basicAuthTest{"Basic YWRtaW46b3BlbjpzZXNhbWU=", 200, "hello admin"},
+    basicAuthTest{"basic YWRtaW46b3BlbjpzZXNhbWU=", 200, "hello admin"},
+    //admin:wrong
+    basicAuthTest{"Basic YWRtaW46d3Jvbmc=", 401, "Unauthorized"},
+    //admin
+    basicAuthTest{"Basic YWRtaW4=", 401, "Unauthorized"},
+    basicAuthTest{"Basic !!!not base64!!!", 401, "Unauthorized"},
+    basicAuthTest{"Basic", 401, "Unauthorized"},
+    basicAuthTest{"Digest username=admin", 401, "Unauthorized"},
+    basicAuthTest{"", 401, "Unauthorized"},
+}
+
+func TestBasicAuth(t *testing.T) {
+    for _, test := range basicAuthTests {
+        headers := map[string]string{}
+        if len(test.authorization) > 0 {
+            headers["Authorization"] = test.authorization
+        }
+        resp := getTestResponse("GET", "/basicauth", "", headers)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%q: expected %d %q got %d %q", test.authorization, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+        if resp.statusCode == 401 {
+            if h := resp.headers["WWW-Authenticate"]; len(h) != 1 || h[0] != `Basic realm="admin area"` {
+                t.Fatalf("unexpected WWW-Authenticate header %v", resp.headers)
+            }
+        }
+    }
+}
+
+func checkSetHeaderResponse(t *testing.T, resp *testResponse) {
+    expected := map[string]string{
+        "X-Unique":     "b",
+        "X-Multi":      "a,b",
+        "Content-Type": "text/plain",
+        "X-Late":       "",
+    }
+    for name, value := range expected {
+        if strings.Join(resp.headers[name], ",") != value {
+            t.Fatalf("expected %s %q got %v", name, value, resp.headers[name])
+        }
+    }
+    if len(resp.headers["Set-Cookie"]) != 2 || resp.cookies["a"] != "1" || resp.cookies["b"] != "2" {
+        t.Fatalf("expected two cookies got %v", resp.headers["Set-Cookie"])
+    }
+    if resp.body != "ok" {
+        t.Fatalf("expected %q got %q", "ok", resp.body)
+    }
+}
+
+func TestSetHeader(t *testing.T) {
+    checkSetHeaderResponse(t, getTestResponse("GET", "/setheader", "", nil))
+
+    req := buildTestScgiRequest("GET", "/setheader", "", make(map[string]string))
+    var output bytes.Buffer
+    handleScgiRequest(&tcpBuffer{input: req, output: &output})
+    checkSetHeaderResponse(t, buildTestResponse(&output))
+
+    req = buildTestFcgiRequest("GET", "/setheader", []string{""}, make(map[string]string))
+    var output2 bytes.Buffer
+    handleFcgiConnection(&tcpBuffer{input: req, output: &output2})
+    checkSetHeaderResponse(t, buildTestResponse(getFcgiOutput(&output2)))
+}
+
+func TestRender(t *testing.T) {
+    if err := SetTemplateDir("testdata/templates"); err != nil {
+        t.Fatalf("SetTemplateDir failed: %s", err.String())
+    }
+
+    tests := []Test{
+        Test{"GET", "/render/hello.html", "", 200, "Hello world!"},
+        Test{"GET", "/renderlayout/hello.html", "", 200, "<body>Hello world!</body>"},
+        Test{"GET", "/render/broken.html", "", 500, "template error"},
+        Test{"GET", "/renderlayout/broken.html", "", 500, "template error"},
+        Test{"GET", "/render/doesnotexist.html", "", 500, "template error"},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s: expected %d %q got %d %q", test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+        if cl := resp.headers["Content-Length"]; len(cl) != 1 || cl[0] != strconv.Itoa(len(resp.body)) {
+            t.Fatalf("%s: unexpected Content-Length header %v", test.path, cl)
+        }
+    }
+
+    if SetTemplateDir("testdata/doesnotexist") == nil {
+        t.Fatalf("SetTemplateDir accepted a missing directory")
+    }
+}
+
+func TestEventStream(t *testing.T) {
+    resp := getTestResponse("GET", "/events", "", nil)
+    if ct := resp.headers["Content-Type"]; len(ct) != 1 || ct[0] != "text/event-stream" {
+        t.Fatalf("unexpected Content-Type header %v", ct)
+    }
+    expected := "event: greeting\ndata: hello\n\ndata: multi\ndata: line\n\n"
+    if resp.body != expected {
+        t.Fatalf("expected %q got %q", expected, resp.body)
+    }
+}
+
+func TestBodylessResponses(t *testing.T) {
+    for _, path := range []string{"/nocontent", "/notmodified", "/buffer/nocontent"} {
+        resp := getTestResponse("GET", path, "", nil)
+        if cl, ok := resp.headers["Content-Length"]; ok {
+            t.Fatalf("%s: unexpected Content-Length header %v", path, cl)
+        }
+        if resp.body != "" {
+            t.Fatalf("%s: unexpected body %q", path, resp.body)
+        }
+    }
+    resp := getTestResponse("GET", "/notmodified", "", nil)
+    if ct, ok := resp.headers["Content-Type"]; ok {
+        t.Fatalf("unexpected Content-Type header %v on a 304", ct)
+    }
+}
+
+type jsonpTest struct {
+    path                string
+    expectedStatus      int
+    expectedContentType string
+    expectedBody        string
+}
+
+var jsonpTests = []jsonpTest{
+    jsonpTest{"/json", 200, "application/json; charset=utf-8", `{"a":"b"}`},
+    jsonpTest{"/json?callback=cb", 200, "application/javascript; charset=utf-8", `cb({"a":"b"});`},
+    jsonpTest{"/json?callback=jQuery_12.$cb", 200, "application/javascript; charset=utf-8", `jQuery_12.$cb({"a":"b"});`},
+    jsonpTest{"/json?callback=alert(1)//", 400, "text/html; charset=utf-8", "Invalid JSONP callback"},
+    jsonpTest{"/json?callback=", 400, "text/html; charset=utf-8", "Invalid JSONP callback"},
+    jsonpTest{"/json?callback=a..b", 400, "text/html; charset=utf-8", "Invalid JSONP callback"},
+}
+
+func TestJSONP(t *testing.T) {
+    for _, test := range jsonpTests {
+        resp := getTestResponse("GET", test.path, "", nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s: expected %d %q got %d %q", test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+        if ct := resp.headers["Content-Type"]; len(ct) != 1 || ct[0] != test.expectedContentType {
+            t.Fatalf("%s: unexpected Content-Type header %v", test.path, ct)
+        }
+    }
+
+    SetJSONP(false)
+    resp := getTestResponse("GET", "/json?callback=cb", "", nil)
+    SetJSONP(true)
+    if resp.body != `{"a":"b"}` {
+        t.Fatalf("JSONP wasn't disabled, got %q", resp.body)
+    }
+}
+
+func TestGetHeader(t *testing.T) {
+    headers := map[string]string{"X-Custom": "custom", "Content-Type": "text/plain"}
+    for _, name := range []string{"X-Custom", "x-custom", "X-CUSTOM"} {
+        resp := getTestResponse("GET", "/header/"+name, "", headers)
+        if resp.body != "custom" {
+            t.Fatalf("%s: expected %q got %q", name, "custom", resp.body)
+        }
+    }
+    resp := getTestResponse("GET", "/header/user-agent", "", nil)
+    if resp.body != "web.go test framework" {
+        t.Fatalf("unexpected User-Agent %q", resp.body)
+    }
+    resp = getTestResponse("GET", "/header/missing", "", nil)
+    if resp.body != "" {
+        t.Fatalf("unexpected value %q for a missing header", resp.body)
+    }
+
+    cgiHeaders := map[string]string{
+        "HTTP_X_CUSTOM":   "custom",
+        "HTTP_USER_AGENT": "agent",
+        "HTTP_REFERER":    "http://example.com/",
+    }
+    expected := map[string]string{
+        "/header/x-custom":   "custom",
+        "/header/User-Agent": "agent",
+        "/header/referer":    "http://example.com/",
+        "/header/host":       "127.0.0.1",
+    }
+    for path, value := range expected {
+        req := buildTestScgiRequest("GET", path, "", cgiHeaders)
+        var output bytes.Buffer
+        handleScgiRequest(&tcpBuffer{input: req, output: &output})
+        if resp := buildTestResponse(&output); resp.body != value {
+            t.Fatalf("Scgi %s: expected %q got %q", path, value, resp.body)
+        }
+
+        req = buildTestFcgiRequest("GET", path, []string{}, cgiHeaders)
+        output.Reset()
+        handleFcgiConnection(&tcpBuffer{input: req, output: &output})
+        if resp := buildTestResponse(getFcgiOutput(&output)); resp.body != value {
+            t.Fatalf("Fcgi %s: expected %q got %q", path, value, resp.body)
+        }
+    }
+}
+
+var staticTests = []Test{
+    Test{"GET", "/hello.txt", "", 200, "hello static\n"},
+    Test{"GET", "/link.html", "", 200, "Hello {Name}!"},
+    Test{"GET", "/../templates/hello.html", "", 404, "Page not found"},
+    Test{"GET", "/static/../../web.go", "", 404, "Page not found"},
+    Test{"GET", "/%2e%2e/templates/hello.html", "", 404, "Page not found"},
+    Test{"GET", "/%252e%252e/templates/hello.html", "", 404, "Page not found"},
+    Test{"GET", "/..%5ctemplates%5chello.html", "", 404, "Page not found"},
+    Test{"GET", "/..\\templates\\hello.html", "", 404, "Page not found"},
+}
+
+func TestStaticTraversal(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    for _, test := range staticTests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s: expected %d %q got %d %q", test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+    }
+
+    SetStaticFollowSymlinks(false)
+    defer SetStaticFollowSymlinks(true)
+    if resp := getTestResponse("GET", "/link.html", "", nil); resp.statusCode != 404 {
+        t.Fatalf("symlink was followed, got status %d", resp.statusCode)
+    }
+    if resp := getTestResponse("GET", "/hello.txt", "", nil); resp.statusCode != 200 {
+        t.Fatalf("expected status 200 got %d", resp.statusCode)
+    }
+}
+
+func TestStaticContentType(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    AddMimeType("webmanifest", "application/manifest+json")
+    expected := map[string]string{
+        "/hello.txt":        "text/plain; charset=utf-8",
+        "/style.css":        "text/css; charset=utf-8",
+        "/upper.JS":         "application/javascript; charset=utf-8",
+        "/data.unknownext":  "application/octet-stream",
+        "/site.webmanifest": "application/manifest+json",
+    }
+    for path, ctype := range expected {
+        resp := getTestResponse("GET", path, "", nil)
+        if ct := resp.headers["Content-Type"]; len(ct) != 1 || ct[0] != ctype {
+            t.Fatalf("%s: expected Content-Type %q got %v", path, ctype, ct)
+        }
+    }
+}
+
+func TestStaticCaching(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    resp := getTestResponse("GET", "/hello.txt", "", nil)
+    etag := resp.headers["ETag"]
+    lm := resp.headers["Last-Modified"]
+    if len(etag) != 1 || len(lm) != 1 {
+        t.Fatalf("missing validators, ETag %v Last-Modified %v", etag, lm)
+    }
+    if cc, ok := resp.headers["Cache-Control"]; ok {
+        t.Fatalf("unexpected Cache-Control header %v", cc)
+    }
+
+    conditionals := []map[string]string{
+        map[string]string{"If-None-Match": etag[0]},
+        map[string]string{"If-Modified-Since": lm[0]},
+        map[string]string{"If-None-Match": etag[0], "If-Modified-Since": "Sat, 01 Jan 2000 00:00:00 GMT"},
+    }
+    for _, headers := range conditionals {
+        for _, method := range []string{"GET", "HEAD"} {
+            resp = getTestResponse(method, "/hello.txt", "", headers)
+            if resp.statusCode != 304 || resp.body != "" {
+                t.Fatalf("%s %v: expected status 304 got %d %q", method, headers, resp.statusCode, resp.body)
+            }
+            if v := resp.headers["ETag"]; len(v) != 1 || v[0] != etag[0] {
+                t.Fatalf("%s %v: unexpected ETag header %v", method, headers, v)
+            }
+        }
+    }
+
+    //If-None-Match wins over a matching If-Modified-Since
+    resp = getTestResponse("GET", "/hello.txt", "", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lm[0]})
+    if resp.statusCode != 200 || resp.body != "hello static\n" {
+        t.Fatalf("expected status 200 got %d", resp.statusCode)
+    }
+
+    SetStaticCacheMaxAge(3600)
+    defer SetStaticCacheMaxAge(0)
+    for _, method := range []string{"GET", "HEAD"} {
+        resp = getTestResponse(method, "/hello.txt", "", nil)
+        if cc := resp.headers["Cache-Control"]; len(cc) != 1 || cc[0] != "public, max-age=3600" {
+            t.Fatalf("%s: unexpected Cache-Control header %v", method, cc)
+        }
+    }
+}
+
+type rangeTest struct {
+    header         string
+    expectedStatus int
+    expectedRange  string
+    expectedBody   string
+}
+
+var rangeTests = []rangeTest{
+    rangeTest{"bytes=0-4", 206, "bytes 0-4/13", "hello"},
+    rangeTest{"bytes=6-", 206, "bytes 6-12/13", "static\n"},
+    rangeTest{"bytes=-7", 206, "bytes 6-12/13", "static\n"},
+    rangeTest{"bytes=6-100", 206, "bytes 6-12/13", "static\n"},
+    rangeTest{"bytes=-100", 206, "bytes 0-12/13", "hello static\n"},
+    rangeTest{"bytes=12-12", 206, "bytes 12-12/13", "\n"},
+    rangeTest{"bytes=13-", 416, "bytes */13", "Requested range not satisfiable"},
+    rangeTest{"bytes=-0", 416, "bytes */13", "Requested range not satisfiable"},
+    rangeTest{"bytes=0-1,3-4", 200, "", "hello static\n"},
+    rangeTest{"bytes=5-2", 200, "", "hello static\n"},
+    rangeTest{"bytes=a-b", 200, "", "hello static\n"},
+    rangeTest{"items=0-4", 200, "", "hello static\n"},
+}
+
+func TestStaticRange(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    resp := getTestResponse("GET", "/hello.txt", "", nil)
+    if ar := resp.headers["Accept-Ranges"]; len(ar) != 1 || ar[0] != "bytes" {
+        t.Fatalf("unexpected Accept-Ranges header %v", ar)
+    }
+
+    for _, test := range rangeTests {
+        resp := getTestResponse("GET", "/hello.txt", "", map[string]string{"Range": test.header})
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s: expected %d %q got %d %q", test.header, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+        if cr := resp.headers["Content-Range"]; test.expectedRange != "" && (len(cr) != 1 || cr[0] != test.expectedRange) {
+            t.Fatalf("%s: unexpected Content-Range header %v", test.header, cr)
+        }
+        if cl := resp.headers["Content-Length"]; len(cl) != 1 || cl[0] != strconv.Itoa(len(resp.body)) {
+            t.Fatalf("%s: unexpected Content-Length header %v", test.header, cl)
+        }
+    }
+}
+
+func TestFcgiLargeResponse(t *testing.T) {
+    req := buildTestFcgiRequest("GET", "/large/200000", []string{}, make(map[string]string))
+    var output bytes.Buffer
+    handleFcgiConnection(&tcpBuffer{input: req, output: &output})
+    resp := buildTestResponse(getFcgiOutput(&output))
+    if resp.statusCode != 200 || resp.body != strings.Repeat("a", 200000) {
+        t.Fatalf("expected a 200000 byte body got %d bytes", len(resp.body))
+    }
+}
+
+func TestServeFileClientGone(t *testing.T) {
+    name := "testdata/large.bin"
+    ioutil.WriteFile(name, make([]byte, 1<<20), 0644)
+    defer os.Remove(name)
+
+    //the headers are written, then the client goes away
+    bc := brokenConn{maxWrites: 1}
+    c := scgiConn{fd: &bc, headers: make(map[string][]string)}
+    routeHandler(buildTestRequest("GET", "/servefile/"+name, "", nil), &c)
+    if bc.writes != 2 {
+        t.Fatalf("expected the copy to stop after the first failed write, got %d writes", bc.writes)
+    }
+}
+
+func BenchmarkServeLargeFile(b *testing.B) {
+    b.StopTimer()
+    name := "testdata/large.bin"
+    size := 16 << 20
+    ioutil.WriteFile(name, make([]byte, size), 0644)
+    defer os.Remove(name)
+    b.SetBytes(int64(size))
+    b.StartTimer()
+
+    for i := 0; i < b.N; i++ {
+        //writes are discarded, so memory use stays at a chunk per request
+        bc := brokenConn{maxWrites: size}
+        c := scgiConn{fd: &bc, headers: make(map[string][]string)}
+        routeHandler(buildTestRequest("GET", "/servefile/"+name, "", nil), &c)
+    }
+}
+
+func TestStaticMounts(t *testing.T) {
+    defer func() { staticMounts = vector.Vector{} }()
+
+    if err := Static("/assets", "testdata/static"); err != nil {
+        t.Fatalf("Static failed: %s", err)
+    }
+    if err := Static("/other/", "testdata/templates"); err != nil {
+        t.Fatalf("Static failed: %s", err)
+    }
+    if Static("/missing", "testdata/doesnotexist") == nil {
+        t.Fatalf("Static accepted a missing directory")
+    }
+
+    tests := []Test{
+        Test{"GET", "/assets/hello.txt", "", 200, "hello static\n"},
+        Test{"HEAD", "/assets/hello.txt", "", 200, ""},
+        Test{"GET", "/other/hello.html", "", 200, "Hello {Name}!"},
+        Test{"GET", "/other/hello.txt", "", 404, "Page not found"},
+        Test{"GET", "/assetsfoo/hello.txt", "", 404, "Page not found"},
+        Test{"GET", "/assets", "", 404, "Page not found"},
+        Test{"GET", "/assets/../hello.txt", "", 404, "Page not found"},
+        Test{"GET", "/assets/%2e%2e/templates/hello.html", "", 404, "Page not found"},
+        Test{"GET", "/echo/hello", "", 200, "hello"},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s: expected %d %q got %d %q", test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+    }
+
+    //relative directories are relative to the executable, not the working directory
+    oldExeDir := ExeDir()
+    wd, _ := os.Getwd()
+    exeDir = path.Join(wd, "testdata")
+    defer func() { exeDir = oldExeDir }()
+    if err := Static("/relative", "static"); err != nil {
+        t.Fatalf("Static failed: %s", err)
+    }
+    if resp := getTestResponse("GET", "/relative/hello.txt", "", nil); resp.statusCode != 200 || resp.body != "hello static\n" {
+        t.Fatalf("expected the file under the executable's directory, got %d %q", resp.statusCode, resp.body)
+    }
+    SetConfig("webserver", "staticDir", "static")
+    dir := staticDirectory()
+    configValues["webserver"]["staticdir"] = "", false
+    if dir != path.Join(wd, "testdata", "static") {
+        t.Fatalf("expected webserver.staticDir under the executable's directory, got %q", dir)
+    }
+}
+
+func TestIndexFiles(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    resp := getTestResponse("GET", "/docs/", "", nil)
+    if resp.statusCode != 200 || resp.body != "docs index" {
+        t.Fatalf("expected the index file got %d %q", resp.statusCode, resp.body)
+    }
+    resp = getTestResponse("GET", "/docs", "", nil)
+    if loc := resp.headers["Location"]; resp.statusCode != 301 || len(loc) != 1 || loc[0] != "/docs/" {
+        t.Fatalf("expected a redirect to /docs/ got %d %v", resp.statusCode, loc)
+    }
+
+    SetIndexRedirect(false)
+    resp = getTestResponse("GET", "/docs", "", nil)
+    SetIndexRedirect(true)
+    if resp.statusCode != 200 || resp.body != "docs index" {
+        t.Fatalf("expected the index file got %d %q", resp.statusCode, resp.body)
+    }
+
+    //routes take precedence over index files
+    resp = getTestResponse("GET", "/", "", nil)
+    if resp.body != "index" {
+        t.Fatalf("expected the route got %q", resp.body)
+    }
+
+    defer SetIndexFiles([]string{"index.html"})
+    defer func() { staticMounts = vector.Vector{} }()
+    Static("/mount", "testdata/static")
+    SetIndexFiles([]string{"missing.html", "hello.txt"})
+    resp = getTestResponse("GET", "/mount/", "", nil)
+    if resp.statusCode != 200 || resp.body != "hello static\n" {
+        t.Fatalf("expected the second index file got %d %q", resp.statusCode, resp.body)
+    }
+
+    SetIndexFiles([]string{})
+    resp = getTestResponse("GET", "/docs/", "", nil)
+    if resp.statusCode != 404 {
+        t.Fatalf("index files weren't disabled, got status %d", resp.statusCode)
+    }
+}
+
+func TestStaticCache(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    name := "testdata/static/cached.txt"
+    ioutil.WriteFile(name, []byte("one"), 0644)
+    defer os.Remove(name)
+
+    EnableStaticCache(12, 20)
+    defer EnableStaticCache(0, 0)
+
+    for i := 0; i < 2; i++ {
+        resp := getTestResponse("GET", "/cached.txt", "", nil)
+        if resp.statusCode != 200 || resp.body != "one" {
+            t.Fatalf("expected %q got %d %q", "one", resp.statusCode, resp.body)
+        }
+    }
+    if len(fileCache.files) != 1 || fileCache.size != 3 {
+        t.Fatalf("expected 1 cached file of 3 bytes got %d of %d bytes", len(fileCache.files), fileCache.size)
+    }
+
+    //a changed file is reloaded
+    ioutil.WriteFile(name, []byte("two!"), 0644)
+    resp := getTestResponse("GET", "/cached.txt", "", nil)
+    if resp.body != "two!" {
+        t.Fatalf("expected %q got %q", "two!", resp.body)
+    }
+    resp = getTestResponse("GET", "/cached.txt", "", map[string]string{"Range": "bytes=1-2"})
+    if resp.statusCode != 206 || resp.body != "wo" {
+        t.Fatalf("expected a partial response got %d %q", resp.statusCode, resp.body)
+    }
+    resp = getTestResponse("GET", "/cached.txt", "", map[string]string{"If-None-Match": resp.headers["ETag"][0]})
+    if resp.statusCode != 304 {
+        t.Fatalf("expected status 304 got %d", resp.statusCode)
+    }
+
+    //files over the size limit are served from disk
+    getTestResponse("GET", "/hello.txt", "", nil)
+    getTestResponse("GET", "/docs/index.html", "", nil)
+    if len(fileCache.files) != 2 || fileCache.size != 14 {
+        t.Fatalf("expected 2 cached files of 14 bytes got %d of %d bytes", len(fileCache.files), fileCache.size)
+    }
+
+    //the least recently used file is evicted
+    ioutil.WriteFile(name, []byte("three, long"), 0644)
+    getTestResponse("GET", "/cached.txt", "", nil)
+    if len(fileCache.files) != 1 || fileCache.size != 11 {
+        t.Fatalf("expected 1 cached file of 11 bytes got %d of %d bytes", len(fileCache.files), fileCache.size)
+    }
+}
+
+func TestStaticMethodNotAllowed(t *testing.T) {
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    tests := []Test{
+        Test{"PUT", "/hello.txt", "", 405, "Method Not Allowed"},
+        Test{"DELETE", "/docs/index.html", "", 405, "Method Not Allowed"},
+        Test{"POST", "/docs/", "", 405, "Method Not Allowed"},
+        Test{"POST", "/hello.txt", "", 200, "posted"},
+        Test{"PUT", "/doesnotexist.txt", "", 404, "Page not found"},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s %s: expected %d %q got %d %q", test.method, test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+        if allow := resp.headers["Allow"]; test.expectedStatus == 405 && (len(allow) != 1 || allow[0] != "GET, HEAD") {
+            t.Fatalf("%s %s: unexpected Allow header %v", test.method, test.path, allow)
+        }
+    }
+}
+
+func TestStaticFromMap(t *testing.T) {
+    defer func() { staticMounts = vector.Vector{} }()
+
+    StaticFromMap("/embedded", map[string][]byte{
+        "app.js":       []byte("alert(1)"),
+        "/index.html":  []byte("<p>embedded</p>"),
+        "css/site.css": []byte("body {}"),
+    })
+    Static("/embedded", "testdata/static")
+
+    tests := []Test{
+        Test{"GET", "/embedded/app.js", "", 200, "alert(1)"},
+        Test{"HEAD", "/embedded/app.js", "", 200, ""},
+        Test{"GET", "/embedded/css/site.css", "", 200, "body {}"},
+        Test{"GET", "/embedded/", "", 200, "<p>embedded</p>"},
+        Test{"GET", "/embedded/css/", "", 404, "Page not found"},
+        Test{"GET", "/embedded/hello.txt", "", 200, "hello static\n"},
+        Test{"GET", "/embedded/missing.js", "", 404, "Page not found"},
+        Test{"POST", "/embedded/app.js", "", 405, "Method Not Allowed"},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s %s: expected %d %q got %d %q", test.method, test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+    }
+
+    resp := getTestResponse("GET", "/embedded/app.js", "", nil)
+    if ct := resp.headers["Content-Type"]; len(ct) != 1 || ct[0] != "application/javascript; charset=utf-8" {
+        t.Fatalf("unexpected Content-Type header %v", ct)
+    }
+    etag := resp.headers["ETag"]
+    if len(etag) != 1 {
+        t.Fatalf("missing ETag header")
+    }
+    resp = getTestResponse("GET", "/embedded/app.js", "", map[string]string{"If-None-Match": etag[0]})
+    if resp.statusCode != 304 || resp.body != "" {
+        t.Fatalf("expected status 304 got %d %q", resp.statusCode, resp.body)
+    }
+    resp = getTestResponse("GET", "/embedded", "", nil)
+    if loc := resp.headers["Location"]; resp.statusCode != 301 || len(loc) != 1 || loc[0] != "/embedded/" {
+        t.Fatalf("expected a redirect to /embedded/ got %d %v", resp.statusCode, loc)
+    }
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+    tests := []Test{
+        Test{"GET", "/post/echo/hello", "", 405, "Method Not Allowed"},
+        Test{"POST", "/echo/hello", "", 405, "Method Not Allowed"},
+        Test{"PUT", "/json", "", 405, "Method Not Allowed"},
+    }
+    allows := []string{"POST", "GET, HEAD", "POST, GET, HEAD"}
+    for i, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s %s: expected %d %q got %d %q", test.method, test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+        if allow := resp.headers["Allow"]; len(allow) != 1 || allow[0] != allows[i] {
+            t.Fatalf("%s %s: unexpected Allow header %v", test.method, test.path, allow)
+        }
+    }
+}
+
+func TestStaticFallback(t *testing.T) {
+    SetStaticFallback(func(ctx *Context, requestedPath string) bool {
+        if strings.HasPrefix(requestedPath, "/api/") || ctx.Request.Method != "GET" {
+            return false
+        }
+        ctx.WriteString("app " + requestedPath + " " + ctx.Param("tab"))
+        return true
+    })
+    defer SetStaticFallback(nil)
+
+    tests := []Test{
+        Test{"GET", "/app/settings?tab=profile", "", 200, "app /app/settings profile"},
+        Test{"GET", "/api/users", "", 404, "Page not found"},
+        Test{"POST", "/app/settings", "", 404, "Page not found"},
+        Test{"GET", "/echo/hello", "", 200, "hello"},
+        Test{"GET", "/post/echo/hello", "", 405, "Method Not Allowed"},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Fatalf("%s %s: expected %d %q got %d %q", test.method, test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+    }
+}
+
+func TestFindExeDir(t *testing.T) {
+    wd, _ := os.Getwd()
+    pathList := "/nonexistent:" + path.Join(wd, "testdata/static") + ":/bin"
+    tests := [][]string{
+        []string{"/usr/local/bin/app", "/usr/local/bin"},
+        []string{"./app", wd},
+        []string{"bin/app", path.Join(wd, "bin")},
+        []string{"../app", path.Join(wd, "..")},
+        //found in the second directory of the path
+        []string{"hello.txt", path.Join(wd, "testdata/static")},
+        //not in the path at all
+        []string{"doesnotexist", wd},
+    }
+    for _, test := range tests {
+        if dir := findExeDir(test[0], wd, pathList); dir != test[1] {
+            t.Fatalf("%s: expected %q got %q", test[0], test[1], dir)
+        }
+    }
+}
+
+func TestSetStaticDir(t *testing.T) {
+    oldStaticDir := staticDir
+    defer func() { staticDir = oldStaticDir }()
+
+    if !strings.HasPrefix(ExeDir(), "/") {
+        t.Fatalf("ExeDir isn't absolute: %q", ExeDir())
+    }
+    if SetStaticDir("testdata/doesnotexist") == nil {
+        t.Fatalf("SetStaticDir accepted a missing directory")
+    }
+
+    dir := path.Join(ExeDir(), "testdata/newstatic")
+    defer os.Remove(dir)
+    if err := CreateStaticDir("testdata/newstatic"); err != nil {
+        t.Fatalf("CreateStaticDir failed: %s", err)
+    }
+    if staticDir != dir || !dirExists(dir) {
+        t.Fatalf("expected the static directory %q got %q", dir, staticDir)
+    }
+}
+
+func TestStaticErrors(t *testing.T) {
+    errors := []os.Error{
+        &os.PathError{"open", "missing", os.ENOENT},
+        &os.PathError{"open", "secret", os.EACCES},
+        &os.PathError{"read", "broken", os.EIO},
+    }
+    handled := []bool{false, true, true}
+    statuses := []int{0, 403, 500}
+    for i, err := range errors {
+        var buf bytes.Buffer
+        c := scgiConn{fd: &tcpBuffer{nil, &buf}, headers: make(map[string][]string)}
+        var ic conn = &c
+        ctx := Context{Request: buildTestRequest("GET", "/", "", nil), conn: &ic}
+        if handleStaticError(&ctx, "file", err) != handled[i] {
+            t.Fatalf("%s: expected handled to be %v", err, handled[i])
+        }
+        if resp := buildTestResponse(&buf); handled[i] && resp.statusCode != statuses[i] {
+            t.Fatalf("%s: expected status %d got %d", err, statuses[i], resp.statusCode)
+        }
+    }
+
+    //root can read any file, so the permission check only works for other users
+    if os.Getuid() == 0 {
+        return
+    }
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+
+    name := "testdata/static/secret.txt"
+    ioutil.WriteFile(name, []byte("secret"), 0)
+    defer os.Remove(name)
+    resp := getTestResponse("GET", "/secret.txt", "", nil)
+    if resp.statusCode != 403 || resp.body != "Forbidden" {
+        t.Fatalf("expected status 403 got %d %q", resp.statusCode, resp.body)
+    }
+}
+
+func TestClose(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen failed: %s", err)
+    }
+    addr := l.Addr().String()
+    done := make(chan os.Error)
+    go func() { done <- serve("scgi", l) }()
+
+    c, err := net.Dial("tcp", "", addr)
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    c.Write(buildTestScgiRequest("GET", "/slow", "", map[string]string{}).Bytes())
+    //let the request start before shutting down
+    time.Sleep(20e6)
+
+    hookCalled := false
+    OnShutdown(func() { hookCalled = true })
+    defer func() { shutdownHooks = vector.Vector{} }()
+    go Close()
+
+    //the request in flight still gets its response
+    output, _ := ioutil.ReadAll(c)
+    resp := buildTestResponse(bytes.NewBuffer(output))
+    if resp.statusCode != 200 || resp.body != "done" {
+        t.Fatalf("expected the slow request to finish got %d %q", resp.statusCode, resp.body)
+    }
+    if err := <-done; err != nil {
+        t.Fatalf("serve returned an error after Close: %s", err)
+    }
+    if _, err := net.Dial("tcp", "", addr); err == nil {
+        t.Fatalf("a new connection was accepted after Close")
+    }
+    //the hooks run once the requests are done
+    time.Sleep(20e6)
+    if !hookCalled {
+        t.Fatalf("the shutdown hook wasn't called")
+    }
+}
+
+func TestUnixSocket(t *testing.T) {
+    socketPath := "testdata/test.sock"
+    l, err := listen("unix:" + socketPath)
+    if err != nil {
+        t.Fatalf("listen failed: %s", err)
+    }
+    closeListener(l)
+
+    l, err = listenUnix(socketPath, 0600)
+    if err != nil {
+        t.Fatalf("listenUnix failed: %s", err)
+    }
+    if info, err := os.Stat(socketPath); err != nil || info.Mode&0777 != 0600 {
+        t.Fatalf("the socket doesn't have mode 0600")
+    }
+    done := make(chan os.Error)
+    go func() { done <- serve("fcgi", l) }()
+
+    c, err := net.Dial("unix", "", socketPath)
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    c.Write(buildTestFcgiRequest("GET", "/echo/unix", []string{}, map[string]string{}).Bytes())
+    //the fcgi connection is kept open for more records, until Close shuts it
+    time.Sleep(50e6)
+    Close()
+    output, _ := ioutil.ReadAll(c)
+    resp := buildTestResponse(getFcgiOutput(bytes.NewBuffer(output)))
+    if resp.body != "unix" {
+        t.Fatalf("expected %q got %q", "unix", resp.body)
+    }
+    if err := <-done; err != nil {
+        t.Fatalf("serve returned an error after Close: %s", err)
+    }
+    if _, err := os.Lstat(socketPath); err == nil {
+        t.Fatalf("the socket wasn't removed")
+    }
+}
+
+func TestRunMany(t *testing.T) {
+    if err := RunMany(ListenerSpec{Protocol: "gopher", Addr: "127.0.0.1:0"}); err == nil {
+        t.Fatalf("RunMany accepted an unknown protocol")
+    }
+    if err := RunMany(ListenerSpec{Protocol: "scgi", Addr: "unix:testdata/a.sock"}, ListenerSpec{Protocol: "http", Addr: "unix:testdata/missing/b.sock"}); err == nil {
+        t.Fatalf("RunMany accepted a bad address")
+    }
+    if _, err := os.Lstat("testdata/a.sock"); err == nil {
+        t.Fatalf("the first listener wasn't closed")
+    }
+    if err := RunMany(ListenerSpec{"scgi", "unix:testdata/a.sock", "testdata/missing.pem", "testdata/missing.key"}); err == nil {
+        t.Fatalf("RunMany accepted TLS for scgi")
+    }
+
+    done := make(chan os.Error)
+    go func() {
+        done <- RunMany(ListenerSpec{Protocol: "scgi", Addr: "unix:testdata/a.sock"}, ListenerSpec{Protocol: "fcgi", Addr: "unix:testdata/b.sock"})
+    }()
+    time.Sleep(20e6)
+
+    c, err := net.Dial("unix", "", "testdata/a.sock")
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    c.Write(buildTestScgiRequest("GET", "/echo/scgi", "", map[string]string{}).Bytes())
+    output, _ := ioutil.ReadAll(c)
+    if resp := buildTestResponse(bytes.NewBuffer(output)); resp.body != "scgi" {
+        t.Fatalf("expected %q got %q", "scgi", resp.body)
+    }
+
+    c, err = net.Dial("unix", "", "testdata/b.sock")
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    c.Write(buildTestFcgiRequest("GET", "/echo/fcgi", []string{}, map[string]string{}).Bytes())
+    time.Sleep(20e6)
+
+    Close()
+    output, _ = ioutil.ReadAll(c)
+    if resp := buildTestResponse(getFcgiOutput(bytes.NewBuffer(output))); resp.body != "fcgi" {
+        t.Fatalf("expected %q got %q", "fcgi", resp.body)
+    }
+    if err := <-done; err != nil {
+        t.Fatalf("RunMany returned an error after Close: %s", err)
+    }
+}
+
+func TestAccessLog(t *testing.T) {
+    var buf bytes.Buffer
+    SetAccessLog(&buf)
+    defer SetAccessLog(os.Stdout)
+
+    getTestResponse("GET", "/echo/logged?a=1", "", nil)
+    line := buf.String()
+    if !strings.HasPrefix(line, "127.0.0.1 - - [") || !strings.HasSuffix(line, `] "GET /echo/logged?a=1 HTTP/1.1" 200 6`+"\n") {
+        t.Fatalf("unexpected access log line %q", line)
+    }
+
+    //HEAD responses don't send a body
+    buf.Reset()
+    getTestResponse("HEAD", "/echo/logged", "", nil)
+    if line = buf.String(); !strings.HasSuffix(line, `"HEAD /echo/logged HTTP/1.1" 200 0`+"\n") {
+        t.Fatalf("unexpected access log line %q", line)
+    }
+
+    buf.Reset()
+    getTestResponse("GET", "/doesnotexist", "", nil)
+    if line = buf.String(); strings.Index(line, `"GET /doesnotexist HTTP/1.1" 404 `) == -1 {
+        t.Fatalf("unexpected access log line %q", line)
+    }
+
+    defer SetAccessLogFormat(CommonLogFormat)
+    if err := SetAccessLogFormat("{Method} {Path} {Status}\n"); err != nil {
+        t.Fatalf("SetAccessLogFormat failed: %s", err)
+    }
+    buf.Reset()
+    getTestResponse("POST", "/post/echo/x", "", nil)
+    if line = buf.String(); line != "POST /post/echo/x 200\n" {
+        t.Fatalf("unexpected access log line %q", line)
+    }
+
+    SetAccessLogFormat(JSONLogFormat)
+    buf.Reset()
+    getTestResponse("GET", "/echo/json", "", nil)
+    if line = buf.String(); !strings.HasPrefix(line, "{") || strings.Index(line, `"/echo/json"`) == -1 || !strings.HasSuffix(line, "}\n") {
+        t.Fatalf("unexpected access log line %q", line)
+    }
+
+    if SetAccessLogFormat("{Method") == nil {
+        t.Fatalf("SetAccessLogFormat accepted a bad template")
+    }
+
+    SetAccessLog(nil)
+    buf.Reset()
+    getTestResponse("GET", "/echo/quiet", "", nil)
+    if buf.Len() != 0 {
+        t.Fatalf("the access log was written after it was disabled")
+    }
+}
+
+//a logger that keeps the messages, prefixed with their level
+type testLogger struct {
+    messages vector.StringVector
+}
+
+func (l *testLogger) Debugf(format string, v ...interface{}) {
+    l.messages.Push("debug " + fmt.Sprintf(format, v))
+}
+
+func (l *testLogger) Infof(format string, v ...interface{}) {
+    l.messages.Push("info " + fmt.Sprintf(format, v))
+}
+
+func (l *testLogger) Errorf(format string, v ...interface{}) {
+    l.messages.Push("error " + fmt.Sprintf(format, v))
+}
+
+func TestLogger(t *testing.T) {
+    var l testLogger
+    SetLogger(&l)
+    defer SetLogger(nil)
+    defer SetLogLevel(LogInfo)
+
+    if addRoute("/bad(regex", "GET", func() {}) != nil {
+        t.Fatalf("addRoute accepted a bad regex")
+    }
+    logDebugf("hidden")
+    logInfof("shown %d", 1)
+    expected := []string{`error Error in route regex "/bad(regex"`, "info shown 1"}
+    if l.messages.Len() != len(expected) {
+        t.Fatalf("expected %d messages, got %v", len(expected), l.messages.Copy())
+    }
+    for i, msg := range expected {
+        if l.messages.At(i) != msg {
+            t.Fatalf("expected %q got %q", msg, l.messages.At(i))
+        }
+    }
+
+    l.messages.Resize(0, 0)
+    SetLogLevel(LogError)
+    logInfof("hidden")
+    logErrorf("failed")
+    if l.messages.Len() != 1 || l.messages.At(0) != "error failed" {
+        t.Fatalf("unexpected messages %v", l.messages.Copy())
+    }
+
+    SetLogLevel(LogNone)
+    logErrorf("hidden")
+    if l.messages.Len() != 1 {
+        t.Fatalf("unexpected messages %v", l.messages.Copy())
+    }
+}
+
+func TestTimingHeader(t *testing.T) {
+    AddTimingHeader(true)
+    defer AddTimingHeader(false)
+
+    for _, path := range []string{"/echo/timed", "/buffer/status"} {
+        resp := getTestResponse("GET", path, "", nil)
+        timing, ok := resp.headers["X-Response-Time"]
+        if !ok || len(timing) != 1 || !strings.HasSuffix(timing[0], "ms") {
+            t.Fatalf("%s: bad X-Response-Time %v", path, timing)
+        }
+    }
+
+    //the headers of a flushed response were sent before the handler returned
+    resp := getTestResponse("GET", "/buffer/flush", "", nil)
+    if _, ok := resp.headers["X-Response-Time"]; ok {
+        t.Fatalf("X-Response-Time was added to a flushed response")
+    }
+}
+
+func TestSlowRequest(t *testing.T) {
+    var l testLogger
+    SetLogger(&l)
+    defer SetLogger(nil)
+    SetSlowRequestThreshold(10)
+    defer SetSlowRequestThreshold(0)
+
+    getTestResponse("GET", "/echo/fast", "", nil)
+    if l.messages.Len() != 0 {
+        t.Fatalf("unexpected messages %v", l.messages.Copy())
+    }
+    getTestResponse("GET", "/slow", "", nil)
+    if l.messages.Len() != 1 || !strings.HasPrefix(l.messages.At(0), "error Slow request: GET /slow took ") {
+        t.Fatalf("unexpected messages %v", l.messages.Copy())
+    }
+}
+
+func TestStats(t *testing.T) {
+    before := Stats()
+    getTestResponse("GET", "/echo/a", "", nil)
+    getTestResponse("GET", "/echo/bc", "", nil)
+    getTestResponse("GET", "/doesnotexist", "", nil)
+    after := Stats()
+
+    if after.Requests-before.Requests != 3 {
+        t.Fatalf("expected 3 requests, got %d", after.Requests-before.Requests)
+    }
+    if after.Responses["2xx"]-before.Responses["2xx"] != 2 || after.Responses["4xx"]-before.Responses["4xx"] != 1 {
+        t.Fatalf("unexpected responses %v, before %v", after.Responses, before.Responses)
+    }
+    if after.Bytes-before.Bytes < 3 {
+        t.Fatalf("expected at least 3 bytes, got %d", after.Bytes-before.Bytes)
+    }
+    if after.Routes["GET /echo/(.*)"].Hits-before.Routes["GET /echo/(.*)"].Hits != 2 {
+        t.Fatalf("unexpected route stats %v", after.Routes)
+    }
+    if _, ok := after.Routes["GET /doesnotexist"]; ok {
+        t.Fatalf("a request without a route was counted as a route")
+    }
+
+    EnableStatsEndpoint("/debug/webgo-stats")
+    resp := getTestResponse("GET", "/debug/webgo-stats", "", nil)
+    ct, ok := resp.headers["Content-Type"]
+    if !ok || len(ct) != 1 || !strings.HasPrefix(ct[0], "application/json") || !strings.HasPrefix(resp.body, "{") {
+        t.Fatalf("unexpected stats response %v %q", ct, resp.body)
+    }
+}
+
+func TestHandlerTimeout(t *testing.T) {
+    before := Stats()
+
+    var buf bytes.Buffer
+    c := scgiConn{wroteHeaders: false, headers: make(map[string][]string), fd: &tcpBuffer{nil, &buf}}
+    routeHandler(buildTestRequest("GET", "/timeout", "", nil), &c)
+    resp := buildTestResponse(bytes.NewBufferString(buf.String()))
+    if resp.statusCode != 503 || resp.body != "Service Unavailable" {
+        t.Fatalf("expected a 503, got %d %q", resp.statusCode, resp.body)
+    }
+
+    //the handler's output is dropped once it finishes
+    output := buf.String()
+    time.Sleep(60e6)
+    if buf.String() != output {
+        t.Fatalf("the handler wrote after it timed out: %q", buf.String())
+    }
+
+    if Stats().TimedOut-before.TimedOut != 1 {
+        t.Fatalf("the timeout wasn't counted")
+    }
+
+    //the handler keeps its slot and stays in flight until it returns
+    SetMaxConcurrentRequests(1, 0)
+    getTestResponse("GET", "/timeout", "", nil)
+    inflight := requestsInFlight()
+    blocked := getTestResponse("GET", "/echo/blocked", "", nil)
+    time.Sleep(60e6)
+    after := requestsInFlight()
+    resp = getTestResponse("GET", "/echo/free", "", nil)
+    SetMaxConcurrentRequests(0, 0)
+    if inflight != 1 || after != 0 {
+        t.Fatalf("expected 1 request in flight then 0, got %d and %d", inflight, after)
+    }
+    if blocked.statusCode != 503 || resp.statusCode != 200 {
+        t.Fatalf("expected the slot to be held until the handler returned, got %d then %d", blocked.statusCode, resp.statusCode)
+    }
+
+    SetHandlerTimeout(5)
+    defer SetHandlerTimeout(0)
+    if resp = getTestResponse("GET", "/slow", "", nil); resp.statusCode != 503 {
+        t.Fatalf("expected a 503, got %d", resp.statusCode)
+    }
+    if resp = getTestResponse("GET", "/echo/quick", "", nil); resp.statusCode != 200 || resp.body != "quick" {
+        t.Fatalf("expected 200 quick, got %d %q", resp.statusCode, resp.body)
+    }
+}
+
+//builds a masked client frame
+func buildWebSocketFrame(fin bool, opcode byte, data []byte) []byte {
+    mask := []byte{1, 2, 3, 4}
+    frame := []byte{opcode, 0x80 | byte(len(data)), 1, 2, 3, 4}
+    if fin {
+        frame[0] |= 0x80
+    }
+    var buf bytes.Buffer
+    buf.Write(frame)
+    for i, b := range data {
+        buf.WriteByte(b ^ mask[i%4])
+    }
+    return buf.Bytes()
+}
+
+func TestWebSocket(t *testing.T) {
+    if webSocketAccept("dGhlIHNhbXBsZSBub25jZQ==") != "s3pPLMBiTxaQ9kYGOJizWAHlc+o=" {
+        t.Fatalf("bad Sec-WebSocket-Accept %q", webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+    }
+
+    //a plain request isn't upgraded
+    resp := getTestResponse("GET", "/ws/echo", "", nil)
+    if resp.statusCode != 400 {
+        t.Fatalf("expected a 400, got %d", resp.statusCode)
+    }
+
+    //an open socket doesn't hold a request slot
+    SetMaxConcurrentRequests(1, 0)
+    defer SetMaxConcurrentRequests(0, 0)
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen failed: %s", err)
+    }
+    go serve("http", l)
+    defer stopListener(l)
+
+    c, err := net.Dial("tcp", "", l.Addr().String())
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+    c.Write([]byte("GET /ws/echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+        "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+    expected := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+        "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGOJizWAHlc+o=\r\n\r\n"
+    handshake := make([]byte, len(expected))
+    if _, err = io.ReadFull(c, handshake); err != nil || string(handshake) != expected {
+        t.Fatalf("bad handshake %q %v", handshake, err)
+    }
+    time.Sleep(10e6)
+    if n := requestsInFlight(); n != 0 {
+        t.Fatalf("expected the socket not to count as in flight, got %d", n)
+    }
+    if resp = getTestResponse("GET", "/echo/next", "", nil); resp.statusCode != 200 {
+        t.Fatalf("expected the socket to release its slot, got %d", resp.statusCode)
+    }
+
+    //a fragmented message, with a ping in the middle
+    c.Write(buildWebSocketFrame(false, TextMessage, []byte("hel")))
+    c.Write(buildWebSocketFrame(true, wsPing, []byte("p")))
+    c.Write(buildWebSocketFrame(true, wsContinuation, []byte("lo")))
+    reply := make([]byte, 10)
+    if _, err = io.ReadFull(c, reply); err != nil {
+        t.Fatalf("read failed: %s", err)
+    }
+    if string(reply) != "\x8a\x01p\x81\x05hello" {
+        t.Fatalf("unexpected reply %q", reply)
+    }
+
+    c.Write(buildWebSocketFrame(true, wsClose, []byte{0x03, 0xe8}))
+    reply = make([]byte, 4)
+    if _, err = io.ReadFull(c, reply); err != nil || string(reply) != "\x88\x02\x03\xe8" {
+        t.Fatalf("unexpected close frame %q %v", reply, err)
+    }
+}
+
+//reads a record written by the fcgi server
+func readFcgiRecord(r io.Reader) (h fcgiHeader, content []byte, err os.Error) {
+    if err = binary.Read(r, binary.BigEndian, &h); err != nil {
+        return
+    }
+    content = make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+    if _, err = io.ReadFull(r, content); err != nil {
+        return
+    }
+    content = content[0:h.ContentLength]
+    return
+}
+
+func TestFcgiRecords(t *testing.T) {
+    go listenAndServeFcgi("unix:testdata/c.sock")
+    defer Close()
+    time.Sleep(20e6)
+
+    c, err := net.Dial("unix", "", "testdata/c.sock")
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+
+    c.Write(newFcgiRecord(fcgiGetValues, 0, buildFcgiKeyValue("FCGI_MPXS_CONNS", "")))
+    h, content, err := readFcgiRecord(c)
+    if err != nil || h.Type != fcgiGetValuesResult || string(content) != string(buildFcgiKeyValue("FCGI_MPXS_CONNS", "1")) {
+        t.Fatalf("bad FCGI_GET_VALUES result %v %q %v", h, content, err)
+    }
+
+    c.Write(newFcgiRecord(42, 0, []byte{}))
+    if h, content, err = readFcgiRecord(c); err != nil || h.Type != fcgiUnknownType || content[0] != 42 {
+        t.Fatalf("bad FCGI_UNKNOWN_TYPE %v %q %v", h, content, err)
+    }
+
+    //two requests interleaved on a connection that's kept open
+    for _, id := range []int{1, 2} {
+        c.Write(newFcgiRecord(fcgiBeginRequest, id, []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}))
+    }
+    for _, id := range []int{2, 1} {
+        params := map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": fmt.Sprintf("/echo/req%d", id), "HTTP_HOST": "127.0.0.1", "SERVER_PORT": "80"}
+        var buf bytes.Buffer
+        for k, v := range params {
+            buf.Write(buildFcgiKeyValue(k, v))
+        }
+        c.Write(newFcgiRecord(fcgiParams, id, buf.Bytes()))
+    }
+    for _, id := range []int{1, 2} {
+        c.Write(newFcgiRecord(fcgiParams, id, []byte{}))
+        c.Write(newFcgiRecord(fcgiStdin, id, []byte{}))
+    }
+
+    outputs := map[uint16]*bytes.Buffer{1: new(bytes.Buffer), 2: new(bytes.Buffer)}
+    for ended := 0; ended < 2; {
+        if h, content, err = readFcgiRecord(c); err != nil {
+            t.Fatalf("read failed: %s", err)
+        }
+        switch h.Type {
+        case fcgiStdout:
+            outputs[h.RequestId].Write(content)
+        case fcgiEndRequest:
+            if content[4] != fcgiRequestComplete {
+                t.Fatalf("bad FCGI_END_REQUEST for %d: %v", h.RequestId, content)
+            }
+            ended++
+        }
+    }
+    for id, output := range outputs {
+        if resp := buildTestResponse(output); resp.body != fmt.Sprintf("req%d", id) {
+            t.Fatalf("request %d: expected %q got %q", id, fmt.Sprintf("req%d", id), resp.body)
+        }
+    }
+
+    //an unknown role is refused
+    c.Write(newFcgiRecord(fcgiBeginRequest, 3, []byte{0, 2, fcgiKeepConn, 0, 0, 0, 0, 0}))
+    if h, content, err = readFcgiRecord(c); err != nil || h.Type != fcgiEndRequest || h.RequestId != 3 || content[4] != fcgiUnknownRole {
+        t.Fatalf("bad FCGI_END_REQUEST for an unknown role %v %v %v", h, content, err)
+    }
+
+    //without FCGI_KEEP_CONN, the connection is closed after the request
+    c.Write(buildTestFcgiRequest("GET", "/echo/last", []string{}, nil).Bytes())
+    output, _ := ioutil.ReadAll(c)
+    if resp := buildTestResponse(getFcgiOutput(bytes.NewBuffer(output))); resp.body != "last" {
+        t.Fatalf("expected %q got %q", "last", resp.body)
+    }
+}
+
+//a connection that hands out its input a byte at a time, like a request split
+//across many reads
+type dribbleConn struct {
+    tcpBuffer
+}
+
+func (c *dribbleConn) Read(p []byte) (n int, err os.Error) {
+    if len(p) > 1 {
+        p = p[0:1]
+    }
+    return c.input.Read(p)
+}
+
+func TestScgiDribble(t *testing.T) {
+    body := "a=12&b=" + strings.Repeat("1234567890", 10000)
+    req := buildTestScgiRequest("POST", "/post/echoparam/b", body, make(map[string]string))
+    var output bytes.Buffer
+    handleScgiRequest(&dribbleConn{tcpBuffer{input: req, output: &output}})
+    resp := buildTestResponse(&output)
+    if resp.statusCode != 200 || resp.body != strings.Repeat("1234567890", 10000) {
+        t.Fatalf("the dribbled request failed: %d %d bytes", resp.statusCode, len(resp.body))
+    }
+}
+
+func TestScgiMalformed(t *testing.T) {
+    inputs := []string{
+        "abc:CONTENT_LENGTH\x000\x00,",
+        "20:CONTENT_LENGTH\x000\x00,",
+        "17:CONTENT_LENGTH\x000\x00;",
+        "19:REQUEST_METHOD\x00GET\x00,",
+        "18:CONTENT_LENGTH\x00-1\x00,",
+        "16:CONTENT_LENGTH\x000,",
+        fmt.Sprintf("%d:", maxScgiHeaderSize+1),
+        "99999999999999999999:",
+    }
+    for _, input := range inputs {
+        var output bytes.Buffer
+        handleScgiRequest(&tcpBuffer{input: bytes.NewBufferString(input), output: &output})
+        if resp := buildTestResponse(&output); resp.statusCode != 400 {
+            t.Fatalf("%q: expected a 400, got %d", input, resp.statusCode)
+        }
+    }
+
+    //a connection closed without a request gets no response
+    var output bytes.Buffer
+    handleScgiRequest(&tcpBuffer{input: new(bytes.Buffer), output: &output})
+    if output.Len() != 0 {
+        t.Fatalf("unexpected response %q", output.String())
+    }
+}
+
+func TestCgi(t *testing.T) {
+    env := map[string]string{
+        "REQUEST_METHOD":  "POST",
+        "SCRIPT_NAME":     "/cgi-bin/app.cgi",
+        "PATH_INFO":       "/post/echoparam/a",
+        "QUERY_STRING":    "b=2",
+        "CONTENT_LENGTH":  "4",
+        "CONTENT_TYPE":    "application/x-www-form-urlencoded",
+        "SERVER_NAME":     "example.com",
+        "SERVER_PORT":     "80",
+        "SERVER_PROTOCOL": "HTTP/1.1",
+    }
+    var output bytes.Buffer
+    serveCgi(env, bytes.NewBufferString("a=12 and more"), &output)
+
+    response := output.String()
+    if !strings.HasPrefix(response, "Status: 200 OK\r\n") {
+        t.Fatalf("bad CGI response %q", response)
+    }
+    if !strings.HasSuffix(response, "\r\n\r\n12") {
+        t.Fatalf("expected the body %q, got %q", "12", response)
+    }
+
+    //PATH_INFO is decoded, so its % ? and # are part of the path
+    for _, path := range []string{"/echo/100%", "/echo/a?b", "/echo/a#b"} {
+        output.Reset()
+        serveCgi(map[string]string{"REQUEST_METHOD": "GET", "PATH_INFO": path, "SERVER_NAME": "example.com", "SERVER_PORT": "80"}, new(bytes.Buffer), &output)
+        if response = output.String(); !strings.HasSuffix(response, "\r\n\r\n"+path[6:]) {
+            t.Fatalf("%s: expected the body %q, got %q", path, path[6:], response)
+        }
+    }
+
+    //a request with a url that can't be parsed gets a 400
+    req := buildTestScgiRequest("GET", "/echo/%zz", "", nil)
+    output.Reset()
+    handleScgiRequest(&tcpBuffer{input: req, output: &output})
+    if resp := buildTestResponse(&output); resp.statusCode != 400 {
+        t.Fatalf("expected a 400 for a bad url got %d", resp.statusCode)
+    }
+
+    //without PATH_INFO, the script itself was requested
+    output.Reset()
+    serveCgi(map[string]string{"REQUEST_METHOD": "GET", "SERVER_NAME": "example.com", "SERVER_PORT": "80"}, new(bytes.Buffer), &output)
+    if response = output.String(); !strings.HasSuffix(response, "\r\n\r\nindex") {
+        t.Fatalf("expected the index, got %q", response)
+    }
+}
+
+func TestURLPrefix(t *testing.T) {
+    SetURLPrefix("myapp/")
+    defer SetURLPrefix("")
+
+    if resp := getTestResponse("GET", "/myapp/echo/x", "", nil); resp.body != "x" {
+        t.Fatalf("expected %q got %q", "x", resp.body)
+    }
+    //the proxy may strip the prefix itself
+    if resp := getTestResponse("GET", "/echo/y", "", nil); resp.body != "y" {
+        t.Fatalf("expected %q got %q", "y", resp.body)
+    }
+    if resp := getTestResponse("GET", "/myapp", "", nil); resp.body != "index" {
+        t.Fatalf("expected %q got %q", "index", resp.body)
+    }
+    resp := getTestResponse("GET", "/myapp/redirect/permanent", "", nil)
+    if resp.statusCode != 301 || resp.headers["Location"][0] != "/myapp/echo/a" {
+        t.Fatalf("bad redirect %d %v", resp.statusCode, resp.headers["Location"])
+    }
+
+    //without the setting, SCRIPT_NAME is used
+    SetURLPrefix("")
+    req := buildTestScgiRequest("GET", "/app/redirect/temporary", "", map[string]string{"SCRIPT_NAME": "/app"})
+    var output bytes.Buffer
+    handleScgiRequest(&tcpBuffer{input: req, output: &output})
+    resp = buildTestResponse(&output)
+    if resp.statusCode != 302 || resp.headers["Location"][0] != "/app/echo/a" {
+        t.Fatalf("bad redirect %d %v", resp.statusCode, resp.headers["Location"])
+    }
+
+    //a SCRIPT_NAME of the whole path, like nginx's stock fastcgi_params set, isn't a prefix
+    for _, path := range []string{"/echo/z", "/echo/z?q=1"} {
+        req = buildTestScgiRequest("GET", path, "", map[string]string{"SCRIPT_NAME": "/echo/z"})
+        output.Reset()
+        handleScgiRequest(&tcpBuffer{input: req, output: &output})
+        if resp = buildTestResponse(&output); resp.body != "z" {
+            t.Fatalf("%s: expected %q got %q", path, "z", resp.body)
+        }
+    }
+
+    //X-Forwarded-Prefix is only honored from trusted proxies
+    headers := map[string]string{"X-Forwarded-Prefix": "/proxied"}
+    resp = getTestResponse("GET", "/redirect/permanent", "", headers)
+    if resp.headers["Location"][0] != "/echo/a" {
+        t.Fatalf("X-Forwarded-Prefix from an untrusted client was used: %v", resp.headers["Location"])
+    }
+    SetTrustedProxies([]string{"127.0.0.1"})
+    defer SetTrustedProxies([]string{})
+    resp = getTestResponse("GET", "/redirect/permanent", "", headers)
+    if resp.headers["Location"][0] != "/proxied/echo/a" {
+        t.Fatalf("bad redirect %v", resp.headers["Location"])
+    }
+}
+
+func TestDefaultHeaders(t *testing.T) {
+    SetDefaultHeaders(map[string]string{"server": "", "Content-Type": "application/json", "X-Frame-Options": "DENY"})
+    defer SetDefaultHeaders(map[string]string{"Server": "web.go", "Content-Type": "text/html; charset=utf-8", "X-Frame-Options": ""})
+
+    resp := getTestResponse("GET", "/echo/x", "", nil)
+    if _, ok := resp.headers["Server"]; ok {
+        t.Fatalf("the Server header was sent")
+    }
+    if resp.headers["Content-Type"][0] != "application/json" || resp.headers["X-Frame-Options"][0] != "DENY" {
+        t.Fatalf("unexpected headers %v", resp.headers)
+    }
+    if !strings.HasSuffix(resp.headers["Date"][0], " GMT") {
+        t.Fatalf("the Date isn't in GMT: %q", resp.headers["Date"][0])
+    }
+
+    //handlers can still override them
+    resp = getTestResponse("GET", "/json", "", nil)
+    if !strings.HasPrefix(resp.headers["Content-Type"][0], "application/json; charset=utf-8") {
+        t.Fatalf("unexpected Content-Type %v", resp.headers["Content-Type"])
+    }
+
+    //the headers a request is using aren't changed under it
+    inUse := defaultHeaderList()
+    SetDefaultHeaders(map[string]string{"X-Added": "1"})
+    defer SetDefaultHeaders(map[string]string{"X-Added": ""})
+    if _, ok := inUse["X-Added"]; ok {
+        t.Fatalf("the default headers were changed in place")
+    }
+    if resp = getTestResponse("GET", "/echo/x", "", nil); resp.headers["X-Added"][0] != "1" {
+        t.Fatalf("the new default header wasn't sent: %v", resp.headers)
+    }
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+    SetMaxConcurrentRequests(1, 1)
+    defer SetMaxConcurrentRequests(0, 0)
+    before := Stats()
+
+    //one request runs, one waits, and the third is refused
+    results := make(chan int, 2)
+    for i := 0; i < 2; i++ {
+        go func() { results <- getTestResponse("GET", "/slow", "", nil).statusCode }()
+    }
+    time.Sleep(5e6)
+    if waiting := Stats().Waiting; waiting != 1 {
+        t.Fatalf("expected 1 waiting request, got %d", waiting)
+    }
+    resp := getTestResponse("GET", "/echo/refused", "", nil)
+    if resp.statusCode != 503 || resp.headers["Retry-After"][0] != "1" {
+        t.Fatalf("expected a 503 with Retry-After, got %d %v", resp.statusCode, resp.headers)
+    }
+    for i := 0; i < 2; i++ {
+        if status := <-results; status != 200 {
+            t.Fatalf("expected 200 got %d", status)
+        }
+    }
+    if Stats().Rejected-before.Rejected != 1 {
+        t.Fatalf("the refused request wasn't counted")
+    }
+
+    //static files aren't limited
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+    go getTestResponse("GET", "/slow", "", nil)
+    go getTestResponse("GET", "/slow", "", nil)
+    time.Sleep(5e6)
+    if resp = getTestResponse("GET", "/hello.txt", "", nil); resp.statusCode != 200 {
+        t.Fatalf("expected 200 for a static file, got %d", resp.statusCode)
+    }
+    time.Sleep(50e6)
+}
+
+func TestDebugEndpoints(t *testing.T) {
+    if resp := getTestResponse("GET", "/internal/debug/vars", "", nil); resp.statusCode != 404 {
+        t.Fatalf("the debug endpoints exist before they are enabled")
+    }
+
+    EnableDebugEndpoints("/internal/debug", nil)
+    resp := getTestResponse("GET", "/internal/debug/vars", "", nil)
+    if resp.statusCode != 200 || !strings.HasPrefix(resp.body, "{") || strings.Index(resp.body, `"webgo": {`) == -1 {
+        t.Fatalf("unexpected vars %d %q", resp.statusCode, resp.body)
+    }
+    if resp = getTestResponse("GET", "/internal/debug/heap", "", nil); resp.statusCode != 200 || len(resp.body) == 0 {
+        t.Fatalf("unexpected heap profile %d %q", resp.statusCode, resp.body)
+    }
+
+    //a local proxy that isn't trusted doesn't make its clients local
+    for _, header := range []string{"X-Forwarded-For", "X-Real-Ip"} {
+        resp = getTestResponse("GET", "/internal/debug/vars", "", map[string]string{header: "127.0.0.1"})
+        if resp.statusCode != 403 {
+            t.Fatalf("expected a 403 for a request with %s, got %d", header, resp.statusCode)
+        }
+    }
+    SetTrustedProxies([]string{"127.0.0.1"})
+    resp = getTestResponse("GET", "/internal/debug/vars", "", map[string]string{"X-Forwarded-For": "127.0.0.1"})
+    SetTrustedProxies(nil)
+    if resp.statusCode != 200 {
+        t.Fatalf("expected a trusted proxy to forward a local client, got %d", resp.statusCode)
+    }
+
+    EnableDebugEndpoints("/remote.debug/", []string{"10.0.0.1"})
+    if resp = getTestResponse("GET", "/remote.debug/memstats", "", nil); resp.statusCode != 403 {
+        t.Fatalf("expected a 403 got %d", resp.statusCode)
+    }
+    if resp = getTestResponse("GET", "/remoteXdebug/memstats", "", nil); resp.statusCode != 404 {
+        t.Fatalf("the prefix wasn't escaped")
+    }
+}
+
+func TestTestRequest(t *testing.T) {
+    resp := TestRequest("GET", "/echo/recorded", nil, nil)
+    if resp.Status != 200 || string(resp.Body) != "recorded" || resp.Headers["Content-Length"][0] != "8" {
+        t.Fatalf("unexpected response %d %q %v", resp.Status, resp.Body, resp.Headers)
+    }
+
+    headers := map[string]string{"content-type": "application/x-www-form-urlencoded"}
+    if resp = TestRequest("POST", "/post/echoparam/a", headers, []byte("a=12")); string(resp.Body) != "12" {
+        t.Fatalf("expected %q got %q", "12", resp.Body)
+    }
+
+    SetCookieSecret("7C19QRmwf3mHZ9CPAaPQ0hsWeufKd")
+    resp = TestRequest("POST", "/securecookie/set/a/1", nil, nil)
+    if _, ok := resp.Cookies["a"]; !ok {
+        t.Fatalf("the cookie wasn't recorded: %v", resp.Headers)
+    }
+    resp = TestRequest("GET", "/securecookie/get/a", map[string]string{"Cookie": "a=" + resp.Cookies["a"]}, nil)
+    if string(resp.Body) != "1" {
+        t.Fatalf("expected %q got %q", "1", resp.Body)
+    }
+
+    //static files are served too
+    oldStaticDir := staticDir
+    staticDir = "testdata/static"
+    defer func() { staticDir = oldStaticDir }()
+    if resp = TestRequest("GET", "/hello.txt", nil, nil); string(resp.Body) != "hello static\n" {
+        t.Fatalf("expected the static file, got %d %q", resp.Status, resp.Body)
+    }
+    if resp = TestRequest("GET", "/missing.txt", nil, nil); resp.Status != 404 {
+        t.Fatalf("expected a 404 got %d", resp.Status)
+    }
+}
+
+func TestStart(t *testing.T) {
+    started := make(chan string, 10)
+    failing := true
+    OnStart(func(addr string) {
+        if failing {
+            panic("failing hook")
+        }
+    })
+    OnStart(func(addr string) {
+        select {
+        case started <- addr:
+        default:
+        }
+    })
+
+    stop, err := Start("127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Start failed: %s", err)
+    }
+    defer stop()
+    addr := <-started
+    failing = false
+    if !strings.HasPrefix(addr, "127.0.0.1:") || addr == "127.0.0.1:0" {
+        t.Fatalf("the hook got %q instead of the bound address", addr)
+    }
+
+    c, err := net.Dial("tcp", "", addr)
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+    c.Write([]byte("GET /echo/started HTTP/1.0\r\n\r\n"))
+    output, _ := ioutil.ReadAll(c)
+    if !strings.HasSuffix(string(output), "\r\n\r\nstarted") {
+        t.Fatalf("unexpected response %q", output)
+    }
+
+    if _, err = Start(addr); err == nil {
+        t.Fatalf("Start succeeded on an address in use")
+    }
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+    hooked := false
+    OnStart(func(addr string) {
+        if strings.HasSuffix(addr, "redirect.sock") {
+            hooked = true
+        }
+    })
+    //a config the application wouldn't start with doesn't stop the redirects
+    SetConfig("security", "cookieSecretFile", "testdata/missing.key")
+    defer func() { configValues = make(map[string]map[string]string) }()
+
+    if err := RedirectToHTTPS("unix:testdata/redirect.sock", "secure.example.com:8443"); err != nil {
+        t.Fatalf("RedirectToHTTPS failed: %s", err)
+    }
+    defer Close()
+    time.Sleep(20e6)
+    if hooked {
+        t.Fatalf("the OnStart hooks were run for the redirect listener")
+    }
+    if err := RedirectToHTTPS("unix:testdata/missing/redirect.sock", ""); err == nil {
+        t.Fatalf("RedirectToHTTPS didn't return the listen error")
+    }
+
+    c, err := net.Dial("unix", "", "testdata/redirect.sock")
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+    //the route exists, but isn't used
+    c.Write([]byte("GET /echo/a?b=1&c=2 HTTP/1.0\r\nHost: example.com\r\n\r\n"))
+    output, _ := ioutil.ReadAll(c)
+    resp := buildTestResponse(bytes.NewBuffer(output))
+    if resp.statusCode != 301 || resp.headers["Location"][0] != "https://secure.example.com:8443/echo/a?b=1&c=2" {
+        t.Fatalf("bad redirect %d %v", resp.statusCode, resp.headers)
+    }
+}
+
+func TestHSTS(t *testing.T) {
+    EnableHSTS(31536000, true)
+    defer EnableHSTS(0, false)
+
+    var output bytes.Buffer
+    req := buildTestScgiRequest("GET", "/echo/a", "", map[string]string{"HTTPS": "on"})
+    handleScgiRequest(&tcpBuffer{input: req, output: &output})
+    resp := buildTestResponse(&output)
+    if hsts, ok := resp.headers["Strict-Transport-Security"]; !ok || hsts[0] != "max-age=31536000; includeSubDomains" {
+        t.Fatalf("bad Strict-Transport-Security %v", resp.headers)
+    }
+
+    //plain http, and a spoofed X-Forwarded-Proto
+    headers := map[string]string{"X-Forwarded-Proto": "https"}
+    if _, ok := getTestResponse("GET", "/echo/a", "", headers).headers["Strict-Transport-Security"]; ok {
+        t.Fatalf("Strict-Transport-Security was sent over http")
+    }
+
+    SetTrustedProxies([]string{"127.0.0.1"})
+    defer SetTrustedProxies([]string{})
+    if _, ok := getTestResponse("GET", "/echo/a", "", headers).headers["Strict-Transport-Security"]; !ok {
+        t.Fatalf("X-Forwarded-Proto from a trusted proxy was ignored")
+    }
+}
+
+func TestReplaceRoutes(t *testing.T) {
+    routesLock.RLock()
+    oldRoutes, oldMounts := routes, staticMounts
+    routesLock.RUnlock()
+    defer func() {
+        routesLock.Lock()
+        routes, staticMounts = oldRoutes, oldMounts
+        routesLock.Unlock()
+    }()
+
+    //a failed registration keeps the current routes
+    err := ReplaceRoutes(func(r *RouteRegistrar) {
+        r.Get("/replaced", func() string { return "replaced" })
+        r.Static("/missing", "testdata/missing")
+    })
+    if err == nil {
+        t.Fatalf("ReplaceRoutes accepted a missing static directory")
+    }
+    if resp := getTestResponse("GET", "/echo/a", "", nil); resp.statusCode != 200 || resp.body != "a" {
+        t.Fatalf("routes changed after a failed ReplaceRoutes: %d %q", resp.statusCode, resp.body)
+    }
+    if err = ReplaceRoutes(func(r *RouteRegistrar) { r.Get("/(", func() {}) }); err == nil {
+        t.Fatalf("ReplaceRoutes accepted a bad regex")
+    }
+    if err = ReplaceRoutes(func(r *RouteRegistrar) { panic("oops") }); err == nil {
+        t.Fatalf("ReplaceRoutes ignored a panic")
+    }
+
+    err = ReplaceRoutes(func(r *RouteRegistrar) {
+        r.Get("/replaced", func() string { return "replaced" })
+        r.StaticFromMap("/assets", map[string][]byte{"a.txt": []byte("asset")})
+    })
+    if err != nil {
+        t.Fatalf("ReplaceRoutes failed: %s", err)
+    }
+    if resp := getTestResponse("GET", "/replaced", "", nil); resp.body != "replaced" {
+        t.Fatalf("new route not served: %d %q", resp.statusCode, resp.body)
+    }
+    if resp := getTestResponse("GET", "/assets/a.txt", "", nil); resp.body != "asset" {
+        t.Fatalf("new static mount not served: %d %q", resp.statusCode, resp.body)
+    }
+    if resp := getTestResponse("GET", "/echo/a", "", nil); resp.statusCode != 404 {
+        t.Fatalf("old route still served: %d", resp.statusCode)
+    }
+}
+
+func TestHijack(t *testing.T) {
+    var output bytes.Buffer
+    req := buildTestScgiRequest("GET", "/hijack", "", map[string]string{})
+    handleScgiRequest(&tcpBuffer{input: req, output: &output})
+    if resp := buildTestResponse(&output); resp.body != errHijackUnsupported.String() {
+        t.Fatalf("scgi connection was hijacked: %q", resp.body)
+    }
+
+    var buf bytes.Buffer
+    SetAccessLog(&buf)
+    defer SetAccessLog(os.Stdout)
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen failed: %s", err)
+    }
+    go serve("http", l)
+    defer stopListener(l)
+
+    c, err := net.Dial("tcp", "", l.Addr().String())
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+    //the line is sent along with the request, so the server has buffered it
+    c.Write([]byte("GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\nping\n"))
+    reply, _ := ioutil.ReadAll(c)
+    if string(reply) != "hijacked ping\n" {
+        t.Fatalf("bad reply %q", reply)
+    }
+
+    time.Sleep(20e6)
+    if !strings.HasSuffix(buf.String(), `"GET /hijack HTTP/1.1" hijacked 0`+"\n") {
+        t.Fatalf("bad access log %q", buf.String())
+    }
+}
+
+func TestBaseURL(t *testing.T) {
+    headers := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com", "X-Forwarded-Port": "443"}
+    req := buildTestRequest("GET", "/baseurl", "", headers)
+    req.Host = "backend:8080"
+    if resp := getTestResponseFromRequest(req); resp.body != "http://backend:8080" {
+        t.Fatalf("forwarding headers from an untrusted client were used: %q", resp.body)
+    }
+
+    SetTrustedProxies([]string{"127.0.0.0/8"})
+    defer SetTrustedProxies(nil)
+    req = buildTestRequest("GET", "/baseurl", "", headers)
+    req.Host = "backend:8080"
+    if resp := getTestResponseFromRequest(req); resp.body != "https://example.com" {
+        t.Fatalf("bad base url %q", resp.body)
+    }
+
+    headers["X-Forwarded-Port"] = "8443"
+    headers["X-Forwarded-Prefix"] = "/app"
+    req = buildTestRequest("GET", "/app/redirect/permanent", "", headers)
+    resp := getTestResponseFromRequest(req)
+    if resp.headers["Location"][0] != "https://example.com:8443/app/echo/a" {
+        t.Fatalf("bad redirect %v", resp.headers["Location"])
+    }
+
+    //a host that would change the URL is ignored
+    headers = map[string]string{"X-Forwarded-Host": "evil.com/x"}
+    req = buildTestRequest("GET", "/baseurl", "", headers)
+    req.Host = "backend:8080"
+    if resp = getTestResponseFromRequest(req); resp.body != "http://backend:8080" {
+        t.Fatalf("bad base url %q", resp.body)
+    }
+
+    if _, ok := parseTrustedNet("10.0.0.0/33"); ok {
+        t.Fatalf("accepted an invalid prefix length")
+    }
+}
+
+func TestReopenLogs(t *testing.T) {
+    defer os.Remove("testdata/access.log")
+    defer os.Remove("testdata/access.log.1")
+    if err := SetAccessLogFile("testdata/access.log"); err != nil {
+        t.Fatalf("SetAccessLogFile failed: %s", err)
+    }
+    defer SetAccessLog(os.Stdout)
+
+    getTestResponse("GET", "/echo/a", "", nil)
+    if err := os.Rename("testdata/access.log", "testdata/access.log.1"); err != nil {
+        t.Fatalf("rename failed: %s", err)
+    }
+    if err := ReopenLogs(); err != nil {
+        t.Fatalf("ReopenLogs failed: %s", err)
+    }
+    getTestResponse("GET", "/echo/b", "", nil)
+
+    rotated, _ := ioutil.ReadFile("testdata/access.log.1")
+    current, _ := ioutil.ReadFile("testdata/access.log")
+    if strings.Count(string(rotated), "\n") != 1 || strings.Index(string(rotated), "/echo/a") == -1 {
+        t.Fatalf("bad rotated log %q", rotated)
+    }
+    if strings.Count(string(current), "\n") != 1 || strings.Index(string(current), "/echo/b") == -1 {
+        t.Fatalf("bad reopened log %q", current)
+    }
+}
+
+func TestLogConfig(t *testing.T) {
+    defer os.Remove("testdata/config_access.log")
+    defer os.Remove("testdata/config_error.log")
+    SetConfig("log", "access", "testdata/config_access.log")
+    SetConfig("log", "error", "testdata/config_error.log")
+    defer SetConfig("log", "access", "")
+    defer SetConfig("log", "error", "")
+    for _, p := range ValidateConfig() {
+        if strings.Index(p.String(), "log.") != -1 {
+            t.Fatalf("unexpected config problem %s", p)
+        }
+    }
+    err := applyLogConfig()
+    defer SetAccessLog(os.Stdout)
+    defer SetLogger(nil)
+    if err != nil {
+        t.Fatalf("applyLogConfig failed: %s", err)
+    }
+
+    getTestResponse("GET", "/echo/logged", "", nil)
+    logErrorf("config error log")
+    access, _ := ioutil.ReadFile("testdata/config_access.log")
+    errors, _ := ioutil.ReadFile("testdata/config_error.log")
+    if strings.Index(string(access), "/echo/logged") == -1 {
+        t.Fatalf("bad access log %q", access)
+    }
+    if strings.Index(string(errors), "config error log") == -1 {
+        t.Fatalf("bad error log %q", errors)
+    }
+
+    SetConfig("log", "access", "testdata/missing/access.log")
+    if err = applyLogConfig(); err == nil {
+        t.Fatalf("expected an error for a log that can't be opened")
+    }
+}
+
+func TestDevMode(t *testing.T) {
+    SetLogLevel(LogNone)
+    defer SetLogLevel(LogInfo)
+
+    resp := getTestResponse("GET", "/panic", "", nil)
+    if resp.statusCode != 500 || resp.body != "Internal Server Error" {
+        t.Fatalf("bad response to a panic %d %q", resp.statusCode, resp.body)
+    }
+    if _, ok := resp.headers["Cache-Control"]; ok {
+        t.Fatalf("Cache-Control set in ProdMode")
+    }
+
+    if err := SetMode("debug"); err == nil {
+        t.Fatalf("SetMode accepted an unknown mode")
+    }
+    SetMode(DevMode)
+    defer SetMode(ProdMode)
+    if Mode() != DevMode {
+        t.Fatalf("expected mode %q got %q", DevMode, Mode())
+    }
+
+    resp = getTestResponse("GET", "/panic?a=b", "", nil)
+    if resp.statusCode != 500 || strings.Index(resp.body, "panic: oops") == -1 || strings.Index(resp.body, "GET /panic?a=b") == -1 {
+        t.Fatalf("bad error page %d %q", resp.statusCode, resp.body)
+    }
+    if strings.Index(resp.body, "partial") != -1 {
+        t.Fatalf("the buffered response was sent with the error page")
+    }
+    if resp.headers["Cache-Control"][0] != "no-store" {
+        t.Fatalf("expected Cache-Control no-store, got %v", resp.headers["Cache-Control"])
+    }
+
+    resp = getTestResponse("GET", "/handlererror", "", nil)
+    if resp.statusCode != 500 || strings.Index(resp.body, "no such thing") == -1 {
+        t.Fatalf("bad error page %d %q", resp.statusCode, resp.body)
+    }
+}
+
+//the request line is logged the same way with and without a query string
+func TestAccessLogRequestLine(t *testing.T) {
+    var buf bytes.Buffer
+    SetAccessLog(&buf)
+    defer SetAccessLog(os.Stdout)
+    defer SetAccessLogFormat(CommonLogFormat)
+    SetAccessLogFormat("{Method} {URI} {Proto}\n")
+
+    getTestResponse("POST", "/post/echo/search?q=go", "", nil)
+    getTestResponse("POST", "/post/echo/search", "", nil)
+    getTestResponse("GET", "/echo/search?q=go&page=2", "", nil)
+    expected := "POST /post/echo/search?q=go HTTP/1.1\n" +
+        "POST /post/echo/search HTTP/1.1\n" +
+        "GET /echo/search?q=go&page=2 HTTP/1.1\n"
+    if buf.String() != expected {
+        t.Fatalf("expected %q got %q", expected, buf.String())
+    }
+}
+
+func TestHealthEndpoint(t *testing.T) {
+    EnableHealthEndpoint("/health")
+    defer EnableHealthEndpoint("")
+    EnableReadinessEndpoint("/ready")
+    defer EnableReadinessEndpoint("")
+    defer func() { healthChecks = vector.Vector{} }()
+
+    var buf bytes.Buffer
+    SetAccessLog(&buf)
+    defer SetAccessLog(os.Stdout)
+    resp := getTestResponse("GET", "/health", "", nil)
+    if resp.statusCode != 200 || resp.body != "ok" {
+        t.Fatalf("expected 200 ok got %d %q", resp.statusCode, resp.body)
+    }
+    if buf.Len() != 0 {
+        t.Fatalf("the health probe was logged: %q", buf.String())
+    }
+
+    var dbErr os.Error
+    AddHealthCheck("cache", func() os.Error { return nil })
+    AddHealthCheck("db", func() os.Error { return dbErr })
+    if resp = getTestResponse("GET", "/ready", "", nil); resp.statusCode != 200 {
+        t.Fatalf("expected 200 got %d", resp.statusCode)
+    }
+    dbErr = os.NewError("connection refused")
+    resp = getTestResponse("GET", "/ready", "", nil)
+    if resp.statusCode != 503 || resp.body != `{"failing":{"db":"connection refused"}}` {
+        t.Fatalf("expected a 503 listing db, got %d %q", resp.statusCode, resp.body)
+    }
+
+    //the liveness probe doesn't run the checks
+    if resp = getTestResponse("GET", "/health", "", nil); resp.statusCode != 200 || resp.body != "ok" {
+        t.Fatalf("expected 200 ok from the liveness probe, got %d %q", resp.statusCode, resp.body)
+    }
+    dbErr = nil
+
+    //a panicking check is a failing one
+    var panics bool
+    AddHealthCheck("queue", func() os.Error {
+        if panics {
+            panic("nil queue")
+        }
+        return nil
+    })
+    panics = true
+    SetLogLevel(LogNone)
+    resp = getTestResponse("GET", "/ready", "", nil)
+    SetLogLevel(LogInfo)
+    if resp.statusCode != 503 || resp.body != `{"failing":{"queue":"panic: nil queue"}}` {
+        t.Fatalf("expected a 503 listing queue, got %d %q", resp.statusCode, resp.body)
+    }
+    panics = false
+
+    //probes are answered while other requests wait
+    SetMaxConcurrentRequests(1, 1)
+    defer SetMaxConcurrentRequests(0, 0)
+    go getTestResponse("GET", "/slow", "", nil)
+    go getTestResponse("GET", "/slow", "", nil)
+    time.Sleep(5e6)
+    for _, path := range []string{"/health", "/ready"} {
+        if resp = getTestResponse("GET", path, "", nil); resp.statusCode != 200 {
+            t.Fatalf("%s: expected 200 while the limit is reached, got %d", path, resp.statusCode)
+        }
+    }
+    time.Sleep(50e6)
+}
+
+func TestInheritedListener(t *testing.T) {
+    os.Setenv("WEBGO_TEST_FD", "7")
+    if fd, err := inheritedFdFromEnv("WEBGO_TEST_FD"); err != nil || fd != 7 {
+        t.Fatalf("expected fd 7 got %d %v", fd, err)
+    }
+    os.Setenv("WEBGO_TEST_FD", "x")
+    if _, err := inheritedFdFromEnv("WEBGO_TEST_FD"); err == nil {
+        t.Fatalf("accepted an invalid descriptor")
+    }
+    if _, err := inheritedFdFromEnv("WEBGO_TEST_UNSET"); err == nil {
+        t.Fatalf("accepted an unset variable")
+    }
+
+    fd, errno := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+    if errno != 0 {
+        t.Fatalf("socket failed: %s", os.Errno(errno))
+    }
+    syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+    syscall.Listen(fd, 16)
+    l, err := newFdListener(fd)
+    if err != nil {
+        t.Fatalf("newFdListener failed: %s", err)
+    }
+    served := make(chan os.Error, 1)
+    go func() { served <- serve("http", l) }()
+
+    c, err := net.Dial("tcp", "", l.Addr().String())
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+    c.Write([]byte("GET /echo/inherited HTTP/1.0\r\n\r\n"))
+    output, _ := ioutil.ReadAll(c)
+    if resp := buildTestResponse(bytes.NewBuffer(output)); resp.statusCode != 200 || resp.body != "inherited" {
+        t.Fatalf("expected 200 inherited got %d %q", resp.statusCode, resp.body)
+    }
+
+    if err = Relaunch(); err == nil {
+        t.Fatalf("Relaunch worked without RunInherited")
+    }
+
+    //closing the listener wakes the blocked Accept
+    stopListener(l)
+    select {
+    case err = <-served:
+        if err != nil {
+            t.Fatalf("serve failed: %s", err)
+        }
+    case <-time.After(1e9):
+        t.Fatalf("the inherited listener wasn't closed")
+    }
+}
+
+func TestUnframedResponses(t *testing.T) {
+    headers := map[string]string{"SERVER_PROTOCOL": "HTTP/1.0"}
+    var output bytes.Buffer
+    handleScgiRequest(&tcpBuffer{input: buildTestScgiRequest("GET", "/unframed", "", headers), output: &output})
+    if !strings.HasPrefix(output.String(), "HTTP/1.0 200 OK\r\n") {
+        t.Fatalf("bad status line %q", output.String())
+    }
+    resp := buildTestResponse(&output)
+    if resp.body != "no length" || resp.headers["Connection"][0] != "close" {
+        t.Fatalf("expected Connection: close, got %v %q", resp.headers, resp.body)
+    }
+
+    //a response with a length doesn't need the connection closed
+    output.Reset()
+    handleScgiRequest(&tcpBuffer{input: buildTestScgiRequest("GET", "/echo/a", "", headers), output: &output})
+    if _, ok := buildTestResponse(&output).headers["Connection"]; ok {
+        t.Fatalf("Connection set on a response with a Content-Length")
+    }
+
+    req := buildTestFcgiRequest("GET", "/unframed", []string{""}, headers)
+    output.Reset()
+    handleFcgiConnection(&tcpBuffer{input: req, output: &output})
+    resp = buildTestResponse(getFcgiOutput(&output))
+    if resp.body != "no length" || resp.headers["Connection"][0] != "close" {
+        t.Fatalf("expected Connection: close, got %v %q", resp.headers, resp.body)
+    }
+
+    //HTTP/1.1 clients get the response chunked by the front end, and keep their
+    //connection
+    headers["SERVER_PROTOCOL"] = "HTTP/1.1"
+    output.Reset()
+    handleScgiRequest(&tcpBuffer{input: buildTestScgiRequest("GET", "/unframed", "", headers), output: &output})
+    resp = buildTestResponse(&output)
+    if _, ok := resp.headers["Connection"]; ok || resp.body != "no length" {
+        t.Fatalf("Connection set on a response to HTTP/1.1: %v %q", resp.headers, resp.body)
+    }
+    req = buildTestFcgiRequest("GET", "/unframed", []string{""}, headers)
+    output.Reset()
+    handleFcgiConnection(&tcpBuffer{input: req, output: &output})
+    resp = buildTestResponse(getFcgiOutput(&output))
+    if _, ok := resp.headers["Connection"]; ok || resp.body != "no length" {
+        t.Fatalf("Connection set on a response to HTTP/1.1: %v %q", resp.headers, resp.body)
+    }
+
+    r := newRequestCgi(map[string]string{"SERVER_PROTOCOL": "HTTP/1.1"}, nil)
+    if r.ProtoMajor != 1 || r.ProtoMinor != 1 || !r.ProtoAtLeast(1, 1) {
+        t.Fatalf("bad version %d.%d", r.ProtoMajor, r.ProtoMinor)
+    }
+    if r = newRequestCgi(map[string]string{}, nil); r.ProtoAtLeast(1, 1) {
+        t.Fatalf("a request without SERVER_PROTOCOL was taken as HTTP/1.1")
+    }
+}
+
+func TestConfig(t *testing.T) {
+    defer func() { configValues = make(map[string]map[string]string) }()
+
+    if ConfigString("webserver", "host", "0.0.0.0") != "0.0.0.0" || ConfigInt("webserver", "port", 80) != 80 {
+        t.Fatalf("the defaults weren't used")
+    }
+
+    os.Setenv("WEBGO_WEBSERVER_PORT", "8080")
+    defer os.Setenv("WEBGO_WEBSERVER_PORT", "")
+    if port := ConfigInt("webserver", "port", 80); port != 8080 {
+        t.Fatalf("expected the port from the environment, got %d", port)
+    }
+    SetConfig("WebServer", "Port", "9090")
+    if port := ConfigInt("webserver", "port", 80); port != 9090 {
+        t.Fatalf("expected the port set with SetConfig, got %d", port)
+    }
+
+    SetConfig("app", "debug", "yes")
+    SetConfig("app", "count", "many")
+    SetConfig("app", "flag", "maybe")
+    SetLogLevel(LogNone)
+    defer SetLogLevel(LogInfo)
+    if !ConfigBool("app", "debug", false) || ConfigInt("app", "count", 3) != 3 || !ConfigBool("app", "flag", true) {
+        t.Fatalf("bad typed values")
+    }
+    if configEnvName("security", "cookieSecret") != "WEBGO_SECURITY_COOKIESECRET" {
+        t.Fatalf("bad environment variable %q", configEnvName("security", "cookieSecret"))
+    }
+
+    SetConfig("webserver", "staticDir", "testdata/static")
+    if resp := getTestResponse("GET", "/hello.txt", "", nil); resp.body != "hello static\n" {
+        t.Fatalf("the static directory from the config wasn't used: %d %q", resp.statusCode, resp.body)
+    }
+}
+
+func TestCookieSecretSources(t *testing.T) {
+    oldSecrets := secrets
+    defer func() { secrets = oldSecrets }()
+    defer func() { configValues = make(map[string]map[string]string) }()
+    SetCookieSecret("inline")
+
+    ioutil.WriteFile("testdata/cookie.key", []byte("  from file\n"), 0600)
+    defer os.Remove("testdata/cookie.key")
+    SetConfig("security", "cookieSecretFile", "testdata/cookie.key")
+    if keys := cookieSecrets(); len(keys) != 2 || keys[0] != "from file" || keys[1] != "inline" {
+        t.Fatalf("expected the secret from the file first, got %q", keys)
+    }
+
+    os.Setenv("WEBGO_COOKIE_SECRET", "from env")
+    defer os.Setenv("WEBGO_COOKIE_SECRET", "")
+    if keys := cookieSecrets(); keys[0] != "from env" {
+        t.Fatalf("expected the secret from the environment first, got %q", keys)
+    }
+    os.Setenv("WEBGO_COOKIE_SECRET", "")
+
+    SetLogLevel(LogNone)
+    defer SetLogLevel(LogInfo)
+    SetConfig("security", "cookieSecretFile", "testdata/missing.key")
+    if keys := cookieSecrets(); len(keys) != 1 || keys[0] != "inline" {
+        t.Fatalf("expected only the inline secret, got %q", keys)
+    }
+
+    if checkCookieSecret() == nil {
+        t.Fatalf("a missing cookie secret file wasn't reported")
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen failed: %s", err)
+    }
+    if serve("http", l) == nil {
+        t.Fatalf("the server started with a missing cookie secret file")
+    }
+
+    //without any secret, one is generated and kept, but not in place of a
+    //secret file that can't be read
+    oldExeDir := exeDir
+    exeDir = "testdata"
+    defer func() { exeDir = oldExeDir }()
+    defer os.Remove("testdata/" + generatedSecretFile)
+    secrets = nil
+    if keys := cookieSecrets(); len(keys) != 0 {
+        t.Fatalf("a secret was generated in place of the secret file: %q", keys)
+    }
+    configValues = make(map[string]map[string]string)
+    secrets = nil
+    keys := cookieSecrets()
+    saved, err := ioutil.ReadFile("testdata/" + generatedSecretFile)
+    if len(keys) != 1 || len(keys[0]) != 64 || err != nil || strings.TrimSpace(string(saved)) != keys[0] {
+        t.Fatalf("the generated secret wasn't saved: %q %q %v", keys, saved, err)
+    }
+    if info, err := os.Stat("testdata/" + generatedSecretFile); err != nil || info.Permission()&077 != 0 {
+        t.Fatalf("the generated secret is readable by others")
+    }
+    generatedSecret = ""
+    if again := cookieSecrets(); again[0] != keys[0] {
+        t.Fatalf("the saved secret wasn't reused")
+    }
+}
+
+type configParseTest struct {
+    input   string
+    section string
+    key     string
+    value   string //"" if the key shouldn't be set
+    ok      bool   //false if parsing should fail
+}
+
+var configParseTests = []configParseTest{
+    configParseTest{"[webserver]\nport = 8080\n", "webserver", "port", "8080", true},
+    configParseTest{"[webserver]\r\nport = 8080\r\n", "webserver", "port", "8080", true},
+    configParseTest{"\xef\xbb\xbf[webserver]\nport=8080", "webserver", "port", "8080", true},
+    configParseTest{"host = example.com  \t\n", "default", "host", "example.com", true},
+    configParseTest{"# comment\n; comment\n[a]\nk = 1\nk = 2\n", "a", "k", "2", true},
+    configParseTest{"[Session]\nLength = 3600\n", "session", "length", "3600", true},
+    configParseTest{"[a]\nk = x = y\n", "a", "k", "x = y", true},
+    configParseTest{"[a]\nk =\n", "a", "k", "", true},
+    configParseTest{"[a]\n# k = 1\n", "a", "k", "", true},
+    configParseTest{"[a\nk = 1\n", "", "", "", false},
+    configParseTest{"[]\n", "", "", "", false},
+    configParseTest{"[a]\njust a line\n", "", "", "", false},
+    configParseTest{"[a]\n= 1\n", "", "", "", false},
+}
+
+func TestParseConfig(t *testing.T) {
+    for _, test := range configParseTests {
+        c, err := ParseConfig(bytes.NewBufferString(test.input))
+        if !test.ok {
+            if err == nil {
+                t.Fatalf("%q: expected an error", test.input)
+            }
+            continue
+        }
+        if err != nil {
+            t.Fatalf("%q: %s", test.input, err)
+        }
+        value, err := c.GetString(test.section, test.key)
+        if len(test.value) == 0 && strings.Index(test.input, test.key+" =\n") == -1 {
+            if err == nil {
+                t.Fatalf("%q: %s.%s is set to %q", test.input, test.section, test.key, value)
+            }
+            continue
+        }
+        if err != nil || value != test.value {
+            t.Fatalf("%q: expected %q got %q %v", test.input, test.value, value, err)
+        }
+    }
+
+    ioutil.WriteFile("testdata/test.config", []byte("[webserver]\nport = 8000\nhost = localhost\n"), 0644)
+    defer os.Remove("testdata/test.config")
+    oldConfig := Config
+    defer func() { Config = oldConfig }()
+    defer func() { configValues = make(map[string]map[string]string) }()
+    if err := LoadConfigFile("testdata/test.config"); err != nil {
+        t.Fatalf("LoadConfigFile failed: %s", err)
+    }
+    if port, err := Config.GetInt("webserver", "port"); err != nil || port != 8000 {
+        t.Fatalf("expected port 8000 got %d %v", port, err)
+    }
+    os.Setenv("WEBGO_WEBSERVER_PORT", "8001")
+    defer os.Setenv("WEBGO_WEBSERVER_PORT", "")
+    if ConfigInt("webserver", "port", 80) != 8001 || ConfigString("webserver", "host", "") != "localhost" {
+        t.Fatalf("the environment didn't take precedence over the file")
+    }
+    if LoadConfigFile("testdata/missing.config") == nil {
+        t.Fatalf("LoadConfigFile accepted a missing file")
+    }
+}
+
+func TestLoadConfig(t *testing.T) {
+    oldConfig, oldLoaded, oldSecrets := Config, configLoaded, secrets
+    defer func() { Config, configLoaded, secrets = oldConfig, oldLoaded, oldSecrets }()
+    defer func() { configValues = make(map[string]map[string]string) }()
+    defer forgetSecretFiles()
+    secrets = nil
+
+    ioutil.WriteFile("testdata/env.config", []byte("[security]\ncookieSecretFile = testdata/load.key\n"), 0644)
+    ioutil.WriteFile("testdata/arg.config", []byte("[webserver]\nport = 8002\n"), 0644)
+    ioutil.WriteFile("testdata/load.key", []byte("first\n"), 0600)
+    defer os.Remove("testdata/env.config")
+    defer os.Remove("testdata/arg.config")
+    defer os.Remove("testdata/load.key")
+
+    //WEBGO_CONFIG names the file when no path is given
+    os.Setenv("WEBGO_CONFIG", "testdata/env.config")
+    defer os.Setenv("WEBGO_CONFIG", "")
+    if err := LoadConfig(""); err != nil {
+        t.Fatalf("LoadConfig failed: %s", err)
+    }
+    if keys := cookieSecrets(); len(keys) != 1 || keys[0] != "first" {
+        t.Fatalf("expected the secret from the file, got %q", keys)
+    }
+
+    //reloading applies the settings again
+    ioutil.WriteFile("testdata/load.key", []byte("second\n"), 0600)
+    if err := LoadConfig(""); err != nil {
+        t.Fatalf("LoadConfig failed: %s", err)
+    }
+    if keys := cookieSecrets(); len(keys) != 1 || keys[0] != "second" {
+        t.Fatalf("expected the secret to be read again, got %q", keys)
+    }
+    os.Remove("testdata/load.key")
+    SetLogLevel(LogNone)
+    err := LoadConfig("")
+    SetLogLevel(LogInfo)
+    if err == nil {
+        t.Fatalf("LoadConfig didn't report the missing secret file")
+    }
+
+    //a path takes precedence over WEBGO_CONFIG
+    if err := LoadConfig("testdata/arg.config"); err != nil || ConfigInt("webserver", "port", 0) != 8002 {
+        t.Fatalf("the path wasn't loaded: %v", err)
+    }
+    if LoadConfig("testdata/missing.config") == nil {
+        t.Fatalf("LoadConfig accepted a missing file")
+    }
+    os.Setenv("WEBGO_CONFIG", "testdata/missing.config")
+    if LoadConfig("") == nil {
+        t.Fatalf("LoadConfig accepted a missing WEBGO_CONFIG file")
+    }
+
+    //without either, webgo.config next to the executable is optional
+    os.Setenv("WEBGO_CONFIG", "")
+    oldExeDir := exeDir
+    exeDir = "testdata"
+    defer func() { exeDir = oldExeDir }()
+    if err := LoadConfig(""); err != nil {
+        t.Fatalf("a missing default config file was an error: %s", err)
+    }
+}
+
+func TestConfigEnvironment(t *testing.T) {
+    oldConfig := Config
+    defer func() { Config = oldConfig }()
+    defer func() { environment, environmentSet = "", false }()
+    defer func() { configValues = make(map[string]map[string]string) }()
+
+    input := "[webserver]\nhost = localhost\nport = 80\n[webserver:production]\nport = 8080\n"
+    Config, _ = ParseConfig(bytes.NewBufferString(input))
+    if ConfigInt("webserver", "port", 0) != 80 || Environment() != "" {
+        t.Fatalf("expected the base section without an environment")
+    }
+
+    os.Setenv("WEBGO_ENV", "production")
+    defer os.Setenv("WEBGO_ENV", "")
+    if Environment() != "production" || ConfigInt("webserver", "port", 0) != 8080 {
+        t.Fatalf("WEBGO_ENV wasn't used")
+    }
+    if ConfigString("webserver", "host", "") != "localhost" {
+        t.Fatalf("the base section wasn't used for a key missing in the environment's")
+    }
+
+    SetLogLevel(LogNone)
+    defer SetLogLevel(LogInfo)
+    SetEnvironment("staging")
+    if Environment() != "staging" || ConfigInt("webserver", "port", 0) != 80 {
+        t.Fatalf("an unknown environment didn't fall back to the base section")
+    }
+
+    SetEnvironment("production")
+    SetConfig("webserver", "port", "9000")
+    if ConfigInt("webserver", "port", 0) != 9000 {
+        t.Fatalf("SetConfig didn't take precedence over the file")
+    }
+}
+
+func TestConfigListenerSpecs(t *testing.T) {
+    defer func() { configValues = make(map[string]map[string]string) }()
+
+    SetConfig("webserver", "host", "127.0.0.1, ::1, unix:testdata/app.sock")
+    SetConfig("webserver", "port", "8080,8081")
+    specs, err := configListenerSpecs()
+    if err != nil {
+        t.Fatalf("unexpected error: %s", err)
+    }
+    expected := []string{"127.0.0.1:8080", "127.0.0.1:8081", "[::1]:8080", "[::1]:8081", "unix:testdata/app.sock"}
+    if len(specs) != len(expected) {
+        t.Fatalf("expected %d listeners, got %d", len(expected), len(specs))
+    }
+    for i, spec := range specs {
+        if spec.Protocol != "http" || spec.Addr != expected[i] {
+            t.Errorf("expected http %s, got %s %s", expected[i], spec.Protocol, spec.Addr)
+        }
+    }
+
+    SetConfig("webserver", "protocol", "https")
+    SetConfig("webserver", "certFile", "web_test.go")
+    SetConfig("webserver", "keyFile", "web_test.go")
+    if specs, err = configListenerSpecs(); err != nil || specs[0].CertFile != "web_test.go" {
+        t.Fatalf("expected an https listener, got %v", err)
+    }
+
+    tests := []struct{ key, value string }{
+        {"keyFile", "testdata/missing.key"},
+        {"protocol", "gopher"},
+        {"port", "http"},
+        {"port", "70000"},
+        {"host", "localhost:8080"},
+    }
+    for _, test := range tests {
+        SetConfig("webserver", "protocol", "https")
+        SetConfig("webserver", "keyFile", "web_test.go")
+        SetConfig("webserver", "host", "localhost")
+        SetConfig("webserver", "port", "8080")
+        SetConfig("webserver", test.key, test.value)
+        if _, err := configListenerSpecs(); err == nil || strings.Index(err.String(), "webserver."+test.key) == -1 {
+            t.Errorf("expected an error about webserver.%s for %q, got %v", test.key, test.value, err)
+        }
+    }
+}
+
+func TestValidateConfig(t *testing.T) {
+    oldConfig := Config
+    defer func() { Config = oldConfig }()
+    defer func() { configValues = make(map[string]map[string]string) }()
+    defer StrictConfig(false)
+
+    input := "[webserver]\nstaticdir = static\nstaticdri = static\n[webserver:production]\nport = eighty\n[app]\nanything = goes\n"
+    Config, _ = ParseConfig(bytes.NewBufferString(input))
+    SetConfig("webserver", "protocol", "gopher")
+
+    problems := ValidateConfig()
+    if len(problems) != 3 {
+        t.Fatalf("expected 3 problems, got %v", problems)
+    }
+    for _, expected := range []string{"webserver.staticdri", "webserver.port", "webserver.protocol"} {
+        found := false
+        for _, p := range problems {
+            found = found || strings.Index(p.String(), expected) != -1
+        }
+        if !found {
+            t.Errorf("expected a problem with %s, got %v", expected, problems)
+        }
+    }
+
+    RegisterConfigSection("App", "name")
+    if len(ValidateConfig()) != 4 {
+        t.Errorf("the keys of a registered section weren't checked")
+    }
+
+    SetLogLevel(LogNone)
+    defer SetLogLevel(LogInfo)
+    if err := checkConfig(); err != nil {
+        t.Errorf("expected only warnings, got %s", err)
+    }
+    StrictConfig(true)
+    if err := checkConfig(); err == nil {
+        t.Errorf("expected an error in strict mode")
+    }
+    configKeys["app"] = nil, false
+}
+
+func TestInit(t *testing.T) {
+    oldExeDir, oldStaticDir, oldTemplateDir, oldSecrets := ExeDir(), staticDir, templateDir, secrets
+    defer func() {
+        exeDir, staticDir, secrets = oldExeDir, oldStaticDir, oldSecrets
+        SetTemplateDir(oldTemplateDir)
+    }()
+
+    if err := Init(InitOptions{ExeDir: "testdata", StaticDir: "static", TemplateDir: "templates", CookieSecret: "init"}); err != nil {
+        t.Fatalf("Init failed: %s", err)
+    }
+    wd, _ := os.Getwd()
+    dir := path.Join(wd, "testdata")
+    if ExeDir() != dir {
+        t.Fatalf("expected ExeDir %q got %q", dir, ExeDir())
+    }
+    if staticDirectory() != path.Join(dir, "static") || templateDirectory() != path.Join(dir, "templates") {
+        t.Fatalf("unexpected directories %q and %q", staticDirectory(), templateDirectory())
+    }
+    if len(secrets) != 1 || secrets[0] != "init" {
+        t.Fatalf("the cookie secret wasn't set")
+    }
+
+    if Init(InitOptions{ExeDir: "testdata/missing"}) == nil {
+        t.Errorf("Init accepted a missing directory")
+    }
+    if Init(InitOptions{ConfigFile: "testdata/missing.conf"}) == nil {
+        t.Errorf("Init accepted a missing config file")
+    }
+}
+
+func TestJSONParams(t *testing.T) {
+    body := `{"name": "web.go", "count": 3, "ratio": 0.5, "ok": true, "nested": {"a": "b"}, "list": [1]}`
+    req := buildTestRequest("POST", "/jsonparams?name=query", body, nil)
+    req.Headers["Content-Type"] = "application/json; charset=utf-8"
+    resp := getTestResponseFromRequest(req)
+    expected := "[query web.go] [3] [0.5] [true] b"
+    if resp.statusCode != 200 || resp.body != expected {
+        t.Fatalf("expected %q got %d %q", expected, resp.statusCode, resp.body)
+    }
+
+    req = buildTestRequest("POST", "/jsonparams", `{"name": `, nil)
+    req.Headers["Content-Type"] = "application/json"
+    resp = getTestResponseFromRequest(req)
+    if resp.statusCode != 400 {
+        t.Fatalf("expected status 400 for invalid JSON got %d", resp.statusCode)
+    }
+
+    req = buildTestRequest("POST", "/rawbody", "<a>b</a>", nil)
+    req.Headers["Content-Type"] = "application/xml"
+    resp = getTestResponseFromRequest(req)
+    if resp.statusCode != 200 || resp.body != ":<a>b</a>" {
+        t.Fatalf("expected the raw XML body got %d %q", resp.statusCode, resp.body)
+    }
+}
+
+func TestBodyParamsMethods(t *testing.T) {
+    bodies := map[string]string{
+        "application/x-www-form-urlencoded": "a=1",
+        "application/json":                  `{"a": 1}`,
+    }
+    for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+        for ct, body := range bodies {
+            headers := map[string]string{"Content-Type": ct, "Content-Length": strconv.Itoa(len(body))}
+            resp := getTestResponse(method, "/bodyparams?q=2", body, headers)
+            if expected := method + " 2 1"; resp.body != expected {
+                t.Errorf("%s %s: expected %q got %q", method, ct, expected, resp.body)
+            }
+        }
+        headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Transfer-Encoding": "chunked"}
+        if resp := getTestResponse(method, "/bodyparams", "a=1", headers); resp.body != method+"  1" {
+            t.Errorf("%s chunked: expected the body to be parsed got %q", method, resp.body)
+        }
+        if resp := getTestResponse(method, "/bodyparams?q=2", "a=1", nil); resp.body != method+" 2 " {
+            t.Errorf("%s without a length: expected the body to be left alone got %q", method, resp.body)
+        }
+    }
+}
+
+type testUser struct {
+    Name    string
+    Emails  []string
+    Age     int
+    Admin   bool
+    Address struct {
+        City string
+    }
+}
+
+func TestNestedParams(t *testing.T) {
+    body := "user[name]=Bob&user[emails][]=a@x&user[emails][]=b@x&user[age]=30&user[address][city]=Rome"
+    resp := getTestResponse("POST", "/nestedparams", body, nil)
+    if expected := "Bob [a@x b@x] 30 false Rome"; resp.body != expected {
+        t.Fatalf("expected %q got %q", expected, resp.body)
+    }
+    resp = getTestResponse("POST", "/nestedparams", "user[age]=old", nil)
+    if expected := `invalid value "old" for user[Age]`; resp.body != expected {
+        t.Fatalf("expected %q got %q", expected, resp.body)
+    }
+
+    params := map[string][]string{"a": []string{"1"}, "a[b]": []string{"2"}, "c[][d]": []string{"3"}, "e[f": []string{"4"}}
+    nested, err := nestParams(params)
+    if err != nil || len(nested) != 2 || nested["a"] != "1" || nested["e[f"] != "4" {
+        t.Fatalf("unexpected nesting %v %v", nested, err)
+    }
+
+    deep := "a" + strings.Repeat("[a]", maxParamDepth+1)
+    if _, err = nestParams(map[string][]string{deep: []string{"1"}}); err == nil {
+        t.Fatalf("expected an error for a deeply nested parameter")
+    }
+    many := make(map[string][]string)
+    for i := 0; i <= maxParamKeys; i++ {
+        many[strconv.Itoa(i)] = []string{""}
+    }
+    if _, err = nestParams(many); err == nil {
+        t.Fatalf("expected an error for too many parameters")
+    }
+    //too many parameters only matter to the requests that nest them
+    var form bytes.Buffer
+    for i := 0; i <= maxParamKeys; i++ {
+        fmt.Fprintf(&form, "p%d=1&", i)
+    }
+    form.WriteString("user[name]=Bob")
+    req := buildTestRequest("POST", "/nestedparams", form.String(), nil)
+    if err = req.parseParams(); err != nil || req.ParseError != nil {
+        t.Fatalf("a large flat form is a parse error: %v", err)
+    }
+    if _, err = req.ParseNestedParams(); err == nil {
+        t.Fatalf("expected ParseNestedParams to report too many parameters")
+    }
+    resp = getTestResponse("POST", "/nestedparams", form.String(), nil)
+    if expected := "too many parameters, the limit is 1000"; resp.body != expected {
+        t.Fatalf("expected %q got %q", expected, resp.body)
+    }
+}
+
+type cookieHeaderTest struct {
+    header   string
+    expected map[string]string
+}
+
+var cookieHeaderTests = []cookieHeaderTest{
+    cookieHeaderTest{"a=1; b=2", map[string]string{"a": "1", "b": "2"}},
+    cookieHeaderTest{`sid="quoted value"; x=1`, map[string]string{"sid": "quoted value", "x": "1"}},
+    cookieHeaderTest{`q="semi;colon, comma"; r=1`, map[string]string{"q": "semi;colon, comma", "r": "1"}},
+    cookieHeaderTest{"data=YWJjZA==; other=1", map[string]string{"data": "YWJjZA==", "other": "1"}},
+    cookieHeaderTest{"v=a=b=c", map[string]string{"v": "a=b=c"}},
+    cookieHeaderTest{"  spaced  =  val  ;  b = 2 ;", map[string]string{"spaced": "val", "b": "2"}},
+    cookieHeaderTest{"a=1; a=2", map[string]string{"a": "1"}},
+    cookieHeaderTest{"a=1,b=2", map[string]string{"a": "1", "b": "2"}},
+    cookieHeaderTest{"list=x,y; c=3", map[string]string{"list": "x,y", "c": "3"}},
+    cookieHeaderTest{`json={"a":1,"b":2}`, map[string]string{"json": `{"a":1,"b":2}`}},
+    cookieHeaderTest{"empty=; flag; z=9", map[string]string{"empty": "", "z": "9"}},
+    cookieHeaderTest{`open="abc`, map[string]string{"open": "abc"}},
+    cookieHeaderTest{"=novalue; ;; x=1", map[string]string{"x": "1"}},
+    cookieHeaderTest{"=x", map[string]string{}},
+    cookieHeaderTest{"a=1; =x", map[string]string{"a": "1"}},
+    cookieHeaderTest{"a=1; = ; =b=c; d=2", map[string]string{"a": "1", "d": "2"}},
+    cookieHeaderTest{"__utma=1.2.3; __utmz=1.2.utmcsr=(direct)|utmccn=(direct)", map[string]string{"__utma": "1.2.3", "__utmz": "1.2.utmcsr=(direct)|utmccn=(direct)"}},
+    cookieHeaderTest{"", map[string]string{}},
+}
+
+func TestParseCookies(t *testing.T) {
+    for _, test := range cookieHeaderTests {
+        req := &Request{Headers: map[string]string{"Cookie": test.header}}
+        req.parseCookies()
+        if len(req.Cookies) != len(test.expected) {
+            t.Errorf("%q: expected %d cookies got %v", test.header, len(test.expected), req.Cookies)
+        }
+        for name, value := range test.expected {
+            if got, ok := req.Cookies[name]; !ok || got != value {
+                t.Errorf("%q: expected %s=%q got %q", test.header, name, value, got)
+            }
+        }
+    }
+
+    req := &Request{Headers: map[string]string{"Cookie": "a=1; b=2; a=3"}}
+    req.parseCookies()
+    if all := req.CookiesAll["a"]; len(all) != 2 || all[0] != "1" || all[1] != "3" {
+        t.Errorf("expected both values of a got %v", all)
+    }
+}
+
+func TestPathParamDecoding(t *testing.T) {
+    tests := []Test{
+        Test{"GET", "/echo/caf%C3%A9", "", 200, "café"},
+        Test{"GET", "/echo/a+b%20c", "", 200, "a+b c"},
+        Test{"GET", "/echo/a%2Fb", "", 200, "a/b"},
+        Test{"GET", "/echo/100%25", "", 200, "100%"},
+        Test{"GET", "/caf%C3%A9/a%20b", "", 200, "literal a b"},
+        Test{"GET", "/echo/%zz", "", 400, "Bad Request"},
+        Test{"GET", "/echo/%4", "", 400, "Bad Request"},
+    }
+    for _, test := range tests {
+        resp := getTestResponse(test.method, test.path, test.body, nil)
+        if resp.statusCode != test.expectedStatus || resp.body != test.expectedBody {
+            t.Errorf("%s: expected %d %q got %d %q", test.path, test.expectedStatus, test.expectedBody, resp.statusCode, resp.body)
+        }
+    }
+
+    //the same through scgi
+    for _, path := range []string{"/echo/%zz", "/echo/%4"} {
+        var output bytes.Buffer
+        handleScgiRequest(&tcpBuffer{input: buildTestScgiRequest("GET", path, "", nil), output: &output})
+        if resp := buildTestResponse(&output); resp.statusCode != 400 {
+            t.Errorf("%s: expected a 400 through scgi got %d", path, resp.statusCode)
+        }
+    }
+
+    RawPathParams(true)
+    defer RawPathParams(false)
+    if resp := getTestResponse("GET", "/echo/caf%C3%A9", "", nil); resp.body != "caf%C3%A9" {
+        t.Errorf("expected the raw capture got %q", resp.body)
+    }
+}
+
+//panics outside the route handlers don't end the process either
+func TestHandlerPanics(t *testing.T) {
+    SetLogLevel(LogNone)
+    defer SetLogLevel(LogInfo)
+
+    SetStaticFallback(func(ctx *Context, requestedPath string) bool { panic("oops") })
+    resp := getTestResponse("GET", "/no/such/page", "", nil)
+    SetStaticFallback(nil)
+    if resp.statusCode != 500 || resp.body != "Internal Server Error" {
+        t.Fatalf("bad response to a panic in the static fallback %d %q", resp.statusCode, resp.body)
+    }
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen failed: %s", err)
+    }
+    go serve("http", l)
+    defer stopListener(l)
+
+    c, err := net.Dial("tcp", "", l.Addr().String())
+    if err != nil {
+        t.Fatalf("dial failed: %s", err)
+    }
+    defer c.Close()
+    c.Write([]byte("GET /ws/panic HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+        "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+    //the handshake is followed by the connection being closed
+    if _, err = ioutil.ReadAll(c); err != nil {
+        t.Fatalf("read failed: %s", err)
+    }
+}
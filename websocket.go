@@ -0,0 +1,330 @@
+package web
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "io"
+    "os"
+    "strings"
+    "sync"
+)
+
+//WebSocket message types, for ReadMessage and WriteMessage
+const (
+    TextMessage   = 1
+    BinaryMessage = 2
+)
+
+//control frame opcodes
+const (
+    wsContinuation = 0
+    wsClose        = 8
+    wsPing         = 9
+    wsPong         = 10
+)
+
+//the GUID appended to the client's key in the handshake, from RFC 6455
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//the largest message ReadMessage accepts
+var maxWebSocketMessage = 1 << 20
+
+var errWebSocketClosed = os.NewError("websocket: connection closed")
+var errHijackUnsupported = os.NewError("the connection can't be hijacked")
+
+//WebSocketConn is a WebSocket connection, set up by a route added with Websocket
+type WebSocketConn struct {
+    rwc    io.ReadWriteCloser
+    br     *bufio.Reader
+    lock   sync.Mutex //serializes writes, so pongs can be sent while reading
+    closed bool
+}
+
+//Adds a WebSocket route. The handshake is done before the handler is called, and
+//the connection is closed when it returns. The handler has the connection to
+//itself: nothing can be written to ctx. Only the http server supports WebSockets
+func Websocket(route string, handler func(ctx *Context, ws *WebSocketConn)) *Route {
+    r := addRoute(route, "GET", handler)
+    if r != nil {
+        r.websocket = handler
+    }
+    return r
+}
+
+//the value of the Sec-WebSocket-Accept header for the client's key
+func webSocketAccept(key string) string {
+    h := sha1.New()
+    h.Write([]byte(key + wsGUID))
+    sum := h.Sum()
+    encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+    base64.StdEncoding.Encode(encoded, sum)
+    return string(encoded)
+}
+
+//returns true if the comma separated header contains token, ignoring case
+func headerHasToken(header string, token string) bool {
+    for _, t := range strings.Split(header, ",", -1) {
+        if strings.ToLower(strings.TrimSpace(t)) == token {
+            return true
+        }
+    }
+    return false
+}
+
+//completes the handshake and runs the handler of a WebSocket route, calling
+//upgraded once the connection has switched protocols
+func serveWebSocket(ctx *Context, handler func(*Context, *WebSocketConn), upgraded func()) {
+    req := ctx.Request
+    key := req.GetHeader("Sec-WebSocket-Key")
+    if !headerHasToken(req.GetHeader("Upgrade"), "websocket") || !headerHasToken(req.GetHeader("Connection"), "upgrade") || len(key) == 0 {
+        ctx.BadRequest("Not a WebSocket handshake")
+        return
+    }
+    if req.GetHeader("Sec-WebSocket-Version") != "13" {
+        ctx.SetHeader("Sec-WebSocket-Version", "13", true)
+        ctx.BadRequest("Unsupported WebSocket version")
+        return
+    }
+
+    rwc, buf, err := hijackConn(*ctx.conn, 101)
+    if err != nil {
+        logErrorf("WebSocket handshake for %s failed: %s", req.URL.Path, err)
+        ctx.Abort(501, "Not Implemented")
+        return
+    }
+    ctx.saveFlash()
+    ctx.responseStarted = true
+
+    buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+    buf.WriteString("Upgrade: websocket\r\n")
+    buf.WriteString("Connection: Upgrade\r\n")
+    buf.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+    if err = buf.Flush(); err != nil {
+        rwc.Close()
+        return
+    }
+
+    //the socket is long lived, so it stops counting as a request once upgraded
+    upgraded()
+
+    ws := &WebSocketConn{rwc: rwc, br: buf.Reader}
+    defer ws.Close()
+    callWebSocketHandler(ctx, ws, handler)
+}
+
+//returns the raw connection of c, which is expected to send status, or 0 if the
+//response isn't HTTP. The response isn't sent by c afterwards, so it has to be
+//written to the connection
+func hijackConn(c conn, status int) (io.ReadWriteCloser, *bufio.ReadWriter, os.Error) {
+    for {
+        switch w := c.(type) {
+        case *loggedConn:
+            w.status = status
+            w.hijacked = status == 0
+            c = w.conn
+        case headConn:
+            c = w.conn
+        case *timeoutConn:
+            c = w.conn
+        case *httpConn:
+            w.wroteHeaders = true
+            return w.conn.Hijack()
+        default:
+            return nil, nil, errHijackUnsupported
+        }
+    }
+    return nil, nil, errHijackUnsupported
+}
+
+//Takes over the connection, for protocols web.go doesn't speak. Nothing is sent
+//for the request afterwards, not even the flash messages, and the access log
+//records it as hijacked. The caller has to close the connection. Only the http
+//server supports it; with scgi and fcgi an error is returned
+func (ctx *Context) Hijack() (io.ReadWriteCloser, os.Error) {
+    if ctx.responseStarted {
+        return nil, os.NewError("the response was already started")
+    }
+    rwc, buf, err := hijackConn(*ctx.conn, 0)
+    if err != nil {
+        return nil, err
+    }
+    ctx.buffer = nil
+    ctx.responseStarted = true
+    return &hijackedConn{rwc, buf.Reader}, nil
+}
+
+//hijackedConn reads what the server had already buffered before the connection
+type hijackedConn struct {
+    io.ReadWriteCloser
+    br *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (n int, err os.Error) { return c.br.Read(p) }
+
+//Reads the next text or binary message. Pings are answered while waiting for it.
+//os.EOF is returned once the client closes the connection
+func (ws *WebSocketConn) ReadMessage() (messageType int, data []byte, err os.Error) {
+    var message []byte
+    messageType = -1
+    for {
+        fin, opcode, payload, err := ws.readFrame()
+        if err != nil {
+            return -1, nil, err
+        }
+
+        switch opcode {
+        case wsPing:
+            if err = ws.writeFrame(wsPong, payload); err != nil {
+                return -1, nil, err
+            }
+            continue
+        case wsPong:
+            continue
+        case wsClose:
+            //echo the client's status code
+            ws.closeWith(payload)
+            return -1, nil, os.EOF
+        case TextMessage, BinaryMessage:
+            if messageType != -1 {
+                return -1, nil, ws.fail("websocket: expected a continuation frame")
+            }
+            messageType = opcode
+        case wsContinuation:
+            if messageType == -1 {
+                return -1, nil, ws.fail("websocket: unexpected continuation frame")
+            }
+        default:
+            return -1, nil, ws.fail("websocket: unknown opcode")
+        }
+
+        if len(message)+len(payload) > maxWebSocketMessage {
+            return -1, nil, ws.fail("websocket: message too large")
+        }
+        joined := make([]byte, len(message)+len(payload))
+        copy(joined, message)
+        copy(joined[len(message):], payload)
+        message = joined
+
+        if fin {
+            return messageType, message, nil
+        }
+    }
+    return -1, nil, errWebSocketClosed
+}
+
+//reads a single frame, unmasking its payload
+func (ws *WebSocketConn) readFrame() (fin bool, opcode int, payload []byte, err os.Error) {
+    var header [2]byte
+    if _, err = io.ReadFull(ws.br, &header); err != nil {
+        return
+    }
+    fin = header[0]&0x80 != 0
+    opcode = int(header[0] & 0x0f)
+    if header[1]&0x80 == 0 {
+        err = ws.fail("websocket: unmasked client frame")
+        return
+    }
+
+    length := uint64(header[1] & 0x7f)
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err = io.ReadFull(ws.br, &ext); err != nil {
+            return
+        }
+        length = uint64(binary.BigEndian.Uint16(&ext))
+    case 127:
+        var ext [8]byte
+        if _, err = io.ReadFull(ws.br, &ext); err != nil {
+            return
+        }
+        length = binary.BigEndian.Uint64(&ext)
+    }
+    if opcode >= wsClose && (length > 125 || !fin) {
+        err = ws.fail("websocket: bad control frame")
+        return
+    }
+    if length > uint64(maxWebSocketMessage) {
+        err = ws.fail("websocket: message too large")
+        return
+    }
+
+    var mask [4]byte
+    if _, err = io.ReadFull(ws.br, &mask); err != nil {
+        return
+    }
+    payload = make([]byte, length)
+    if _, err = io.ReadFull(ws.br, payload); err != nil {
+        return
+    }
+    for i := range payload {
+        payload[i] ^= mask[i%4]
+    }
+    return
+}
+
+//closes the connection after a protocol error
+func (ws *WebSocketConn) fail(message string) os.Error {
+    ws.closeWith([]byte{0x03, 0xea}) //1002, protocol error
+    return os.NewError(message)
+}
+
+//Sends data as a single TextMessage or BinaryMessage
+func (ws *WebSocketConn) WriteMessage(messageType int, data []byte) os.Error {
+    if messageType != TextMessage && messageType != BinaryMessage {
+        return os.NewError("websocket: unknown message type")
+    }
+    return ws.writeFrame(messageType, data)
+}
+
+//Sends a ping. The client's pong is skipped by ReadMessage
+func (ws *WebSocketConn) Ping(data []byte) os.Error { return ws.writeFrame(wsPing, data) }
+
+func (ws *WebSocketConn) writeFrame(opcode int, data []byte) os.Error {
+    ws.lock.Lock()
+    defer ws.lock.Unlock()
+    if ws.closed {
+        return errWebSocketClosed
+    }
+    return ws.sendFrame(opcode, data)
+}
+
+//sends a frame, with the lock held
+func (ws *WebSocketConn) sendFrame(opcode int, data []byte) os.Error {
+    var header []byte
+    switch {
+    case len(data) < 126:
+        header = []byte{0x80 | byte(opcode), byte(len(data))}
+    case len(data) <= 0xffff:
+        header = []byte{0x80 | byte(opcode), 126, 0, 0}
+        binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+    default:
+        header = make([]byte, 10)
+        header[0] = 0x80 | byte(opcode)
+        header[1] = 127
+        binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+    }
+    if _, err := ws.rwc.Write(header); err != nil {
+        return err
+    }
+    _, err := ws.rwc.Write(data)
+    return err
+}
+
+//Sends a close frame and closes the connection, unless it was closed already
+func (ws *WebSocketConn) Close() os.Error {
+    return ws.closeWith([]byte{0x03, 0xe8}) //1000, normal closure
+}
+
+func (ws *WebSocketConn) closeWith(payload []byte) os.Error {
+    ws.lock.Lock()
+    defer ws.lock.Unlock()
+    if ws.closed {
+        return nil
+    }
+    ws.closed = true
+    ws.sendFrame(wsClose, payload)
+    return ws.rwc.Close()
+}